@@ -0,0 +1,284 @@
+// SHIM - A web front end for the Hugo site generator
+// Copyright (C) 2016        Cameron Conn
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	calendarMonth = "month"
+	calendarWeek  = "week"
+
+	calendarDayFormat = "2006-01-02"
+	calendarKeyFile   = "calendar.key"
+	icalDateFormat    = "20060102T150405Z"
+)
+
+// Publication states of posts on the calendar
+const (
+	entryPublished = "published"
+	entryScheduled = "scheduled"
+	entryDraft     = "draft"
+)
+
+// CalendarEntry - A post placed on the calendar
+type CalendarEntry struct {
+	Post   *Post
+	Site   *Site
+	Date   time.Time
+	Status string // published, scheduled or draft
+}
+
+// CalendarDay - One day of a calendar
+type CalendarDay struct {
+	Date    time.Time
+	Entries []CalendarEntry
+	InRange bool // false for days of other months shown to fill a week
+	Today   bool
+}
+
+// Calendar - A month or week of posts
+type Calendar struct {
+	View  string
+	Title string
+	Start time.Time
+	End   time.Time
+	Prev  string // anchor dates of the previous and next pages
+	Next  string
+	Weeks [][]CalendarDay
+}
+
+// entryStatus works out how a post shows up on the calendar
+func entryStatus(p *Post, now time.Time) string {
+	if p.Draft {
+		return entryDraft
+	}
+	if p.HasDate() && p.Published.After(now) {
+		return entryScheduled
+	}
+	return entryPublished
+}
+
+// calendarEntries finds the posts of `sites` dated between start and end. A
+// zero end means there is no end.
+func calendarEntries(sites []*Site, start, end time.Time) []CalendarEntry {
+	now := time.Now()
+	entries := []CalendarEntry{}
+
+	for _, s := range sites {
+		s.GetAllPosts()
+		for _, p := range s.Posts {
+			// Posts nobody has put a date on don't belong on any day
+			if !p.HasDate() {
+				continue
+			}
+
+			date := *p.Date()
+			if date.Before(start) || (!end.IsZero() && !date.Before(end)) {
+				continue
+			}
+			entries = append(entries, CalendarEntry{
+				Post:   p,
+				Site:   s,
+				Date:   date,
+				Status: entryStatus(p, now),
+			})
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Date.Before(entries[j].Date) })
+	return entries
+}
+
+// startOfDay truncates a time to midnight in its location
+func startOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// startOfWeek finds the Sunday on or before a day
+func startOfWeek(t time.Time) time.Time {
+	day := startOfDay(t)
+	return day.AddDate(0, 0, -int(day.Weekday()))
+}
+
+// buildCalendar lays out the posts of `sites` for the month or week around
+// `anchor`.
+func buildCalendar(sites []*Site, view string, anchor time.Time) *Calendar {
+	c := &Calendar{View: view}
+
+	var rangeStart, rangeEnd time.Time
+	if view == calendarWeek {
+		rangeStart = startOfWeek(anchor)
+		rangeEnd = rangeStart.AddDate(0, 0, 7)
+		c.Title = "Week of " + rangeStart.Format("January 2, 2006")
+		c.Prev = rangeStart.AddDate(0, 0, -7).Format(calendarDayFormat)
+		c.Next = rangeEnd.Format(calendarDayFormat)
+	} else {
+		c.View = calendarMonth
+		rangeStart = time.Date(anchor.Year(), anchor.Month(), 1, 0, 0, 0, 0, anchor.Location())
+		rangeEnd = rangeStart.AddDate(0, 1, 0)
+		c.Title = rangeStart.Format("January 2006")
+		c.Prev = rangeStart.AddDate(0, -1, 0).Format(calendarDayFormat)
+		c.Next = rangeEnd.Format(calendarDayFormat)
+	}
+
+	// Always show whole weeks
+	c.Start = startOfWeek(rangeStart)
+	c.End = startOfWeek(rangeEnd.AddDate(0, 0, -1)).AddDate(0, 0, 7)
+
+	entries := calendarEntries(sites, c.Start, c.End)
+	today := startOfDay(time.Now().In(anchor.Location()))
+
+	for day := c.Start; day.Before(c.End); day = day.AddDate(0, 0, 7) {
+		week := make([]CalendarDay, 7)
+		for i := range week {
+			date := day.AddDate(0, 0, i)
+			week[i] = CalendarDay{
+				Date:    date,
+				InRange: !date.Before(rangeStart) && date.Before(rangeEnd),
+				Today:   date.Equal(today),
+			}
+
+			next := date.AddDate(0, 0, 1)
+			for _, e := range entries {
+				if !e.Date.Before(date) && e.Date.Before(next) {
+					week[i].Entries = append(week[i].Entries, e)
+				}
+			}
+		}
+		c.Weeks = append(c.Weeks, week)
+	}
+
+	return c
+}
+
+// Reschedule - Move a post to another day, keeping the time of day it was
+// planned for.
+func (p *Post) Reschedule(day time.Time) error {
+	date := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, day.Location())
+	if current := p.Date(); current != nil {
+		date = time.Date(day.Year(), day.Month(), day.Day(),
+			current.Hour(), current.Minute(), current.Second(), 0, current.Location())
+	}
+	p.Published = &date
+
+	return p.SavePost(p.GetBody())
+}
+
+// calendarKey is the secret used to sign calendar feed tokens. It is created
+// the first time it's needed.
+func calendarKey() ([]byte, error) {
+	keyPath := filepath.Join(shimAssets().root, calendarKeyFile)
+
+	key, err := ioutil.ReadFile(keyPath)
+	if err == nil && len(key) > 0 {
+		return key, nil
+	} else if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key = make([]byte, 32)
+	if _, err = io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	return key, ioutil.WriteFile(keyPath, key, 0600)
+}
+
+// calendarSignature signs a user name for their calendar feed
+func calendarSignature(key []byte, user string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(user))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// calendarToken - The token which lets a user's calendar app read the feed
+// without logging in.
+func calendarToken(user string) (string, error) {
+	key, err := calendarKey()
+	if err != nil {
+		return "", err
+	}
+	return user + ":" + calendarSignature(key, user), nil
+}
+
+// checkCalendarToken finds which user a calendar feed token belongs to
+func checkCalendarToken(token string) (string, error) {
+	parts := strings.SplitN(token, ":", 2)
+	if len(parts) != 2 || len(parts[0]) == 0 {
+		return "", fmt.Errorf("Invalid calendar token")
+	}
+
+	key, err := calendarKey()
+	if err != nil {
+		return "", err
+	}
+
+	expected := calendarSignature(key, parts[0])
+	if !hmac.Equal([]byte(expected), []byte(parts[1])) {
+		return "", fmt.Errorf("Invalid calendar token")
+	}
+	return parts[0], nil
+}
+
+// icalEscape escapes text for an iCalendar property
+func icalEscape(text string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`)
+	return replacer.Replace(text)
+}
+
+// writeICal writes the upcoming publications of `sites` as an iCalendar feed
+func writeICal(w io.Writer, sites []*Site) error {
+	now := time.Now()
+	entries := calendarEntries(sites, startOfDay(now), time.Time{})
+
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//shim//Content Calendar//EN",
+		"X-WR-CALNAME:Upcoming posts",
+	}
+	for _, e := range entries {
+		if e.Status == entryDraft {
+			continue
+		}
+		lines = append(lines,
+			"BEGIN:VEVENT",
+			fmt.Sprintf("UID:%s-%s@shim", e.Site.ShortName, e.Post.PostID()),
+			"DTSTAMP:"+now.UTC().Format(icalDateFormat),
+			"DTSTART:"+e.Date.UTC().Format(icalDateFormat),
+			"SUMMARY:"+icalEscape(fmt.Sprintf("%s (%s)", e.Post.Title, e.Site.Title)),
+			"DESCRIPTION:"+icalEscape(e.Post.Description),
+			"END:VEVENT",
+		)
+	}
+	lines = append(lines, "END:VCALENDAR")
+
+	_, err := io.WriteString(w, strings.Join(lines, "\r\n")+"\r\n")
+	return err
+}
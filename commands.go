@@ -0,0 +1,88 @@
+// SHIM - A web front end for the Hugo site generator
+// Copyright (C) 2016        Cameron Conn
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const commandUsage = `Usage: shim [command]
+
+Without a command, shim runs its web interface.
+
+Commands:
+  import-jekyll SOURCE SITE    Create the site SITE from the Jekyll site in SOURCE
+  help                         Show this message
+`
+
+// runCommand runs one of shim's command line tools instead of the web
+// interface. The returned value is the exit status.
+func runCommand(args []string) int {
+	switch args[0] {
+	case "import-jekyll":
+		if len(args) != 3 {
+			fmt.Fprint(os.Stderr, commandUsage)
+			return 2
+		}
+		return importJekyllCommand(args[1], args[2])
+	case "help", "-h", "--help":
+		fmt.Print(commandUsage)
+		return 0
+	}
+
+	fmt.Fprintf(os.Stderr, "Unknown command %q\n\n%s", args[0], commandUsage)
+	return 2
+}
+
+// importJekyllCommand creates a site named `name` from a Jekyll site
+func importJekyllCommand(src, name string) int {
+	if info, err := os.Stat(filepath.Join(src, "_posts")); err != nil || !info.IsDir() {
+		fmt.Fprintf(os.Stderr, "%s doesn't look like a Jekyll site: it has no _posts folder.\n", src)
+		return 1
+	}
+
+	if NormalizeName(name) != name {
+		fmt.Fprintf(os.Stderr, "Site names may only contain lowercase letters, numbers "+
+			"and dashes. Try %q instead.\n", NormalizeName(name))
+		return 1
+	}
+
+	setupSite(name)
+	s, err := loadSite(name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not open site %s: %s\n", name, err.Error())
+		return 1
+	}
+
+	report, err := s.ImportJekyll(src)
+	if report != nil {
+		fmt.Println(report.String())
+		for _, warning := range report.Warnings {
+			fmt.Printf("  warning: %s\n", warning)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Import failed: %s\n", err.Error())
+		return 1
+	}
+
+	fmt.Printf("\nImported into %s. If shim doesn't manage this site yet, add it to "+
+		"shim's config.toml:\n\n[sites.%s]\n    enabled = true\n", s.Location, name)
+	return 0
+}
@@ -0,0 +1,237 @@
+// SHIM - A web front end for the Hugo site generator
+// Copyright (C) 2016        Cameron Conn
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// commentsLock is held while a post's comment file is read, changed and written
+// back, so that two replies at once can't lose one another
+var commentsLock sync.Mutex
+
+// Comment - An editorial note on a post. Comments are kept outside of the
+// site's content so that Hugo never publishes them.
+type Comment struct {
+	ID       string    `toml:"id"`
+	Parent   string    `toml:"parent,omitempty"` // ID of the comment this replies to
+	Author   string    `toml:"author"`
+	Time     time.Time `toml:"time"`
+	Line     int       `toml:"line,omitempty"` // line of the body this is about; 0 for none
+	Body     string    `toml:"body"`
+	Resolved bool      `toml:"resolved,omitempty"`
+
+	Replies []*Comment `toml:"-"`
+	site    *Site      // for showing times in the site's time zone
+}
+
+type commentFile struct {
+	Comments []*Comment `toml:"comment"`
+}
+
+// WebTime - When this comment was made, in a format for the web
+func (c Comment) WebTime() string {
+	if c.site != nil {
+		return c.site.WebTime(c.Time)
+	}
+	return c.Time.Local().Format(dateFormat)
+}
+
+// commentsPath is where the comments of this post are kept
+func (p *Post) commentsPath() string {
+	return p.Site.commentsPath(p.PostID())
+}
+
+func (s Site) commentsPath(postID string) string {
+	return filepath.Join(s.shimDir(), "comments", postID+".toml")
+}
+
+// moveComments files the comments made while this post had the ID `from`
+// under its current ID
+func (p *Post) moveComments(from string) error {
+	commentsLock.Lock()
+	defer commentsLock.Unlock()
+
+	err := os.Rename(p.Site.commentsPath(from), p.commentsPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// readComments loads every comment on this post, in the order they were made
+func (p *Post) readComments() ([]*Comment, error) {
+	file := new(commentFile)
+	_, err := toml.DecodeFile(p.commentsPath(), file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return file.Comments, err
+}
+
+// writeComments saves every comment on this post
+func (p *Post) writeComments(comments []*Comment) error {
+	if len(comments) == 0 {
+		err := os.Remove(p.commentsPath())
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	buf := new(bytes.Buffer)
+	if err := toml.NewEncoder(buf).Encode(commentFile{Comments: comments}); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(p.commentsPath()), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(p.commentsPath(), buf.Bytes(), 0644)
+}
+
+// Comments - The comment threads on this post. Replies are attached to the
+// comment which started their thread.
+func (p *Post) Comments() []*Comment {
+	commentsLock.Lock()
+	all, err := p.readComments()
+	commentsLock.Unlock()
+	if err != nil {
+		return nil
+	}
+
+	byID := make(map[string]*Comment)
+	threads := []*Comment{}
+	for _, c := range all {
+		c.site = p.Site
+		byID[c.ID] = c
+		if parent, ok := byID[c.Parent]; ok && len(c.Parent) > 0 {
+			parent.Replies = append(parent.Replies, c)
+		} else {
+			threads = append(threads, c)
+		}
+	}
+
+	return threads
+}
+
+// OpenComments - How many comment threads on this post haven't been resolved
+func (p *Post) OpenComments() int {
+	open := 0
+	for _, c := range p.Comments() {
+		if !c.Resolved {
+			open++
+		}
+	}
+	return open
+}
+
+// AddComment - Comment on this post. `parent` is the ID of the thread being
+// replied to, or blank to start a new thread. `line` anchors a new thread to a
+// line of the post's body, and is 0 for comments on the whole post.
+func (p *Post) AddComment(author, body, parent string, line int) error {
+	body = strings.TrimSpace(body)
+	if len(body) == 0 {
+		return fmt.Errorf("Comments can't be blank.")
+	}
+
+	commentsLock.Lock()
+	defer commentsLock.Unlock()
+
+	comments, err := p.readComments()
+	if err != nil {
+		return fmt.Errorf("Could not read comments: %s", err.Error())
+	}
+
+	if len(parent) > 0 {
+		found := false
+		for _, c := range comments {
+			if c.ID == parent {
+				// Replies always belong to the comment starting their thread
+				if len(c.Parent) > 0 {
+					parent = c.Parent
+				}
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("The comment you replied to doesn't exist anymore.")
+		}
+		line = 0
+	}
+
+	if line < 0 || line > strings.Count(p.GetBody(), "\n")+1 {
+		return fmt.Errorf("The post doesn't have a line %d.", line)
+	}
+
+	comments = append(comments, &Comment{
+		ID:     newPostID(),
+		Parent: parent,
+		Author: author,
+		Time:   time.Now().UTC(),
+		Line:   line,
+		Body:   body,
+	})
+
+	return p.writeComments(comments)
+}
+
+// ResolveComment - Mark a comment thread as resolved (or open it again)
+func (p *Post) ResolveComment(id string, resolved bool) error {
+	commentsLock.Lock()
+	defer commentsLock.Unlock()
+
+	comments, err := p.readComments()
+	if err != nil {
+		return fmt.Errorf("Could not read comments: %s", err.Error())
+	}
+
+	for _, c := range comments {
+		if c.ID == id && len(c.Parent) == 0 {
+			c.Resolved = resolved
+			return p.writeComments(comments)
+		}
+	}
+
+	return fmt.Errorf("That comment doesn't exist anymore.")
+}
+
+// removeComments deletes all comments on this post
+func (p *Post) removeComments() error {
+	commentsLock.Lock()
+	defer commentsLock.Unlock()
+
+	return p.writeComments(nil)
+}
+
+// BodyLine - A line of this post's body, for showing what a comment is about
+func (p *Post) BodyLine(line int) string {
+	lines := strings.Split(p.GetBody(), "\n")
+	if line < 1 || line > len(lines) {
+		return ""
+	}
+	return lines[line-1]
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestComments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shim-comments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTestPost(t, dir, "post/a.md", "+++\ntitle = \"A\"\n+++\nOne\nTwo\n", time.Now())
+	s := &Site{Location: dir, contentDir: "content"}
+	s.GetAllPosts()
+	p := s.Posts[0]
+
+	errs := []struct {
+		body, parent string
+		line         int
+	}{
+		{"  ", "", 0},
+		{"Too far", "", 5},
+		{"Reply to nothing", "nothing", 0},
+	}
+	for _, e := range errs {
+		if err = p.AddComment("ann", e.body, e.parent, e.line); err == nil {
+			t.Errorf("The comment %q should have been refused\n", e.body)
+		}
+	}
+
+	if err = p.AddComment("ann", "About line two", "", 2); err != nil {
+		t.Fatal(err)
+	}
+	threads := p.Comments()
+	if len(threads) != 1 || threads[0].Line != 2 {
+		t.Fatalf("Expected one comment on line 2, not %v\n", threads)
+	}
+	if err = p.AddComment("bob", "A reply", threads[0].ID, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err = p.ResolveComment(threads[0].ID, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// The post gets an ID of its own when it's first saved, and its comments
+	// go with it
+	if err = p.save(p.GetBody()); err != nil {
+		t.Fatal(err)
+	}
+	threads = p.Comments()
+	if len(threads) != 1 || len(threads[0].Replies) != 1 || !threads[0].Resolved {
+		t.Errorf("The comments were lost when the post was saved: %v\n", threads)
+	} else if threads[0].Replies[0].Line != 0 {
+		t.Errorf("Replies shouldn't be about a line")
+	}
+}
@@ -38,11 +38,12 @@ func findUserSite(rw http.ResponseWriter, req *http.Request) *Site {
 	siteCookie, err := req.Cookie("currentSite")
 	validSite := false
 
-	userSite := allSites[0] // Default to first site
+	sites := siteList()
+	userSite := sites[0] // Default to first site
 
 	if err == nil {
 		siteName = siteCookie.Value
-		for _, s := range allSites {
+		for _, s := range sites {
 			if len(siteName) == len(s.ShortName) && siteName == s.ShortName {
 				validSite = true
 				userSite = s
@@ -58,6 +59,16 @@ func findUserSite(rw http.ResponseWriter, req *http.Request) *Site {
 	return userSite
 }
 
+// siteNamed finds a site by its short name, or nil if there isn't one
+func siteNamed(name string) *Site {
+	for _, s := range siteList() {
+		if s.ShortName == name {
+			return s
+		}
+	}
+	return nil
+}
+
 func setUserSite(rw http.ResponseWriter, req *http.Request, siteName string) {
 	newSiteCookie := http.Cookie{
 		Name:     "currentSite",
@@ -0,0 +1,530 @@
+// SHIM - A web front end for the Hugo site generator
+// Copyright (C) 2016        Cameron Conn
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+const (
+	configDir = "config" // Hugo's configuration folder, in a site
+
+	// The environment shim builds sites for, which picks the folder in
+	// `config/` whose settings override the defaults
+	configEnvironment = "production"
+
+	configTOML = "toml"
+	configYAML = "yaml"
+	configJSON = "json"
+)
+
+// The names of a site's main configuration file, in the order Hugo looks for
+// them. Only the first one found is used.
+var configFileNames = []string{
+	"hugo.toml", "hugo.yaml", "hugo.yml", "hugo.json",
+	"config.toml", "config.yaml", "config.yml", "config.json",
+}
+
+// configFile - One of the files a site's configuration is in
+type configFile struct {
+	Path     string   // relative to the site
+	Format   string   // configTOML, configYAML or configJSON
+	Prefix   []string // where its settings go, like ["params"] for params.toml
+	Settings map[string]interface{}
+	edits    []configEdit // not saved yet
+}
+
+// configEdit - A change to one setting in a configuration file
+type configEdit struct {
+	path   []string // relative to the file's prefix
+	value  interface{}
+	remove bool
+}
+
+// siteConfig - All of a site's configuration files, in the order Hugo merges
+// them. Settings in later files win.
+type siteConfig struct {
+	Files  []*configFile
+	Merged map[string]interface{}
+}
+
+// configFormat works out the format of a configuration file from its name
+func configFormat(name string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".toml":
+		return configTOML
+	case ".yaml", ".yml":
+		return configYAML
+	case ".json":
+		return configJSON
+	}
+	return ""
+}
+
+// parseConfig decodes a configuration file. Maps always have string keys, so
+// YAML and TOML settings look the same.
+func parseConfig(src []byte, format string) (map[string]interface{}, error) {
+	var settings interface{}
+	var err error
+
+	switch format {
+	case configTOML:
+		m := make(map[string]interface{})
+		_, err = toml.Decode(string(src), &m)
+		settings = m
+	case configYAML:
+		err = yaml.Unmarshal(src, &settings)
+	case configJSON:
+		err = json.Unmarshal(src, &settings)
+	default:
+		return nil, fmt.Errorf("Unknown configuration format %s", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if settings == nil {
+		return make(map[string]interface{}), nil // an empty file
+	}
+	m, ok := normalizeConfig(settings).(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("The configuration needs to be a table of settings")
+	}
+	return m, nil
+}
+
+// normalizeConfig turns every map in a decoded configuration into a
+// map[string]interface{}, and drops empty values, which TOML can't hold.
+func normalizeConfig(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			if item != nil {
+				m[fmt.Sprint(key)] = normalizeConfig(item)
+			}
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			if item != nil {
+				m[key] = normalizeConfig(item)
+			}
+		}
+		return m
+	case []interface{}:
+		list := make([]interface{}, 0, len(v))
+		for _, item := range v {
+			if item != nil {
+				list = append(list, normalizeConfig(item))
+			}
+		}
+		return list
+	case []map[string]interface{}:
+		list := make([]map[string]interface{}, len(v))
+		for i, item := range v {
+			list[i] = normalizeConfig(item).(map[string]interface{})
+		}
+		return list
+	}
+	return value
+}
+
+// encodeConfig writes settings in a configuration file's format
+func encodeConfig(settings map[string]interface{}, format string) ([]byte, error) {
+	switch format {
+	case configTOML:
+		buf := new(bytes.Buffer)
+		tomlEncoder := toml.NewEncoder(buf)
+		tomlEncoder.Indent = "    "
+		err := tomlEncoder.Encode(settings)
+		return buf.Bytes(), err
+	case configYAML:
+		return yaml.Marshal(settings)
+	case configJSON:
+		src, err := json.MarshalIndent(settings, "", "  ")
+		return append(src, '\n'), err
+	}
+	return nil, fmt.Errorf("Unknown configuration format %s", format)
+}
+
+// configKey finds a key in settings, ignoring case like Hugo does
+func configKey(settings map[string]interface{}, key string) (string, bool) {
+	if _, ok := settings[key]; ok {
+		return key, true
+	}
+	for k := range settings {
+		if strings.EqualFold(k, key) {
+			return k, true
+		}
+	}
+	return key, false
+}
+
+// lowercaseConfig copies settings with every table's keys in lowercase
+func lowercaseConfig(value interface{}) interface{} {
+	m, ok := value.(map[string]interface{})
+	if !ok {
+		return value
+	}
+
+	lower := make(map[string]interface{}, len(m))
+	for key, item := range m {
+		lower[strings.ToLower(key)] = lowercaseConfig(item)
+	}
+	return lower
+}
+
+// copyConfig copies settings, so that changing the copy's tables doesn't
+// change the original's
+func copyConfig(value interface{}) interface{} {
+	m, ok := value.(map[string]interface{})
+	if !ok {
+		return value
+	}
+
+	copied := make(map[string]interface{}, len(m))
+	for key, item := range m {
+		copied[key] = copyConfig(item)
+	}
+	return copied
+}
+
+// mergeConfig merges settings into `dst`. Tables are merged key by key, and
+// anything else in `src` replaces what's in `dst`.
+func mergeConfig(dst, src map[string]interface{}) {
+	for key, value := range src {
+		key = strings.ToLower(key)
+		if from, ok := value.(map[string]interface{}); ok {
+			if into, ok := dst[key].(map[string]interface{}); ok {
+				mergeConfig(into, from)
+				continue
+			}
+		}
+		dst[key] = lowercaseConfig(value)
+	}
+}
+
+// get finds the setting at `path` in this file. Tables above this file's
+// prefix are found too, since the file holds part of them.
+func (f *configFile) get(path []string) (interface{}, bool) {
+	for i, key := range f.Prefix {
+		if i == len(path) {
+			return f.Settings, true
+		}
+		if !strings.EqualFold(key, path[i]) {
+			return nil, false
+		}
+	}
+
+	var value interface{} = f.Settings
+	for _, key := range path[len(f.Prefix):] {
+		table, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if key, ok = configKey(table, key); !ok {
+			return nil, false
+		}
+		value = table[key]
+	}
+	return value, true
+}
+
+// canSet tells whether the setting at `path` would go in this file
+func (f *configFile) canSet(path []string) bool {
+	if len(path) <= len(f.Prefix) {
+		return false
+	}
+	for i, key := range f.Prefix {
+		if !strings.EqualFold(key, path[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// set changes the setting at `path` in this file, making tables as needed
+func (f *configFile) set(path []string, value interface{}) {
+	table := f.Settings
+	rest := path[len(f.Prefix):]
+	for _, key := range rest[:len(rest)-1] {
+		key, _ = configKey(table, key)
+		next, ok := table[key].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			table[key] = next
+		}
+		table = next
+	}
+
+	key, _ := configKey(table, rest[len(rest)-1])
+	table[key] = value
+	f.edits = append(f.edits, configEdit{path: rest, value: value})
+}
+
+// remove takes the setting at `path` out of this file
+func (f *configFile) remove(path []string) bool {
+	if !f.canSet(path) {
+		return false
+	}
+	parent, ok := f.get(path[:len(path)-1])
+	table, isTable := parent.(map[string]interface{})
+	if !ok || !isTable {
+		return false
+	}
+
+	key, found := configKey(table, path[len(path)-1])
+	if found {
+		delete(table, key)
+		f.edits = append(f.edits, configEdit{path: path[len(f.Prefix):], remove: true})
+	}
+	return found
+}
+
+// source works out what this file should say now. TOML files are edited in
+// place, so only the settings which changed are touched, and everything else
+// (comments too) stays as it was. Other files are written again.
+func (f *configFile) source(location string) ([]byte, error) {
+	old, err := ioutil.ReadFile(filepath.Join(location, f.Path))
+	if f.Format != configTOML || os.IsNotExist(err) {
+		return encodeConfig(f.Settings, f.Format)
+	} else if err != nil {
+		return nil, err
+	}
+
+	doc, err := parseTOMLDoc(string(old))
+	if err != nil {
+		return nil, err
+	}
+	for _, edit := range f.edits {
+		if edit.remove {
+			err = doc.remove(edit.path)
+		} else {
+			err = doc.set(edit.path, edit.value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Could not change %s: %s", tomlKey(edit.path), err.Error())
+		}
+	}
+
+	// Make sure the edits left the file readable
+	src := doc.String()
+	if _, err = parseConfig([]byte(src), configTOML); err != nil {
+		return nil, fmt.Errorf("Could not edit %s: %s", f.Path, err.Error())
+	}
+	return []byte(src), nil
+}
+
+// findConfigFiles lists a site's configuration files in the order Hugo merges
+// them: the main file, then `config/_default/`, then the folder for
+// configEnvironment.
+func findConfigFiles(location string) ([]*configFile, error) {
+	files := []*configFile{}
+
+	for _, name := range configFileNames {
+		if _, err := os.Stat(filepath.Join(location, name)); err == nil {
+			files = append(files, &configFile{Path: name, Format: configFormat(name)})
+			break
+		}
+	}
+
+	for _, env := range []string{"_default", configEnvironment} {
+		dir := filepath.Join(configDir, env)
+		infos, err := ioutil.ReadDir(filepath.Join(location, dir))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("Could not read %s: %s", dir, err.Error())
+		}
+
+		names := []string{}
+		for _, info := range infos {
+			if !info.IsDir() && len(configFormat(info.Name())) > 0 {
+				names = append(names, info.Name())
+			}
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			files = append(files, &configFile{
+				Path:   filepath.Join(dir, name),
+				Format: configFormat(name),
+				Prefix: configDirPrefix(name),
+			})
+		}
+	}
+
+	if len(files) == 0 {
+		return nil, fmt.Errorf("Could not find a configuration file in %s", location)
+	}
+	return files, nil
+}
+
+// configDirPrefix works out where the settings of a file in `config/` go.
+// `hugo.toml` and `config.toml` hold top level settings, `params.toml` holds
+// `params`, and `menus.en.toml` holds the `menus` of the `en` language.
+func configDirPrefix(name string) []string {
+	parts := strings.Split(strings.TrimSuffix(name, filepath.Ext(name)), ".")
+	switch {
+	case parts[0] == "hugo" || parts[0] == "config":
+		return nil
+	case len(parts) > 1:
+		return []string{"languages", parts[1], parts[0]}
+	}
+	return []string{parts[0]}
+}
+
+// loadSiteConfig reads and merges all of a site's configuration files
+func loadSiteConfig(location string) (*siteConfig, error) {
+	files, err := findConfigFiles(location)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range files {
+		src, err := ioutil.ReadFile(filepath.Join(location, f.Path))
+		if err != nil {
+			return nil, fmt.Errorf("Could not read %s: %s", f.Path, err.Error())
+		}
+		if f.Settings, err = parseConfig(src, f.Format); err != nil {
+			return nil, fmt.Errorf("Could not read %s: %s", f.Path, err.Error())
+		}
+	}
+
+	c := &siteConfig{Files: files}
+	c.merge()
+	return c, nil
+}
+
+// merge works out the settings Hugo sees from all of the files
+func (c *siteConfig) merge() {
+	c.Merged = make(map[string]interface{})
+	for _, f := range c.Files {
+		settings := f.Settings
+		for i := len(f.Prefix) - 1; i >= 0; i-- {
+			settings = map[string]interface{}{f.Prefix[i]: settings}
+		}
+		mergeConfig(c.Merged, settings)
+	}
+}
+
+// MainFile - The file top level settings go in when no file has them yet
+func (c *siteConfig) MainFile() *configFile {
+	for _, f := range c.Files {
+		if len(f.Prefix) == 0 {
+			return f
+		}
+	}
+
+	f := &configFile{Path: "config.toml", Format: configTOML, Settings: make(map[string]interface{})}
+	c.Files = append([]*configFile{f}, c.Files...)
+	return f
+}
+
+// File - Find one of the configuration files by its path
+func (c *siteConfig) File(path string) *configFile {
+	for _, f := range c.Files {
+		if f.Path == path {
+			return f
+		}
+	}
+	return nil
+}
+
+// owner finds the file which should hold a changed setting: the last file
+// which has it, or else the last one which has the closest table around it.
+func (c *siteConfig) owner(path []string) *configFile {
+	for end := len(path); end > 0; end-- {
+		for i := len(c.Files) - 1; i >= 0; i-- {
+			f := c.Files[i]
+			if !f.canSet(path) {
+				continue
+			}
+			value, ok := f.get(path[:end])
+			if _, isTable := value.(map[string]interface{}); ok && (end == len(path) || isTable) {
+				return f
+			}
+		}
+	}
+	return c.MainFile()
+}
+
+// sameConfigValue tells whether two settings are the same, even when they
+// were decoded as different types
+func sameConfigValue(a, b interface{}) bool {
+	return reflect.DeepEqual(a, b) || fmt.Sprint(a) == fmt.Sprint(b)
+}
+
+// apply changes the files so they hold `settings`, and lists the files which
+// changed. Each setting is changed in the file which defines it.
+func (c *siteConfig) apply(settings map[string]interface{}) []*configFile {
+	changed := make(map[*configFile]bool)
+	c.applyTable(nil, lowercaseConfig(settings).(map[string]interface{}), c.Merged, changed)
+	c.merge()
+
+	files := []*configFile{}
+	for _, f := range c.Files {
+		if changed[f] {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+func (c *siteConfig) applyTable(path []string, settings, old map[string]interface{}, changed map[*configFile]bool) {
+	for key, value := range settings {
+		keyPath := append(append([]string{}, path...), key)
+		oldValue, existed := old[key]
+
+		newTable, isTable := value.(map[string]interface{})
+		oldTable, wasTable := oldValue.(map[string]interface{})
+		if isTable && wasTable {
+			c.applyTable(keyPath, newTable, oldTable, changed)
+			continue
+		}
+
+		if !existed || !sameConfigValue(value, oldValue) {
+			f := c.owner(keyPath)
+			f.set(keyPath, value)
+			changed[f] = true
+		}
+	}
+
+	for key := range old {
+		if _, ok := settings[key]; ok {
+			continue
+		}
+		keyPath := append(append([]string{}, path...), key)
+		for _, f := range c.Files {
+			if f.remove(keyPath) {
+				changed[f] = true
+			}
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestConfigDirPrefix(t *testing.T) {
+	inputs := []string{"hugo.toml", "config.yaml", "params.toml", "menus.en.json"}
+	outputs := [][]string{nil, nil, {"params"}, {"languages", "en", "menus"}}
+
+	for i, input := range inputs {
+		if prefix := configDirPrefix(input); !reflect.DeepEqual(prefix, outputs[i]) {
+			t.Errorf("%s was supposed to go in %v, not %v\n", input, outputs[i], prefix)
+		}
+	}
+}
+
+func TestSiteConfigApply(t *testing.T) {
+	main := &configFile{Path: "config.toml", Format: configTOML, Settings: map[string]interface{}{
+		"Title":  "Base",
+		"theme":  "slim",
+		"params": map[string]interface{}{"color": "red"},
+	}}
+	params := &configFile{Path: "config/_default/params.toml", Format: configTOML, Prefix: []string{"params"},
+		Settings: map[string]interface{}{"author": "Ann"}}
+	production := &configFile{Path: "config/production/hugo.toml", Format: configTOML,
+		Settings: map[string]interface{}{"title": "Prod"}}
+
+	c := &siteConfig{Files: []*configFile{main, params, production}}
+	c.merge()
+	if c.Merged["title"] != "Prod" {
+		t.Fatalf("The merged title was supposed to be Prod, not %v\n", c.Merged["title"])
+	}
+
+	changed := c.apply(map[string]interface{}{
+		"title": "New",
+		"theme": "slim",
+		"params": map[string]interface{}{
+			"color":    "red",
+			"author":   "Bob",
+			"subtitle": "Hi",
+		},
+	})
+	if !reflect.DeepEqual(changed, []*configFile{params, production}) {
+		t.Errorf("Only the params and production files were supposed to change, not %v\n", changed)
+	}
+
+	if production.Settings["title"] != "New" || main.Settings["Title"] != "Base" {
+		t.Errorf("The title was supposed to change in the production file only\n")
+	}
+	if params.Settings["author"] != "Bob" || params.Settings["subtitle"] != "Hi" {
+		t.Errorf("Params were supposed to change in the params file, not %v\n", params.Settings)
+	}
+}
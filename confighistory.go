@@ -0,0 +1,357 @@
+// SHIM - A web front end for the Hugo site generator
+// Copyright (C) 2016        Cameron Conn
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	configVersionsDir  = "config-versions" // in a site's shim folder
+	configVersionsFile = "config-versions.toml"
+	configVersionsKept = 50
+	configVersionID    = "20060102-150405.000000000"
+)
+
+var regexConfigVersionID = regexp.MustCompile(`^[0-9]{8}-[0-9]{6}\.[0-9]{9}$`)
+
+// Only one configuration is written at a time
+var configLock sync.Mutex
+
+// ConfigVersion - An earlier version of a site's configuration
+type ConfigVersion struct {
+	ID       string
+	File     string    // which configuration file, relative to the site
+	Saved    time.Time // when this version was written
+	User     string    // who wrote it, or empty if shim did
+	Replaced time.Time // when it stopped being the current version
+	site     *Site
+}
+
+// Author - Who wrote this version, for people
+func (v ConfigVersion) Author() string {
+	if len(v.User) == 0 {
+		return "shim"
+	}
+	return v.User
+}
+
+// WebSaved - When this version was written, for people
+func (v ConfigVersion) WebSaved() string {
+	if v.site != nil {
+		return v.site.WebTime(v.Saved)
+	}
+	return v.Saved.Local().Format(dateFormat)
+}
+
+// WebReplaced - When this version was replaced, for people
+func (v ConfigVersion) WebReplaced() string {
+	if v.site != nil {
+		return v.site.WebTime(v.Replaced)
+	}
+	return v.Replaced.Local().Format(dateFormat)
+}
+
+// configHistory - Who wrote each of a site's current configuration files, and
+// the versions before them, newest first
+type configHistory struct {
+	Current  map[string]ConfigVersion // by file
+	Versions []ConfigVersion
+}
+
+// DiffLine - One line of a diff between two versions of a file
+type DiffLine struct {
+	Kind string // " " if both have it, "-" if only the old one, "+" if only the new one
+	Text string
+}
+
+// diffLines compares two versions of a file line by line
+func diffLines(old, new []string) []DiffLine {
+	// common[i][j] is the longest common subsequence of old[i:] and new[j:]
+	common := make([][]int, len(old)+1)
+	for i := range common {
+		common[i] = make([]int, len(new)+1)
+	}
+	for i := len(old) - 1; i >= 0; i-- {
+		for j := len(new) - 1; j >= 0; j-- {
+			if old[i] == new[j] {
+				common[i][j] = common[i+1][j+1] + 1
+			} else if common[i+1][j] >= common[i][j+1] {
+				common[i][j] = common[i+1][j]
+			} else {
+				common[i][j] = common[i][j+1]
+			}
+		}
+	}
+
+	diff := []DiffLine{}
+	i, j := 0, 0
+	for i < len(old) && j < len(new) {
+		switch {
+		case old[i] == new[j]:
+			diff = append(diff, DiffLine{" ", old[i]})
+			i++
+			j++
+		case common[i+1][j] >= common[i][j+1]:
+			diff = append(diff, DiffLine{"-", old[i]})
+			i++
+		default:
+			diff = append(diff, DiffLine{"+", new[j]})
+			j++
+		}
+	}
+	for ; i < len(old); i++ {
+		diff = append(diff, DiffLine{"-", old[i]})
+	}
+	for ; j < len(new); j++ {
+		diff = append(diff, DiffLine{"+", new[j]})
+	}
+	return diff
+}
+
+// configPath is where this site's main configuration file is
+func (s Site) configPath() string {
+	if s.config == nil {
+		return filepath.Join(s.Location, "config.toml")
+	}
+	return filepath.Join(s.Location, s.config.MainFile().Path)
+}
+
+// ConfigFiles - The files this site's configuration is in, in the order Hugo
+// reads them
+func (s Site) ConfigFiles() []string {
+	if s.config == nil {
+		return []string{"config.toml"}
+	}
+
+	files := []string{}
+	for _, f := range s.config.Files {
+		files = append(files, f.Path)
+	}
+	return files
+}
+
+// configFilePath checks that `file` is one of this site's configuration files
+// and finds where it is
+func (s Site) configFilePath(file string) (string, error) {
+	for _, name := range s.ConfigFiles() {
+		if name == file {
+			return filepath.Join(s.Location, file), nil
+		}
+	}
+	return "", fmt.Errorf("%s isn't one of this site's configuration files.", file)
+}
+
+func (s Site) configVersionPath(id string) string {
+	return filepath.Join(s.shimDir(), configVersionsDir, id)
+}
+
+func (s *Site) readConfigHistory() (*configHistory, error) {
+	history := new(configHistory)
+	_, err := toml.DecodeFile(filepath.Join(s.shimDir(), configVersionsFile), history)
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	if history.Current == nil {
+		history.Current = make(map[string]ConfigVersion)
+	}
+
+	for i := range history.Versions {
+		if len(history.Versions[i].File) == 0 {
+			history.Versions[i].File = "config.toml" // kept before sites had other files
+		}
+		history.Versions[i].site = s
+	}
+	return history, err
+}
+
+func (s Site) writeConfigHistory(history *configHistory) error {
+	buf := new(bytes.Buffer)
+	if err := toml.NewEncoder(buf).Encode(history); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(s.shimDir(), configVersionsFile), buf.Bytes(), 0644)
+}
+
+// writeConfig replaces one of this site's configuration files, and keeps the
+// one it replaces as a version which can be rolled back to.
+func (s *Site) writeConfig(file string, src []byte, user string) error {
+	configLock.Lock()
+	defer configLock.Unlock()
+	return s.writeConfigLocked(file, src, user)
+}
+
+func (s *Site) writeConfigLocked(file string, src []byte, user string) error {
+	history, err := s.readConfigHistory()
+	if err != nil {
+		return fmt.Errorf("Could not read configuration versions: %s", err.Error())
+	}
+	if err = os.MkdirAll(filepath.Join(s.shimDir(), configVersionsDir), 0755); err != nil {
+		return fmt.Errorf("Could not create configuration versions folder: %s", err.Error())
+	}
+
+	filePath := filepath.Join(s.Location, file)
+	now := time.Now()
+	old, err := ioutil.ReadFile(filePath)
+	if err == nil {
+		previous := history.Current[file]
+		if previous.Saved.IsZero() {
+			// Written before shim kept versions
+			if info, err := os.Stat(filePath); err == nil {
+				previous.Saved = info.ModTime()
+			}
+		}
+		previous.ID = now.UTC().Format(configVersionID)
+		previous.File = file
+		previous.Replaced = now
+
+		if err = ioutil.WriteFile(s.configVersionPath(previous.ID), old, 0644); err != nil {
+			return fmt.Errorf("Could not keep the previous configuration: %s", err.Error())
+		}
+		history.Versions = append([]ConfigVersion{previous}, history.Versions...)
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("Could not read %s: %s", file, err.Error())
+	}
+
+	for len(history.Versions) > configVersionsKept {
+		last := history.Versions[len(history.Versions)-1]
+		os.Remove(s.configVersionPath(last.ID))
+		history.Versions = history.Versions[:len(history.Versions)-1]
+	}
+
+	if err = os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return fmt.Errorf("Could not create the folder for %s: %s", file, err.Error())
+	}
+	if err = ioutil.WriteFile(filePath, src, 0666); err != nil {
+		return fmt.Errorf("Could not save %s: %s", file, err.Error())
+	}
+
+	history.Current[file] = ConfigVersion{File: file, Saved: now, User: user}
+	if err = s.writeConfigHistory(history); err != nil {
+		return fmt.Errorf("Configuration was saved, but its version couldn't be recorded: %s",
+			err.Error())
+	}
+	return nil
+}
+
+// ConfigVersions - The earlier versions of this site's configuration, newest
+// first
+func (s *Site) ConfigVersions() ([]ConfigVersion, error) {
+	configLock.Lock()
+	defer configLock.Unlock()
+
+	history, err := s.readConfigHistory()
+	if err != nil {
+		return nil, err
+	}
+	return history.Versions, nil
+}
+
+// ConfigVersion - Find an earlier version of this site's configuration and
+// what it says
+func (s *Site) ConfigVersion(id string) (*ConfigVersion, string, error) {
+	if !regexConfigVersionID.MatchString(id) {
+		return nil, "", fmt.Errorf("There is no configuration version %s.", id)
+	}
+
+	versions, err := s.ConfigVersions()
+	if err != nil {
+		return nil, "", err
+	}
+	for i := range versions {
+		if versions[i].ID != id {
+			continue
+		}
+
+		src, err := ioutil.ReadFile(s.configVersionPath(id))
+		if err != nil {
+			return nil, "", fmt.Errorf("Could not read configuration version %s: %s", id, err.Error())
+		}
+		return &versions[i], string(src), nil
+	}
+	return nil, "", fmt.Errorf("There is no configuration version %s.", id)
+}
+
+// DiffConfigVersion - What changed between a version of this site's
+// configuration and the current one
+func (s *Site) DiffConfigVersion(id string) ([]DiffLine, error) {
+	version, old, err := s.ConfigVersion(id)
+	if err != nil {
+		return nil, err
+	}
+
+	// A file which is gone is compared as if it were empty
+	current, err := ioutil.ReadFile(filepath.Join(s.Location, version.File))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("Could not read %s: %s", version.File, err.Error())
+	}
+
+	return diffLines(strings.Split(old, "\n"), strings.Split(string(current), "\n")), nil
+}
+
+// replaceConfig saves a new version of one of this site's configuration
+// files and reloads the site with it, returning the reloaded site. If the site
+// can't use it, the file is put back the way it was.
+func (s *Site) replaceConfig(file string, src []byte, user string) (fresh *Site, err error) {
+	filePath := filepath.Join(s.Location, file)
+	old, err := ioutil.ReadFile(filePath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("Could not read %s: %s", file, err.Error())
+	}
+	existed := err == nil
+
+	if err = s.writeConfig(file, src, user); err != nil {
+		return nil, err
+	}
+
+	// Whatever goes wrong, a file which can't be loaded is never left behind
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Could not reload site: %v", r)
+		}
+		if err == nil {
+			return
+		}
+		if existed {
+			s.writeConfig(file, old, user)
+		} else {
+			os.Remove(filePath)
+		}
+	}()
+
+	return s.Reload()
+}
+
+// RollbackConfig - Go back to an earlier version of one of this site's
+// configuration files and reload the site, returning the reloaded site. The
+// current file is kept as a version too.
+func (s *Site) RollbackConfig(id, user string) (*Site, error) {
+	version, src, err := s.ConfigVersion(id)
+	if err != nil {
+		return nil, err
+	}
+	return s.replaceConfig(version.File, []byte(src), user)
+}
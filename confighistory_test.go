@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestDiffLines(t *testing.T) {
+	old := strings.Split("title = \"Old\"\ntheme = \"slim\"\n[params]\nauthor = \"Me\"", "\n")
+	new := strings.Split("title = \"New\"\ntheme = \"slim\"\n[params]\nauthor = \"Me\"\nsubtitle = \"Hi\"", "\n")
+
+	outputs := []DiffLine{
+		{"-", "title = \"Old\""},
+		{"+", "title = \"New\""},
+		{" ", "theme = \"slim\""},
+		{" ", "[params]"},
+		{" ", "author = \"Me\""},
+		{"+", "subtitle = \"Hi\""},
+	}
+
+	diff := diffLines(old, new)
+	if len(diff) != len(outputs) {
+		t.Fatalf("The diff was supposed to be %v, not %v\n", outputs, diff)
+	}
+	for i, line := range diff {
+		if line != outputs[i] {
+			t.Errorf("Line %d of the diff was supposed to be %v, not %v\n", i, outputs[i], line)
+		}
+	}
+}
+
+func TestReplaceConfigRestores(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shim-replace-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	good := "title = \"Blog\"\n"
+	os.MkdirAll(filepath.Join(dir, "content"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "config.toml"), []byte(good), 0644)
+
+	config := viper.New()
+	config.Set("sites.blog.dir", dir)
+	old := shim.state
+	setShimState(shimState{config: config, assets: &assets{}})
+	defer setShimState(old)
+
+	s, err := loadSite("blog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.replaceConfig("config.toml", []byte("title = \"Blog\"\ncontentDir = \"missing\"\n"), "ann"); err == nil {
+		t.Errorf("A content folder which doesn't exist was accepted")
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "config.toml")); string(data) != good {
+		t.Errorf("The configuration which couldn't be loaded was left behind:\n%s\n", data)
+	}
+
+	// The reloaded site is served in place of the old one, which requests
+	// may still be using
+	sitesMu.Lock()
+	oldSites := allSites
+	allSites = []*Site{s}
+	sitesMu.Unlock()
+	defer func() { sitesMu.Lock(); allSites = oldSites; sitesMu.Unlock() }()
+
+	fresh, err := s.replaceConfig("config.toml", []byte("title = \"New\"\n"), "ann")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fresh == s || fresh.Title != "New" || s.Title != "Blog" || siteNamed("blog") != fresh {
+		t.Errorf("The reloaded site should replace the old one, which stays as it was")
+	}
+}
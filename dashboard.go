@@ -0,0 +1,219 @@
+// SHIM - A web front end for the Hugo site generator
+// Copyright (C) 2016        Cameron Conn
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	statsMonths      = 12 // months of posting frequency on the dashboard
+	statsRecentEdits = 8
+)
+
+// StatCount - How many posts something has
+type StatCount struct {
+	Name    string
+	Count   int
+	Percent int // of the largest count in its list, for drawing bars
+}
+
+// RecentEdit - A post and when its file last changed
+type RecentEdit struct {
+	Post   *Post
+	Edited time.Time
+}
+
+// SiteStats - Numbers about a site's content for its dashboard
+type SiteStats struct {
+	Published int
+	Drafts    int
+	Scheduled int
+
+	Authors     []StatCount
+	Terms       map[string][]StatCount // by taxonomy (plural)
+	Months      []StatCount            // published posts per month, oldest first
+	RecentEdits []RecentEdit
+
+	StaticFiles int
+	StaticBytes int64
+}
+
+// StaticSize - How much space static files use, for people
+func (st SiteStats) StaticSize() string {
+	return humanBytes(st.StaticBytes)
+}
+
+// humanBytes formats a number of bytes with a unit
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// rankCounts turns counts into a list with the largest first
+func rankCounts(counts map[string]int) []StatCount {
+	ranked := []StatCount{}
+	for name, count := range counts {
+		ranked = append(ranked, StatCount{Name: name, Count: count})
+	}
+
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].Count != ranked[j].Count {
+			return ranked[i].Count > ranked[j].Count
+		}
+		return ranked[i].Name < ranked[j].Name
+	})
+
+	setPercents(ranked)
+	return ranked
+}
+
+// setPercents works out the size of each count's bar
+func setPercents(counts []StatCount) {
+	most := 0
+	for _, c := range counts {
+		if c.Count > most {
+			most = c.Count
+		}
+	}
+	if most == 0 {
+		return
+	}
+
+	for i := range counts {
+		counts[i].Percent = counts[i].Count * 100 / most
+	}
+}
+
+// Stats - Count this site's posts in every way its dashboard shows them
+func (s *Site) Stats() *SiteStats {
+	s.GetAllPosts()
+
+	st := &SiteStats{Terms: make(map[string][]StatCount)}
+	now := time.Now().In(s.TimeZone())
+
+	// The months shown, with the current month last
+	thisMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	firstMonth := thisMonth.AddDate(0, 1-statsMonths, 0)
+	for i := 0; i < statsMonths; i++ {
+		st.Months = append(st.Months, StatCount{Name: firstMonth.AddDate(0, i, 0).Format("Jan 2006")})
+	}
+
+	authors := make(map[string]int)
+	terms := make(map[string]map[string]int)
+
+	for _, p := range s.Posts {
+		switch entryStatus(p, now) {
+		case entryDraft:
+			st.Drafts++
+			continue
+		case entryScheduled:
+			st.Scheduled++
+			continue
+		}
+
+		st.Published++
+		authors[p.Author()]++
+
+		for plural, postTerms := range p.Taxonomies {
+			if terms[plural] == nil {
+				terms[plural] = make(map[string]int)
+			}
+			for _, term := range postTerms {
+				terms[plural][term]++
+			}
+		}
+
+		if p.HasDate() {
+			date := p.Published.In(s.TimeZone())
+			month := (date.Year()-firstMonth.Year())*12 + int(date.Month()-firstMonth.Month())
+			if month >= 0 && month < statsMonths {
+				st.Months[month].Count++
+			}
+		}
+	}
+
+	st.Authors = rankCounts(authors)
+	for plural, counts := range terms {
+		st.Terms[plural] = rankCounts(counts)
+	}
+	setPercents(st.Months)
+
+	st.RecentEdits = s.recentEdits(statsRecentEdits)
+	st.StaticFiles, st.StaticBytes = dirUsage(s.staticDir())
+
+	return st
+}
+
+// staticDir is the folder hugo copies static files from, which is set by the
+// site's `staticDir` setting.
+func (s *Site) staticDir() string {
+	dir, _ := s.allSettings["staticdir"].(string)
+	if len(dir) == 0 {
+		dir = "static"
+	}
+	if filepath.IsAbs(dir) {
+		return dir
+	}
+	return filepath.Join(s.Location, dir)
+}
+
+// recentEdits finds the posts whose files changed most recently
+func (s *Site) recentEdits(count int) []RecentEdit {
+	edits := []RecentEdit{}
+	for _, p := range s.Posts {
+		info, err := os.Stat(p.Location)
+		if err != nil {
+			continue
+		}
+		edits = append(edits, RecentEdit{Post: p, Edited: info.ModTime()})
+	}
+
+	sort.Slice(edits, func(i, j int) bool { return edits[i].Edited.After(edits[j].Edited) })
+	if len(edits) > count {
+		edits = edits[:count]
+	}
+	return edits
+}
+
+// dirUsage counts the files in a folder and how many bytes they use
+func dirUsage(dir string) (files int, size int64) {
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if !info.IsDir() {
+			files++
+			size += info.Size()
+		}
+		return nil
+	})
+	return
+}
@@ -0,0 +1,119 @@
+// SHIM - A web front end for the Hugo site generator
+// Copyright (C) 2016        Cameron Conn
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Date formats found in front matter, as well as the one shim shows. Dates
+// without a time zone are in the site's time zone, like Hugo does.
+var dateFormats = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05 -07:00",
+	"2006-01-02 15:04:05Z07:00",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04",
+	"2006-01-02",
+	dateFormat,
+}
+
+// parseDate reads a date from front matter or a web form. TOML may have
+// already decoded the date, and anything else is read as text.
+func parseDate(value interface{}, loc *time.Location) (time.Time, error) {
+	var text string
+	switch v := value.(type) {
+	case time.Time:
+		return v, nil
+	case *time.Time:
+		if v != nil {
+			return *v, nil
+		}
+	case string:
+		text = v
+	default:
+		text = fmt.Sprint(v)
+	}
+
+	text = strings.TrimSpace(text)
+	for _, format := range dateFormats {
+		if t, err := time.ParseInLocation(format, text, loc); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("%q isn't a date. Use a date like %q.", text,
+		time.Now().In(loc).Format(dateFormat))
+}
+
+// loadTimeZone finds a time zone by its name (like "America/New_York"). A
+// blank name is shim's own time zone.
+func loadTimeZone(name string) (*time.Location, error) {
+	if len(strings.TrimSpace(name)) == 0 {
+		return time.Local, nil
+	}
+
+	loc, err := time.LoadLocation(strings.TrimSpace(name))
+	if err != nil {
+		return time.Local, fmt.Errorf("Unknown time zone %q", name)
+	}
+	return loc, nil
+}
+
+// TimeZone - The time zone this site's dates are shown and entered in. It's
+// set with Hugo's `timeZone` setting.
+func (s Site) TimeZone() *time.Location {
+	if s.timeZone == nil {
+		return time.Local
+	}
+	return s.timeZone
+}
+
+// TimeZoneName - This site's `timeZone` setting, or blank if it doesn't have
+// one.
+func (s Site) TimeZoneName() string {
+	name, _ := s.allSettings["timezone"].(string)
+	return name
+}
+
+// setTimeZone changes this site's `timeZone` setting
+func (s *Site) setTimeZone(name string) error {
+	loc, err := loadTimeZone(name)
+	if err != nil {
+		return err
+	}
+
+	s.timeZone = loc
+	if len(strings.TrimSpace(name)) > 0 {
+		s.allSettings["timezone"] = strings.TrimSpace(name)
+	} else {
+		delete(s.allSettings, "timezone")
+	}
+	return nil
+}
+
+// WebTime - A time shown in this site's time zone
+func (s Site) WebTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.In(s.TimeZone()).Format(dateFormat)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDate(t *testing.T) {
+	oslo, err := time.LoadLocation("Europe/Oslo")
+	if err != nil {
+		t.Skip("time zone data isn't available")
+	}
+
+	inputs := []interface{}{
+		"2016-06-01T12:30:00Z",
+		"2016-06-01T12:30:00-04:00",
+		"2016-06-01T12:30:00",
+		"2016-06-01",
+		" 1 Jun 2016 @ 12:30 ",
+		time.Date(2016, 6, 1, 12, 30, 0, 0, time.UTC),
+	}
+
+	outputs := []time.Time{
+		time.Date(2016, 6, 1, 12, 30, 0, 0, time.UTC),
+		time.Date(2016, 6, 1, 16, 30, 0, 0, time.UTC),
+		time.Date(2016, 6, 1, 12, 30, 0, 0, oslo),
+		time.Date(2016, 6, 1, 0, 0, 0, 0, oslo),
+		time.Date(2016, 6, 1, 12, 30, 0, 0, oslo),
+		time.Date(2016, 6, 1, 12, 30, 0, 0, time.UTC),
+	}
+
+	for i, input := range inputs {
+		date, err := parseDate(input, oslo)
+		if err != nil {
+			t.Errorf("Could not parse %v: %s\n", input, err.Error())
+		} else if !date.Equal(outputs[i]) {
+			t.Errorf("%v was supposed to be %s, not %s\n", input, outputs[i], date)
+		}
+	}
+
+	for _, input := range []interface{}{"", "yesterday", "2016-13-45", 42} {
+		if _, err := parseDate(input, oslo); err == nil {
+			t.Errorf("%v isn't a date, but it was parsed as one\n", input)
+		}
+	}
+}
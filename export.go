@@ -0,0 +1,171 @@
+// SHIM - A web front end for the Hugo site generator
+// Copyright (C) 2016        Cameron Conn
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+const (
+	exportZip   = "zip"
+	exportTarGz = "tar.gz"
+)
+
+// archiveWriter - A writer for one of the archive formats sites are exported
+// as.
+type archiveWriter interface {
+	add(name string, info os.FileInfo, r io.Reader) error
+	Close() error
+}
+
+type zipArchive struct {
+	w *zip.Writer
+}
+
+func (z *zipArchive) add(name string, info os.FileInfo, r io.Reader) error {
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	header.Method = zip.Deflate
+
+	f, err := z.w.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	return err
+}
+
+func (z *zipArchive) Close() error {
+	return z.w.Close()
+}
+
+type tarGzArchive struct {
+	gz *gzip.Writer
+	w  *tar.Writer
+}
+
+func (t *tarGzArchive) add(name string, info os.FileInfo, r io.Reader) error {
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+
+	if err = t.w.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.Copy(t.w, r)
+	return err
+}
+
+func (t *tarGzArchive) Close() error {
+	if err := t.w.Close(); err != nil {
+		return err
+	}
+	return t.gz.Close()
+}
+
+// newArchiveWriter starts an archive of the given format
+func newArchiveWriter(w io.Writer, format string) (archiveWriter, error) {
+	switch format {
+	case exportZip:
+		return &zipArchive{w: zip.NewWriter(w)}, nil
+	case exportTarGz:
+		gz := gzip.NewWriter(w)
+		return &tarGzArchive{gz: gz, w: tar.NewWriter(gz)}, nil
+	}
+	return nil, fmt.Errorf("Unknown archive format %q", format)
+}
+
+// ExportName - The file name for an export of this site in `format`
+func (s Site) ExportName(format string) string {
+	return fmt.Sprintf("%s-%s.%s", s.ShortName, time.Now().Format("2006-01-02"), format)
+}
+
+// exportPaths are the files and folders (relative to the site) that make up
+// an export.
+func (s Site) exportPaths(includePublic bool) []string {
+	// Every configuration file is exported, not just the ones shim reads
+	paths := append([]string{}, configFileNames...)
+	paths = append(paths, configDir, s.ContentDir(), "static", "data", "archetypes")
+	if includePublic {
+		paths = append(paths, s.PublishDir())
+	}
+	return paths
+}
+
+// Export - Write an archive of this site's content, static files, data,
+// archetypes and configuration to `w`. The archive is either a zip or a
+// tar.gz file, and can optionally include the last public build.
+func (s *Site) Export(w io.Writer, format string, includePublic bool) error {
+	archive, err := newArchiveWriter(w, format)
+	if err != nil {
+		return err
+	}
+
+	for _, rel := range s.exportPaths(includePublic) {
+		if err = s.archiveTree(archive, rel); err != nil {
+			archive.Close()
+			return fmt.Errorf("Could not export %s: %s", rel, err.Error())
+		}
+	}
+
+	return archive.Close()
+}
+
+// archiveTree adds the files in `rel` (a folder or file of this site) to an
+// archive. Symlinks, like those of themes, are left out.
+func (s *Site) archiveTree(archive archiveWriter, rel string) error {
+	root := filepath.Join(s.Location, rel)
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		return nil
+	}
+
+	return filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil // folders are implied by their files
+		}
+
+		name, err := filepath.Rel(s.Location, p)
+		if err != nil {
+			return err
+		}
+		name = path.Join(s.ShortName, filepath.ToSlash(name))
+
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		return archive.add(name, info, f)
+	})
+}
@@ -0,0 +1,472 @@
+// SHIM - A web front end for the Hugo site generator
+// Copyright (C) 2016        Cameron Conn
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Ghost replaces its own URL with this placeholder in exports
+const ghostURLPlaceholder = "__GHOST_URL__"
+
+// ghostExport - The parts of a Ghost JSON export which shim uses. Newer
+// versions of Ghost wrap the export in a `db` list.
+type ghostExport struct {
+	DB   []ghostDB `json:"db"`
+	Data ghostData `json:"data"`
+}
+
+type ghostDB struct {
+	Data ghostData `json:"data"`
+}
+
+type ghostData struct {
+	Posts        []ghostPost      `json:"posts"`
+	Tags         []ghostTag       `json:"tags"`
+	Users        []ghostUser      `json:"users"`
+	PostsTags    []ghostPostTag   `json:"posts_tags"`
+	PostsAuthors []ghostPostOwner `json:"posts_authors"`
+}
+
+type ghostPost struct {
+	ID              json.RawMessage `json:"id"` // a number in old exports, a string in new ones
+	Title           string          `json:"title"`
+	Slug            string          `json:"slug"`
+	Mobiledoc       string          `json:"mobiledoc"`
+	Markdown        string          `json:"markdown"` // Ghost 0.x
+	HTML            string          `json:"html"`
+	Type            string          `json:"type"`
+	Page            bool            `json:"page"` // Ghost 1.x
+	Status          string          `json:"status"`
+	PublishedAt     json.RawMessage `json:"published_at"`
+	CreatedAt       json.RawMessage `json:"created_at"`
+	CustomExcerpt   string          `json:"custom_excerpt"`
+	MetaDescription string          `json:"meta_description"`
+	AuthorID        json.RawMessage `json:"author_id"`
+}
+
+type ghostTag struct {
+	ID   json.RawMessage `json:"id"`
+	Name string          `json:"name"`
+}
+
+type ghostUser struct {
+	ID   json.RawMessage `json:"id"`
+	Name string          `json:"name"`
+}
+
+type ghostPostTag struct {
+	PostID    json.RawMessage `json:"post_id"`
+	TagID     json.RawMessage `json:"tag_id"`
+	SortOrder int             `json:"sort_order"`
+}
+
+type ghostPostOwner struct {
+	PostID    json.RawMessage `json:"post_id"`
+	AuthorID  json.RawMessage `json:"author_id"`
+	SortOrder int             `json:"sort_order"`
+}
+
+// ghostID normalizes an ID, which may be either a number or a string
+func ghostID(raw json.RawMessage) string {
+	return strings.Trim(string(raw), `"`)
+}
+
+// ghostTime reads a date, which is either an ISO 8601 string or milliseconds
+// since the epoch depending on the version of Ghost.
+func ghostTime(raw json.RawMessage) *time.Time {
+	var ms int64
+	if err := json.Unmarshal(raw, &ms); err == nil && ms > 0 {
+		t := time.Unix(ms/1000, (ms%1000)*int64(time.Millisecond))
+		return &t
+	}
+
+	var text string
+	if err := json.Unmarshal(raw, &text); err != nil || len(text) == 0 {
+		return nil
+	}
+	for _, format := range []string{time.RFC3339Nano, "2006-01-02 15:04:05"} {
+		if t, err := time.ParseInLocation(format, text, time.UTC); err == nil {
+			return &t
+		}
+	}
+	return nil
+}
+
+// mobiledoc - A Ghost post body in the Mobiledoc format. Sections and markers
+// are arrays of mixed types, so they are decoded by hand.
+type mobiledoc struct {
+	Atoms    [][]json.RawMessage `json:"atoms"`
+	Cards    [][]json.RawMessage `json:"cards"`
+	Markups  [][]json.RawMessage `json:"markups"`
+	Sections [][]json.RawMessage `json:"sections"`
+}
+
+// Mobiledoc section types
+const (
+	mobiledocMarkupSection = 1
+	mobiledocImageSection  = 2
+	mobiledocListSection   = 3
+	mobiledocCardSection   = 10
+)
+
+// markerHTML renders a list of Mobiledoc markers (runs of text with opening
+// and closing markup) as HTML.
+func (doc mobiledoc) markerHTML(markers []json.RawMessage) string {
+	var b strings.Builder
+	open := []string{}
+
+	for _, raw := range markers {
+		var marker []json.RawMessage
+		if err := json.Unmarshal(raw, &marker); err != nil || len(marker) < 4 {
+			continue
+		}
+
+		var kind, closed int
+		var opened []int
+		json.Unmarshal(marker[0], &kind)
+		json.Unmarshal(marker[1], &opened)
+		json.Unmarshal(marker[2], &closed)
+
+		for _, i := range opened {
+			if i < 0 || i >= len(doc.Markups) {
+				continue
+			}
+			var tag string
+			var attrs []string
+			if len(doc.Markups[i]) == 0 {
+				continue
+			}
+			json.Unmarshal(doc.Markups[i][0], &tag)
+			if len(doc.Markups[i]) > 1 {
+				json.Unmarshal(doc.Markups[i][1], &attrs)
+			}
+
+			b.WriteString("<" + tag)
+			for j := 0; j+1 < len(attrs); j += 2 {
+				fmt.Fprintf(&b, ` %s="%s"`, attrs[j], html.EscapeString(attrs[j+1]))
+			}
+			b.WriteString(">")
+			open = append(open, tag)
+		}
+
+		if kind == 0 {
+			var text string
+			json.Unmarshal(marker[3], &text)
+			b.WriteString(html.EscapeString(text))
+		} else {
+			// Atoms are inline cards. The only common one is a line break.
+			var i int
+			json.Unmarshal(marker[3], &i)
+			if i >= 0 && i < len(doc.Atoms) && len(doc.Atoms[i]) > 0 {
+				var name string
+				json.Unmarshal(doc.Atoms[i][0], &name)
+				if name == "soft-return" {
+					b.WriteString("<br>")
+				}
+			}
+		}
+
+		for ; closed > 0 && len(open) > 0; closed-- {
+			b.WriteString("</" + open[len(open)-1] + ">")
+			open = open[:len(open)-1]
+		}
+	}
+
+	for i := len(open) - 1; i >= 0; i-- {
+		b.WriteString("</" + open[i] + ">")
+	}
+
+	return b.String()
+}
+
+// cardMarkdown renders one of Ghost's cards (rich blocks like images or raw
+// Markdown) as Markdown.
+func (doc mobiledoc) cardMarkdown(i int) string {
+	if i < 0 || i >= len(doc.Cards) || len(doc.Cards[i]) < 2 {
+		return ""
+	}
+
+	var name string
+	payload := make(map[string]interface{})
+	json.Unmarshal(doc.Cards[i][0], &name)
+	json.Unmarshal(doc.Cards[i][1], &payload)
+	get := func(key string) string {
+		if value, ok := payload[key].(string); ok {
+			return value
+		}
+		return ""
+	}
+
+	switch name {
+	case "markdown", "card-markdown":
+		return strings.TrimSpace(get("markdown"))
+	case "html":
+		return htmlToMarkdown(get("html"))
+	case "image":
+		md := fmt.Sprintf("![%s](%s)", get("alt"), get("src"))
+		if caption := get("caption"); len(caption) > 0 {
+			md += "\n\n" + htmlToMarkdown(caption)
+		}
+		return md
+	case "code":
+		return "```" + get("language") + "\n" + strings.TrimRight(get("code"), "\n") + "\n```"
+	case "hr":
+		return "---"
+	case "embed":
+		return strings.TrimSpace(get("html"))
+	}
+	return ""
+}
+
+// mobiledocToMarkdown converts a Ghost Mobiledoc post body to Markdown
+func mobiledocToMarkdown(src string) (string, error) {
+	var doc mobiledoc
+	if err := json.Unmarshal([]byte(src), &doc); err != nil {
+		return "", err
+	}
+
+	blocks := []string{}
+	for _, section := range doc.Sections {
+		if len(section) < 2 {
+			continue
+		}
+		var kind int
+		json.Unmarshal(section[0], &kind)
+
+		switch kind {
+		case mobiledocMarkupSection:
+			var tag string
+			var markers []json.RawMessage
+			json.Unmarshal(section[1], &tag)
+			if len(section) > 2 {
+				json.Unmarshal(section[2], &markers)
+			}
+			if tag == "pull-quote" || tag == "aside" {
+				tag = "blockquote"
+			}
+			blocks = append(blocks, htmlToMarkdown("<"+tag+">"+doc.markerHTML(markers)+"</"+tag+">"))
+		case mobiledocImageSection:
+			var src string
+			json.Unmarshal(section[1], &src)
+			blocks = append(blocks, fmt.Sprintf("![](%s)", src))
+		case mobiledocListSection:
+			var tag string
+			var items [][]json.RawMessage
+			json.Unmarshal(section[1], &tag)
+			if len(section) > 2 {
+				json.Unmarshal(section[2], &items)
+			}
+			list := "<" + tag + ">"
+			for _, item := range items {
+				list += "<li>" + doc.markerHTML(item) + "</li>"
+			}
+			blocks = append(blocks, htmlToMarkdown(list+"</"+tag+">"))
+		case mobiledocCardSection:
+			var i int
+			json.Unmarshal(section[1], &i)
+			blocks = append(blocks, doc.cardMarkdown(i))
+		}
+	}
+
+	nonEmpty := blocks[:0]
+	for _, b := range blocks {
+		if b = strings.TrimSpace(b); len(b) > 0 {
+			nonEmpty = append(nonEmpty, b)
+		}
+	}
+	return strings.Join(nonEmpty, "\n\n") + "\n", nil
+}
+
+var regexGhostImage = regexp.MustCompile(`https?://[^\s"'()<>]+/content/images/[^\s"'()<>]+`)
+
+// resolveGhostURL puts the old site's address back into links which Ghost
+// replaced with its placeholder. Without an address, the links are left
+// relative to this site.
+func resolveGhostURL(body, siteURL string) string {
+	return strings.Replace(body, ghostURLPlaceholder, strings.TrimRight(siteURL, "/"), -1)
+}
+
+// ImportGhost - Import posts and pages from a Ghost JSON export into this
+// site. If `attachments` is true, images which the export links to on the old
+// site are downloaded into this site's static files. Newer exports leave the
+// old site's address out of links, so images are found with `siteURL`.
+func (s *Site) ImportGhost(data io.Reader, attachments bool, siteURL string) (*importReport, error) {
+	siteURL = strings.TrimSpace(siteURL)
+	if len(siteURL) > 0 {
+		if u, err := url.Parse(siteURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			return nil, fmt.Errorf("%q isn't the address of a site. It should look like https://example.com.", siteURL)
+		}
+	}
+
+	export := new(ghostExport)
+	if err := json.NewDecoder(data).Decode(export); err != nil {
+		return nil, fmt.Errorf("Could not read Ghost export: %s", err.Error())
+	}
+
+	db := export.Data
+	if len(export.DB) > 0 {
+		db = export.DB[0].Data
+	}
+
+	report := new(importReport)
+
+	users := make(map[string]string)
+	for _, u := range db.Users {
+		users[ghostID(u.ID)] = u.Name
+	}
+	tags := make(map[string]string)
+	for _, t := range db.Tags {
+		// Tags starting with # are internal to Ghost and never shown
+		if !strings.HasPrefix(t.Name, "#") {
+			tags[ghostID(t.ID)] = t.Name
+		}
+	}
+
+	sort.SliceStable(db.PostsTags, func(i, j int) bool {
+		return db.PostsTags[i].SortOrder < db.PostsTags[j].SortOrder
+	})
+	postTags := make(map[string][]string)
+	for _, pt := range db.PostsTags {
+		if name, ok := tags[ghostID(pt.TagID)]; ok {
+			post := ghostID(pt.PostID)
+			postTags[post] = append(postTags[post], name)
+		}
+	}
+
+	sort.SliceStable(db.PostsAuthors, func(i, j int) bool {
+		return db.PostsAuthors[i].SortOrder < db.PostsAuthors[j].SortOrder
+	})
+	postAuthors := make(map[string]string)
+	for _, pa := range db.PostsAuthors {
+		post := ghostID(pa.PostID)
+		if _, ok := postAuthors[post]; !ok {
+			postAuthors[post] = users[ghostID(pa.AuthorID)]
+		}
+	}
+
+	client := &http.Client{Timeout: 60 * time.Second}
+	downloaded := make(map[string]string)
+
+	newKinds := false
+	for _, gp := range db.Posts {
+		id := ghostID(gp.ID)
+
+		section := "post"
+		if gp.Type == "page" || gp.Page {
+			section = ""
+		}
+
+		var body string
+		var err error
+		switch {
+		case len(gp.Mobiledoc) > 0:
+			body, err = mobiledocToMarkdown(gp.Mobiledoc)
+		case len(gp.Markdown) > 0:
+			body = gp.Markdown
+		default:
+			body = htmlToMarkdown(gp.HTML)
+		}
+		if err != nil {
+			if len(gp.HTML) == 0 {
+				report.warn("Could not read the body of %q: %s", gp.Title, err.Error())
+				continue
+			}
+			body = htmlToMarkdown(gp.HTML)
+		}
+
+		if attachments && len(siteURL) == 0 &&
+			strings.Contains(body, ghostURLPlaceholder+"/content/images/") {
+			report.warn("The images of %q weren't downloaded, because the old site's address wasn't given.",
+				gp.Title)
+		}
+		body = resolveGhostURL(body, siteURL)
+		if attachments {
+			body = regexGhostImage.ReplaceAllStringFunc(body, func(link string) string {
+				if name, ok := downloaded[link]; ok {
+					return name
+				}
+				name, err := s.downloadStaticFile(client, link)
+				if err != nil {
+					report.warn("Could not download %s: %s", link, err.Error())
+					return link
+				}
+				report.Files++
+				downloaded[link] = "files/" + name
+				return downloaded[link]
+			})
+		}
+
+		date := ghostTime(gp.PublishedAt)
+		if date == nil {
+			date = ghostTime(gp.CreatedAt)
+		}
+
+		ip := &importedPost{
+			Section:     section,
+			Slug:        gp.Slug,
+			Title:       gp.Title,
+			Author:      postAuthors[id],
+			Description: gp.CustomExcerpt,
+			Date:        date,
+			Draft:       gp.Status != "published" && gp.Status != "scheduled",
+			Body:        body,
+			Terms:       map[string][]string{"tag": postTags[id]},
+		}
+		if len(ip.Author) == 0 {
+			ip.Author = users[ghostID(gp.AuthorID)]
+		}
+		if len(ip.Description) == 0 {
+			ip.Description = gp.MetaDescription
+		}
+
+		// Ghost serves both posts and pages at /slug/. Pages end up at the same
+		// URL in Hugo, but posts need an alias.
+		if section != "" && len(gp.Slug) > 0 && !ip.Draft {
+			ip.Aliases = []string{"/" + gp.Slug + "/"}
+		}
+
+		_, created, err := s.importPost(ip)
+		newKinds = newKinds || created
+		if err != nil {
+			report.warn("Could not import %q: %s", ip.Title, err.Error())
+			continue
+		}
+
+		report.Posts++
+		if ip.Draft {
+			report.Drafts++
+		}
+	}
+
+	if newKinds {
+		if err := s.SaveConfig(); err != nil {
+			report.warn("Could not save new taxonomies: %s", err.Error())
+		}
+	}
+
+	return report, nil
+}
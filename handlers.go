@@ -66,8 +66,9 @@ func (l *loginHandler) authHandler(h http.Handler) http.Handler {
 			return
 		}
 
+		basepath := shimAssets().basepath
 		redirectTarget := fmt.Sprintf("%s/login/?redirect=%s%s&warn=yes",
-			shimAssets.basepath, shimAssets.basepath, url.QueryEscape(r.URL.String()))
+			basepath, basepath, url.QueryEscape(r.URL.String()))
 		log.Printf("Not logged in! Redirecting to %s\n", redirectTarget)
 		http.Redirect(w, r, redirectTarget, http.StatusSeeOther)
 	})
@@ -141,7 +142,7 @@ func panicHandler(h http.Handler) http.Handler {
 
 				tmpWrapper := new(WebWrapper)
 				tmpWrapper.FailedMessage(fmt.Sprint(r))
-				tmpWrapper.Base = shimAssets.baseurl
+				tmpWrapper.Base = shimAssets().baseurl
 				tmpWrapper.URL = req.URL.String()
 
 				w.WriteHeader(http.StatusInternalServerError)
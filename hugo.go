@@ -0,0 +1,191 @@
+// SHIM - A web front end for the Hugo site generator
+// Copyright (C) 2016        Cameron Conn
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultHugo = "hugo" // found on the PATH
+
+var regexHugoVersion = regexp.MustCompile(`v?([0-9]+)\.([0-9]+)(?:\.([0-9]+))?`)
+
+// HugoVersion - A version of Hugo
+type HugoVersion struct {
+	Major, Minor, Patch int
+	Extended            bool   // whether it can build Sass
+	Output              string // what `hugo version` said
+}
+
+func (v HugoVersion) String() string {
+	version := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if v.Extended {
+		version += " (extended)"
+	}
+	return version
+}
+
+// older tells whether this version came before `other`
+func (v HugoVersion) older(other HugoVersion) bool {
+	if v.Major != other.Major {
+		return v.Major < other.Major
+	}
+	if v.Minor != other.Minor {
+		return v.Minor < other.Minor
+	}
+	return v.Patch < other.Patch
+}
+
+// parseHugoVersion finds the version in the output of `hugo version`, or in a
+// version like "0.110.0" from a site's configuration
+func parseHugoVersion(text string) (*HugoVersion, error) {
+	m := regexHugoVersion.FindStringSubmatch(text)
+	if m == nil {
+		return nil, fmt.Errorf("%q isn't a Hugo version", strings.TrimSpace(text))
+	}
+
+	v := &HugoVersion{Output: strings.TrimSpace(text)}
+	v.Major, _ = strconv.Atoi(m[1])
+	v.Minor, _ = strconv.Atoi(m[2])
+	if len(m[3]) > 0 {
+		v.Patch, _ = strconv.Atoi(m[3])
+	}
+	v.Extended = strings.Contains(text, "extended")
+	return v, nil
+}
+
+// hugoPath finds the Hugo executable the site `name` uses. It's the site's
+// `hugo` setting in shim's configuration, or else shim's own `hugo` setting,
+// or else whichever hugo is on the PATH.
+func hugoPath(name string) (string, error) {
+	hugo := shimConfig().GetString(fmt.Sprintf("sites.%s.hugo", name))
+	if len(hugo) == 0 {
+		hugo = shimConfig().GetString("hugo")
+	}
+	if len(hugo) == 0 {
+		hugo = defaultHugo
+	}
+
+	found, err := exec.LookPath(hugo)
+	if err != nil {
+		return "", fmt.Errorf("Could not find the hugo executable %s. Is hugo installed?", hugo)
+	}
+	return found, nil
+}
+
+// The version of each Hugo executable, which is only asked again once the
+// executable changes
+var hugoVersions = struct {
+	sync.Mutex
+	byPath map[string]hugoVersionEntry
+}{byPath: make(map[string]hugoVersionEntry)}
+
+type hugoVersionEntry struct {
+	modified time.Time
+	version  *HugoVersion
+}
+
+// hugoVersion asks the Hugo executable at `path` which version it is
+func hugoVersion(path string) (*HugoVersion, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	hugoVersions.Lock()
+	entry, ok := hugoVersions.byPath[path]
+	hugoVersions.Unlock()
+	if ok && entry.modified.Equal(info.ModTime()) {
+		return entry.version, nil
+	}
+
+	output, err := exec.Command(path, "version").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("Could not get the version of %s: %s", path, err.Error())
+	}
+	version, err := parseHugoVersion(string(output))
+	if err != nil {
+		return nil, err
+	}
+
+	hugoVersions.Lock()
+	hugoVersions.byPath[path] = hugoVersionEntry{modified: info.ModTime(), version: version}
+	hugoVersions.Unlock()
+	return version, nil
+}
+
+// HugoPath - The Hugo executable this site is built with
+func (s Site) HugoPath() (string, error) {
+	return hugoPath(s.ShortName)
+}
+
+// requiredHugo reads which Hugo this site needs from its configuration's
+// `module.hugoVersion` table, if it has one
+func (s Site) requiredHugo() (least *HugoVersion, extended bool, err error) {
+	module, _ := s.allSettings["module"].(map[string]interface{})
+	required, _ := module["hugoversion"].(map[string]interface{})
+
+	extended, _ = required["extended"].(bool)
+	if text, ok := required["min"].(string); ok && len(text) > 0 {
+		if least, err = parseHugoVersion(text); err != nil {
+			return nil, false, fmt.Errorf("module.hugoVersion.min: %s", err.Error())
+		}
+	}
+	return least, extended, nil
+}
+
+// HugoStatus - Which Hugo builds a site, and whether it can
+type HugoStatus struct {
+	Path    string
+	Version *HugoVersion
+	Warning string // why it can't build the site, if it can't
+}
+
+// Hugo - Which Hugo builds this site, and whether it can
+func (s Site) Hugo() HugoStatus {
+	status := HugoStatus{}
+	var err error
+
+	if status.Path, err = s.HugoPath(); err != nil {
+		status.Warning = err.Error()
+		return status
+	}
+	if status.Version, err = hugoVersion(status.Path); err != nil {
+		status.Warning = err.Error()
+		return status
+	}
+
+	least, extended, err := s.requiredHugo()
+	switch {
+	case err != nil:
+		status.Warning = err.Error()
+	case least != nil && status.Version.older(*least):
+		status.Warning = fmt.Sprintf("This site needs Hugo %d.%d.%d or newer, but %s is %s.",
+			least.Major, least.Minor, least.Patch, status.Path, status.Version)
+	case extended && !status.Version.Extended:
+		status.Warning = fmt.Sprintf("This site needs the extended edition of Hugo, but %s is %s.",
+			status.Path, status.Version)
+	}
+	return status
+}
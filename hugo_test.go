@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseHugoVersion(t *testing.T) {
+	inputs := []string{
+		"Hugo Static Site Generator v0.20 BuildDate: 2017-04-10T13:29:27-04:00",
+		"hugo v0.120.4-f11bca5fec2ebb3a02727fb2a5cfb08da96fd9df+extended linux/amd64 BuildDate=2023-11-08T11:18:07Z",
+		"0.110.0",
+	}
+
+	outputs := []HugoVersion{
+		{Major: 0, Minor: 20},
+		{Major: 0, Minor: 120, Patch: 4, Extended: true},
+		{Major: 0, Minor: 110},
+	}
+
+	for i, input := range inputs {
+		v, err := parseHugoVersion(input)
+		if err != nil {
+			t.Errorf("Could not parse %q: %s\n", input, err.Error())
+			continue
+		}
+
+		want := outputs[i]
+		if v.Major != want.Major || v.Minor != want.Minor || v.Patch != want.Patch || v.Extended != want.Extended {
+			t.Errorf("Expected %s from %q, not %s\n", want, input, v)
+		}
+	}
+
+	if _, err := parseHugoVersion("no version here"); err == nil {
+		t.Error("Found a version where there was none\n")
+	}
+
+	if !outputs[0].older(outputs[2]) || outputs[1].older(outputs[2]) || outputs[2].older(outputs[2]) {
+		t.Error("Versions weren't compared in order\n")
+	}
+}
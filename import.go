@@ -0,0 +1,517 @@
+// SHIM - A web front end for the Hugo site generator
+// Copyright (C) 2016        Cameron Conn
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// importedPost - A post being brought into a site from another blogging
+// platform.
+type importedPost struct {
+	Section     string // Empty for root-level pages
+	Slug        string
+	Title       string
+	Author      string
+	Description string
+	Date        *time.Time
+	Draft       bool
+	Body        string // Markdown
+	Aliases     []string
+
+	// Taxonomy terms of this post, indexed by the singular name of their
+	// taxonomy (e.g. "tag").
+	Terms map[string][]string
+}
+
+// importReport - What happened during an import
+type importReport struct {
+	Posts    int
+	Drafts   int
+	Files    int
+	Warnings []string
+}
+
+func (r *importReport) warn(format string, args ...interface{}) {
+	r.Warnings = append(r.Warnings, fmt.Sprintf(format, args...))
+}
+
+func (r importReport) String() string {
+	return fmt.Sprintf("Imported %d posts (%d drafts) and %d files with %d warnings.",
+		r.Posts, r.Drafts, r.Files, len(r.Warnings))
+}
+
+// importTaxonomy finds the taxonomy with the given names, creating it if this
+// site doesn't have it yet. The returned boolean is true when the taxonomy is
+// new, in which case the site's configuration needs to be saved.
+func (s *Site) importTaxonomy(singular, plural string) (*Taxonomy, bool) {
+	if kind, err := s.Taxonomies().GetTaxonomy(plural); err == nil {
+		return kind, false
+	}
+	if kind, err := s.Taxonomies().GetTaxonomy(singular); err == nil {
+		return kind, false
+	}
+
+	s.Taxonomies().NewTaxonomy(singular, plural)
+	kind, _ := s.Taxonomies().GetTaxonomy(plural)
+	return kind, true
+}
+
+// importPost writes an imported post to this site's content directory. If a
+// post already exists at its path, a number is added to the file name. The
+// returned boolean is true if new taxonomies were created.
+func (s *Site) importPost(ip *importedPost) (*Post, bool, error) {
+	name := NormalizeName(ip.Slug)
+	if len(name) == 0 {
+		name = NormalizeName(ip.Title)
+	}
+	if len(name) == 0 {
+		name = "untitled"
+	}
+	name = strings.Replace(name, "/", "-", -1)
+
+	contentDir := filepath.Join(s.Location, s.ContentDir())
+	relPath := path.Join(ip.Section, name)
+	for i := 2; ; i++ {
+		if _, err := os.Stat(filepath.Join(contentDir, relPath+".md")); os.IsNotExist(err) {
+			break
+		}
+		relPath = path.Join(ip.Section, fmt.Sprintf("%s-%d", name, i))
+	}
+
+	location := filepath.Join(contentDir, relPath+".md")
+	if err := os.MkdirAll(filepath.Dir(location), 0755); err != nil {
+		return nil, false, fmt.Errorf("Could not create section %s: %s", ip.Section, err.Error())
+	}
+
+	p := &Post{
+		Location:   location,
+		RelPath:    relPath,
+		Site:       s,
+		Title:      ip.Title,
+		author:     ip.Author,
+		ManualDesc: ip.Description,
+		Slug:       ip.Slug,
+		Draft:      ip.Draft,
+		Aliases:    ip.Aliases,
+		Taxonomies: make(map[string][]string),
+		all:        make(map[string]interface{}),
+	}
+
+	// Like posts written in shim, drafts don't get a date until they're published
+	if ip.Date != nil && !ip.Draft {
+		p.Published = ip.Date
+	}
+
+	newKinds := false
+	for singular, terms := range ip.Terms {
+		if len(terms) == 0 {
+			continue
+		}
+		kind, created := s.importTaxonomy(singular, pluralize(singular))
+		newKinds = newKinds || created
+
+		removeDuplicates(&terms)
+		p.Taxonomies[kind.Plural()] = terms
+	}
+
+	err := p.save(ip.Body)
+	if err != nil {
+		return nil, newKinds, fmt.Errorf("Could not save %s: %s", relPath, err.Error())
+	}
+
+	return p, newKinds, nil
+}
+
+// pluralize guesses the plural of a taxonomy name
+func pluralize(singular string) string {
+	if strings.HasSuffix(singular, "y") && !strings.HasSuffix(singular, "ey") {
+		return singular[:len(singular)-1] + "ies"
+	}
+	if strings.HasSuffix(singular, "s") {
+		return singular + "es"
+	}
+	return singular + "s"
+}
+
+// aliasFromURL turns an absolute URL from an old site into a Hugo alias
+func aliasFromURL(link string) string {
+	link = strings.TrimSpace(link)
+	if i := strings.Index(link, "://"); i >= 0 {
+		link = link[i+3:]
+		if j := strings.Index(link, "/"); j >= 0 {
+			link = link[j:]
+		} else {
+			link = "/"
+		}
+	}
+
+	// Links like `/?p=123` can't be turned into aliases
+	if strings.ContainsAny(link, "?#") || link == "/" || len(link) == 0 {
+		return ""
+	}
+
+	return link
+}
+
+// Elements which never have an end tag
+var voidElements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true,
+	"hr": true, "img": true, "input": true, "link": true, "meta": true,
+	"param": true, "source": true, "track": true, "wbr": true,
+}
+
+// Elements which end a paragraph that's still open
+var blockElements = map[string]bool{
+	"address": true, "article": true, "aside": true, "blockquote": true,
+	"div": true, "dl": true, "figure": true, "footer": true, "h1": true,
+	"h2": true, "h3": true, "h4": true, "h5": true, "h6": true, "header": true,
+	"hr": true, "ol": true, "p": true, "pre": true, "section": true,
+	"table": true, "ul": true,
+}
+
+var regexTag = regexp.MustCompile(`^<(/?)([a-zA-Z][a-zA-Z0-9]*)((?:\s+[^\s"'>/=]+(?:\s*=\s*(?:"[^"]*"|'[^']*'|[^\s"'>]+))?)*)\s*(/?)>`)
+var regexAttr = regexp.MustCompile(`([^\s"'>/=]+)(?:\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'>]+)))?`)
+var regexBlankLines = regexp.MustCompile(`\n{3,}`)
+var regexTrailingSpace = regexp.MustCompile(`[ \t]+\n`)
+
+// htmlNode - A very forgiving HTML element used for converting imported posts
+type htmlNode struct {
+	tag      string // empty for text
+	text     string
+	attrs    map[string]string
+	children []*htmlNode
+	parent   *htmlNode
+}
+
+// parseHTML builds a tree out of an HTML fragment. Unclosed elements are
+// closed, and stray end tags are ignored.
+func parseHTML(src string) *htmlNode {
+	root := &htmlNode{tag: "#root"}
+	cur := root
+
+	open := func(tag string) bool {
+		for n := cur; n != nil; n = n.parent {
+			if n.tag == tag {
+				return true
+			}
+		}
+		return false
+	}
+
+	for len(src) > 0 {
+		lt := strings.IndexByte(src, '<')
+		if lt != 0 {
+			text := src
+			if lt > 0 {
+				text = src[:lt]
+				src = src[lt:]
+			} else {
+				src = ""
+			}
+			cur.children = append(cur.children, &htmlNode{text: html.UnescapeString(text), parent: cur})
+			continue
+		}
+
+		if strings.HasPrefix(src, "<!--") {
+			end := strings.Index(src, "-->")
+			if end < 0 {
+				break
+			}
+			src = src[end+3:]
+			continue
+		}
+
+		m := regexTag.FindStringSubmatch(src)
+		if m == nil {
+			// A lone `<`
+			cur.children = append(cur.children, &htmlNode{text: "<", parent: cur})
+			src = src[1:]
+			continue
+		}
+		src = src[len(m[0]):]
+		tag := strings.ToLower(m[2])
+
+		if m[1] == "/" {
+			if !open(tag) {
+				continue
+			}
+			for cur.tag != tag {
+				cur = cur.parent
+			}
+			cur = cur.parent
+			continue
+		}
+
+		if blockElements[tag] && open("p") {
+			for cur.tag != "p" {
+				cur = cur.parent
+			}
+			cur = cur.parent
+		}
+		if tag == "li" && (cur.tag == "li") {
+			cur = cur.parent
+		}
+
+		node := &htmlNode{tag: tag, attrs: make(map[string]string), parent: cur}
+		for _, attr := range regexAttr.FindAllStringSubmatch(m[3], -1) {
+			node.attrs[strings.ToLower(attr[1])] = html.UnescapeString(attr[2] + attr[3] + attr[4])
+		}
+		cur.children = append(cur.children, node)
+
+		if tag == "pre" || tag == "script" || tag == "style" {
+			// Keep everything up to the end tag as-is
+			end := strings.Index(strings.ToLower(src), "</"+tag)
+			if end < 0 {
+				end = len(src)
+			}
+			node.children = append(node.children, &htmlNode{text: src[:end], parent: node})
+			src = src[end:]
+			if gt := strings.IndexByte(src, '>'); gt >= 0 {
+				src = src[gt+1:]
+			}
+			continue
+		}
+
+		if !voidElements[tag] && m[4] != "/" {
+			cur = node
+		}
+	}
+
+	return root
+}
+
+// innerText is all of the text inside of a node
+func (n *htmlNode) innerText() string {
+	if len(n.tag) == 0 {
+		return n.text
+	}
+
+	buf := new(bytes.Buffer)
+	for _, c := range n.children {
+		buf.WriteString(c.innerText())
+	}
+	return buf.String()
+}
+
+// htmlToMarkdown converts an HTML fragment, such as the body of a post
+// exported from another blogging platform, to Markdown. Anything which has
+// no Markdown equivalent is converted to plain text.
+func htmlToMarkdown(src string) string {
+	md := renderMarkdown(parseHTML(src), false)
+	md = regexTrailingSpace.ReplaceAllStringFunc(md, func(s string) string {
+		// Keep hard line breaks
+		if strings.HasSuffix(s, "  \n") {
+			return "  \n"
+		}
+		return "\n"
+	})
+	md = regexBlankLines.ReplaceAllString(md, "\n\n")
+	return strings.TrimSpace(md) + "\n"
+}
+
+func renderChildren(n *htmlNode, pre bool) string {
+	buf := new(bytes.Buffer)
+	for _, c := range n.children {
+		buf.WriteString(renderMarkdown(c, pre))
+	}
+	return buf.String()
+}
+
+// block surrounds Markdown with blank lines
+func block(md string) string {
+	md = strings.TrimSpace(md)
+	if len(md) == 0 {
+		return ""
+	}
+	return "\n\n" + md + "\n\n"
+}
+
+// emphasize wraps text in a Markdown marker, keeping surrounding spaces out
+func emphasize(text, marker string) string {
+	trimmed := strings.TrimSpace(text)
+	if len(trimmed) == 0 {
+		return text
+	}
+	lead := text[:strings.Index(text, trimmed)]
+	trail := text[len(lead)+len(trimmed):]
+	return lead + marker + trimmed + marker + trail
+}
+
+// prefixLines adds a prefix to every line of some Markdown. The first line
+// may use a different prefix (for list bullets).
+func prefixLines(md, first, rest string) string {
+	lines := strings.Split(md, "\n")
+	for i, line := range lines {
+		if i == 0 {
+			lines[i] = first + line
+		} else if len(line) > 0 {
+			lines[i] = rest + line
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func renderMarkdown(n *htmlNode, pre bool) string {
+	if len(n.tag) == 0 {
+		if pre {
+			return n.text
+		}
+		return regexWhitespace.ReplaceAllString(n.text, " ")
+	}
+
+	switch n.tag {
+	case "p", "div", "section", "article", "header", "footer", "aside", "figure", "address":
+		return block(renderChildren(n, pre))
+	case "h1", "h2", "h3", "h4", "h5", "h6":
+		level := int(n.tag[1] - '0')
+		return block(strings.Repeat("#", level) + " " + strings.TrimSpace(renderChildren(n, pre)))
+	case "br":
+		return "  \n"
+	case "hr":
+		return "\n\n---\n\n"
+	case "strong", "b":
+		return emphasize(renderChildren(n, pre), "**")
+	case "em", "i", "cite":
+		return emphasize(renderChildren(n, pre), "*")
+	case "del", "s", "strike":
+		return emphasize(renderChildren(n, pre), "~~")
+	case "code", "tt", "kbd":
+		return "`" + n.innerText() + "`"
+	case "pre":
+		lang := ""
+		if class := n.attrs["class"]; strings.HasPrefix(class, "language-") {
+			lang = strings.Fields(class)[0][len("language-"):]
+		}
+		code := strings.Trim(parseHTML(n.innerText()).innerText(), "\n")
+		return "\n\n```" + lang + "\n" + code + "\n```\n\n"
+	case "a":
+		text := strings.TrimSpace(renderChildren(n, pre))
+		href, ok := n.attrs["href"]
+		if !ok || len(href) == 0 {
+			return text
+		}
+		if len(text) == 0 {
+			text = href
+		}
+		if title := n.attrs["title"]; len(title) > 0 {
+			return fmt.Sprintf("[%s](%s \"%s\")", text, href, strings.Replace(title, "\"", "'", -1))
+		}
+		return fmt.Sprintf("[%s](%s)", text, href)
+	case "img":
+		if title := n.attrs["title"]; len(title) > 0 {
+			return fmt.Sprintf("![%s](%s \"%s\")", n.attrs["alt"], n.attrs["src"], strings.Replace(title, "\"", "'", -1))
+		}
+		return fmt.Sprintf("![%s](%s)", n.attrs["alt"], n.attrs["src"])
+	case "figcaption":
+		return block(emphasize(renderChildren(n, pre), "*"))
+	case "blockquote":
+		inner := strings.TrimSpace(renderChildren(n, pre))
+		inner = regexBlankLines.ReplaceAllString(inner, "\n\n")
+		return block(prefixLines(inner, "> ", "> "))
+	case "ul", "ol":
+		buf := new(bytes.Buffer)
+		num := 1
+		for _, c := range n.children {
+			if c.tag != "li" {
+				continue
+			}
+			bullet := "- "
+			if n.tag == "ol" {
+				bullet = fmt.Sprintf("%d. ", num)
+				num++
+			}
+			item := strings.TrimSpace(renderChildren(c, pre))
+			item = regexBlankLines.ReplaceAllString(item, "\n\n")
+			buf.WriteString(prefixLines(item, bullet, "    "))
+			buf.WriteString("\n")
+		}
+		return block(buf.String())
+	case "li":
+		return block("- " + strings.TrimSpace(renderChildren(n, pre)))
+	case "table":
+		return renderTable(n)
+	case "iframe", "video", "audio":
+		// These have no Markdown equivalent, but Hugo can pass them through
+		src := n.attrs["src"]
+		if len(src) == 0 {
+			return ""
+		}
+		return block(fmt.Sprintf("<%s src=\"%s\"></%s>", n.tag, html.EscapeString(src), n.tag))
+	case "script", "style", "head", "title", "noscript":
+		return ""
+	}
+
+	return renderChildren(n, pre)
+}
+
+// renderTable turns an HTML table into a Markdown table. The first row is
+// used as the header.
+func renderTable(table *htmlNode) string {
+	var rows [][]string
+	var walk func(n *htmlNode)
+	walk = func(n *htmlNode) {
+		for _, c := range n.children {
+			if c.tag == "tr" {
+				row := []string{}
+				for _, cell := range c.children {
+					if cell.tag == "td" || cell.tag == "th" {
+						text := strings.TrimSpace(renderChildren(cell, false))
+						text = strings.Replace(regexWhitespace.ReplaceAllString(text, " "), "|", "\\|", -1)
+						row = append(row, text)
+					}
+				}
+				rows = append(rows, row)
+			} else if len(c.tag) > 0 {
+				walk(c)
+			}
+		}
+	}
+	walk(table)
+
+	if len(rows) == 0 {
+		return ""
+	}
+
+	width := 0
+	for _, row := range rows {
+		if len(row) > width {
+			width = len(row)
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	for i, row := range rows {
+		for len(row) < width {
+			row = append(row, "")
+		}
+		buf.WriteString("| " + strings.Join(row, " | ") + " |\n")
+		if i == 0 {
+			buf.WriteString(strings.Repeat("| --- ", width) + "|\n")
+		}
+	}
+
+	return block(buf.String())
+}
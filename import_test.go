@@ -0,0 +1,129 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHTMLToMarkdown(t *testing.T) {
+	inputs := []string{
+		"<p>Hello, <strong>world</strong>!</p><p>Second &amp; last</p>",
+		"<h2>Title</h2><ul><li>one</li><li><em>two</em></li></ul>",
+		"<ol><li>first<li>second</ol>",
+		"<p>A <a href=\"http://example.com/\">link</a> and <img src=\"a.png\" alt=\"pic\"></p>",
+		"<blockquote><p>quoted</p></blockquote><pre><code>x &lt; y</code></pre>",
+		"line one<br>line two",
+		"<p>unclosed <b>bold</p><div>after</div>",
+	}
+
+	outputs := []string{
+		"Hello, **world**!\n\nSecond & last\n",
+		"## Title\n\n- one\n- *two*\n",
+		"1. first\n2. second\n",
+		"A [link](http://example.com/) and ![pic](a.png)\n",
+		"> quoted\n\n```\nx < y\n```\n",
+		"line one  \nline two\n",
+		"unclosed **bold**\n\nafter\n",
+	}
+
+	for i, input := range inputs {
+		md := htmlToMarkdown(input)
+		if md != outputs[i] {
+			t.Errorf("|%s| was supposed to convert to |%s|, not |%s|\n", input, outputs[i], md)
+		}
+	}
+}
+
+func TestAliasFromURL(t *testing.T) {
+	inputs := []string{
+		"http://example.com/2016/01/hello-world/",
+		"https://example.com/?p=123",
+		"https://example.com",
+		"/about/",
+	}
+
+	outputs := []string{
+		"/2016/01/hello-world/",
+		"",
+		"",
+		"/about/",
+	}
+
+	for i, input := range inputs {
+		alias := aliasFromURL(input)
+		if alias != outputs[i] {
+			t.Errorf("|%s| was supposed to become alias |%s|, not |%s|\n", input, outputs[i], alias)
+		}
+	}
+}
+
+func TestMobiledocToMarkdown(t *testing.T) {
+	inputs := []string{
+		`{"markups":[["strong"]],"sections":[[1,"p",[[0,[0],1,"bold"],[0,[],0," text"]]]]}`,
+		`{"cards":[["markdown",{"markdown":"# Title"}]],"sections":[[10,0],[3,"ol",[[[0,[],0,"one"]]]]]}`,
+		`{"atoms":[["soft-return","",{}]],"sections":[[1,"p",[[0,[],0,"a"],[1,[],0,0],[0,[],0,"b"]]]]}`,
+		`{"markups":[[]],"atoms":[[]],"sections":[[1,"p",[[0,[0],1,"a"],[1,[],0,0]]]]}`,
+	}
+
+	outputs := []string{
+		"**bold** text\n",
+		"# Title\n\n1. one\n",
+		"a  \nb\n",
+		"a\n",
+	}
+
+	for i, input := range inputs {
+		md, err := mobiledocToMarkdown(input)
+		if err != nil {
+			t.Errorf("Could not convert |%s|: %s\n", input, err.Error())
+		} else if md != outputs[i] {
+			t.Errorf("|%s| was supposed to convert to |%s|, not |%s|\n", input, outputs[i], md)
+		}
+	}
+}
+
+func TestResolveGhostURL(t *testing.T) {
+	body := "![pic](__GHOST_URL__/content/images/2020/01/a.png)"
+	resolved := resolveGhostURL(body, "https://old.example.com/")
+	if resolved != "![pic](https://old.example.com/content/images/2020/01/a.png)" {
+		t.Errorf("The link was resolved to |%s|\n", resolved)
+	}
+	if !regexGhostImage.MatchString(resolved) {
+		t.Errorf("The resolved link isn't found as an image on the old site")
+	}
+	if resolved = resolveGhostURL(body, ""); resolved != "![pic](/content/images/2020/01/a.png)" {
+		t.Errorf("Without an address, the link was resolved to |%s|\n", resolved)
+	}
+}
+
+func TestReadJekyllPostSlug(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shim-jekyll")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	site := &jekyllSite{Permalink: jekyllPermalinks["date"]}
+	posts := map[string]string{
+		"2016-05-01-from-name.md": "---\ntitle: A\n---\nHello\n",
+		"2016-05-02-ignored.md":   "---\ntitle: B\nslug: from-front-matter\n---\nHello\n",
+	}
+	slugs := map[string]string{
+		"2016-05-01-from-name.md": "from-name",
+		"2016-05-02-ignored.md":   "from-front-matter",
+	}
+
+	for name, src := range posts {
+		postPath := filepath.Join(dir, name)
+		ioutil.WriteFile(postPath, []byte(src), 0644)
+		ip, err := readJekyllPost(postPath, "post", true, site)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ip.Slug != slugs[name] {
+			t.Errorf("%s has the slug %s, not %s\n", name, ip.Slug, slugs[name])
+		}
+	}
+}
@@ -0,0 +1,451 @@
+// SHIM - A web front end for the Hugo site generator
+// Copyright (C) 2016        Cameron Conn
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/spf13/viper"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	yamlBoundary = "---"
+)
+
+// Folders of a Jekyll site which are copied into a Hugo site's static files
+var jekyllAssetDirs = []string{"assets", "images", "img", "uploads", "files", "downloads"}
+
+// Jekyll's built-in permalink styles
+var jekyllPermalinks = map[string]string{
+	"date":    "/:categories/:year/:month/:day/:title.html",
+	"pretty":  "/:categories/:year/:month/:day/:title/",
+	"ordinal": "/:categories/:year/:y_day/:title.html",
+	"none":    "/:categories/:title.html",
+}
+
+var regexJekyllPostName = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2})-(.+)$`)
+var regexLiquidHighlight = regexp.MustCompile(`{%-?\s*highlight\s+(\S+)[^%]*-?%}`)
+var regexLiquidEndHighlight = regexp.MustCompile(`{%-?\s*endhighlight\s*-?%}`)
+var regexLiquidRaw = regexp.MustCompile(`{%-?\s*(end)?raw\s*-?%}`)
+var regexLiquidPostURL = regexp.MustCompile(`{%-?\s*post_url\s+\d{4}-\d{2}-\d{2}-(\S+?)\s*-?%}`)
+var regexLiquidBaseURL = regexp.MustCompile(`{{-?\s*site\.baseurl\s*-?}}`)
+
+// Date formats Jekyll accepts in front matter
+var jekyllDateFormats = []string{
+	"2006-01-02 15:04:05 -0700",
+	"2006-01-02 15:04:05 -07:00",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	time.RFC3339,
+	"2006-01-02",
+}
+
+// jekyllSite - The settings of a Jekyll site which carry over to Hugo
+type jekyllSite struct {
+	Title       string
+	BaseURL     string
+	Description string
+	Author      string
+	Permalink   string
+}
+
+// readJekyllConfig reads a Jekyll site's `_config.yml`
+func readJekyllConfig(src string) (*jekyllSite, error) {
+	js := &jekyllSite{Permalink: jekyllPermalinks["date"]}
+
+	file, err := os.Open(filepath.Join(src, "_config.yml"))
+	if os.IsNotExist(err) {
+		return js, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	v := viper.New()
+	v.SetConfigType("yaml")
+	if err = v.ReadConfig(file); err != nil {
+		return nil, fmt.Errorf("Could not read _config.yml: %s", err.Error())
+	}
+
+	js.Title = v.GetString("title")
+	js.Description = v.GetString("description")
+
+	url := strings.TrimRight(v.GetString("url"), "/")
+	baseurl := strings.Trim(v.GetString("baseurl"), "/")
+	if len(baseurl) > 0 {
+		url += "/" + baseurl
+	}
+	if len(url) > 0 {
+		js.BaseURL = url + "/"
+	}
+
+	// `author` is either a name or a table with a name
+	js.Author = v.GetString("author.name")
+	if len(js.Author) == 0 {
+		js.Author = v.GetString("author")
+	}
+
+	if permalink := v.GetString("permalink"); len(permalink) > 0 {
+		if style, ok := jekyllPermalinks[permalink]; ok {
+			js.Permalink = style
+		} else {
+			js.Permalink = permalink
+		}
+	}
+
+	return js, nil
+}
+
+// splitFrontMatter separates the YAML front matter of a Jekyll file from its
+// body. Files without front matter have an empty front matter.
+func splitFrontMatter(data []byte) (frontMatter, body []byte) {
+	text := bytes.Replace(data, []byte("\r\n"), []byte("\n"), -1)
+	if !bytes.HasPrefix(text, []byte(yamlBoundary+"\n")) {
+		return nil, text
+	}
+
+	rest := text[len(yamlBoundary)+1:]
+	end := bytes.Index(rest, []byte("\n"+yamlBoundary))
+	if bytes.HasPrefix(rest, []byte(yamlBoundary)) {
+		end = 0
+	} else if end < 0 {
+		return nil, text
+	} else {
+		end++
+	}
+
+	frontMatter = rest[:end]
+	body = rest[end+len(yamlBoundary):]
+	if i := bytes.IndexByte(body, '\n'); i >= 0 {
+		body = body[i+1:]
+	} else {
+		body = nil
+	}
+
+	return frontMatter, body
+}
+
+// yamlStrings reads a front matter value which is either a list or a single
+// string of space-separated words (how Jekyll writes categories and tags).
+func yamlStrings(v *viper.Viper, key string) []string {
+	switch value := v.Get(key).(type) {
+	case string:
+		return strings.Fields(value)
+	case []interface{}, []string:
+		return v.GetStringSlice(key)
+	}
+	return nil
+}
+
+// jekyllDate reads the `date` from front matter, which YAML may have already
+// decoded into a time.
+func jekyllDate(v *viper.Viper) *time.Time {
+	switch value := v.Get("date").(type) {
+	case time.Time:
+		return &value
+	case string:
+		for _, format := range jekyllDateFormats {
+			if t, err := time.ParseInLocation(format, strings.TrimSpace(value), time.Local); err == nil {
+				return &t
+			}
+		}
+	}
+	return nil
+}
+
+// convertLiquid replaces the Liquid tags Jekyll posts commonly use with their
+// Hugo shortcode equivalents.
+func convertLiquid(body string) string {
+	body = regexLiquidHighlight.ReplaceAllString(body, "{{< highlight $1 >}}")
+	body = regexLiquidEndHighlight.ReplaceAllString(body, "{{< /highlight >}}")
+	body = regexLiquidRaw.ReplaceAllString(body, "")
+	body = regexLiquidPostURL.ReplaceAllString(body, `{{< relref "post/$1.md" >}}`)
+	body = regexLiquidBaseURL.ReplaceAllString(body, "")
+	return body
+}
+
+// jekyllPermalink works out the URL Jekyll gave to a post so that it can be
+// kept as an alias.
+func jekyllPermalink(pattern string, date time.Time, categories []string, title string) string {
+	cats := make([]string, 0, len(categories))
+	for _, c := range categories {
+		if c = NormalizeName(c); len(c) > 0 {
+			cats = append(cats, c)
+		}
+	}
+
+	replacer := strings.NewReplacer(
+		":categories", strings.Join(cats, "/"),
+		":year", date.Format("2006"),
+		":short_year", date.Format("06"),
+		":i_month", fmt.Sprint(int(date.Month())),
+		":month", date.Format("01"),
+		":i_day", fmt.Sprint(date.Day()),
+		":day", date.Format("02"),
+		":y_day", fmt.Sprintf("%03d", date.YearDay()),
+		":title", title,
+		":slug", title,
+	)
+
+	link := replacer.Replace(pattern)
+	for strings.Contains(link, "//") {
+		link = strings.Replace(link, "//", "/", -1)
+	}
+	return link
+}
+
+// readJekyllPost converts a single post, draft or page from a Jekyll site.
+// `section` is where the post goes in the Hugo site, and `isPost` tells
+// whether the file is a dated post (from _posts) or not.
+func readJekyllPost(filePath, section string, isPost bool, site *jekyllSite) (*importedPost, error) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	frontMatter, body := splitFrontMatter(data)
+	v := viper.New()
+	v.SetConfigType("yaml")
+	if len(bytes.TrimSpace(frontMatter)) > 0 {
+		if err = v.ReadConfig(bytes.NewReader(frontMatter)); err != nil {
+			return nil, fmt.Errorf("Could not read front matter: %s", err.Error())
+		}
+	}
+
+	ext := filepath.Ext(filePath)
+	name := strings.TrimSuffix(filepath.Base(filePath), ext)
+
+	ip := &importedPost{
+		Section:     section,
+		Slug:        name,
+		Title:       v.GetString("title"),
+		Author:      v.GetString("author"),
+		Description: v.GetString("description"),
+		Date:        jekyllDate(v),
+		Terms:       make(map[string][]string),
+	}
+	if len(ip.Description) == 0 {
+		ip.Description = v.GetString("excerpt")
+	}
+	if v.IsSet("published") && !v.GetBool("published") {
+		ip.Draft = true
+	}
+
+	if m := regexJekyllPostName.FindStringSubmatch(name); m != nil {
+		if ip.Date == nil {
+			if date, err := time.ParseInLocation("2006-01-02", m[1], time.Local); err == nil {
+				ip.Date = &date
+			}
+		}
+		ip.Slug = m[2]
+	}
+	// A slug in the front matter wins over the one in the file name
+	if slug := v.GetString("slug"); len(slug) > 0 {
+		ip.Slug = slug
+	}
+	if len(ip.Title) == 0 {
+		ip.Title = strings.Title(strings.Replace(ip.Slug, "-", " ", -1))
+	}
+
+	categories := yamlStrings(v, "categories")
+	categories = append(categories, yamlStrings(v, "category")...)
+	tags := yamlStrings(v, "tags")
+	tags = append(tags, yamlStrings(v, "tag")...)
+	ip.Terms["category"] = categories
+	ip.Terms["tag"] = tags
+
+	if permalink := v.GetString("permalink"); len(permalink) > 0 {
+		ip.Aliases = []string{permalink}
+	} else if isPost && ip.Date != nil && !ip.Draft {
+		ip.Aliases = []string{jekyllPermalink(site.Permalink, *ip.Date, categories, ip.Slug)}
+	}
+
+	// Hugo already serves the post at this URL, so it mustn't be an alias too
+	hugoPath := "/" + path.Join(section, ip.Slug) + "/"
+	if len(ip.Aliases) > 0 && ip.Aliases[0] == hugoPath {
+		ip.Aliases = nil
+	}
+
+	text := convertLiquid(string(body))
+	if ext == ".html" || ext == ".htm" {
+		text = htmlToMarkdown(text)
+	}
+	ip.Body = text
+
+	return ip, nil
+}
+
+// copyTree copies a folder and everything inside of it
+func copyTree(src, dst string) (int, error) {
+	copied := 0
+	err := filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		if info.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+
+		in, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := os.Create(target)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+
+		if _, err = io.Copy(out, in); err != nil {
+			return err
+		}
+		copied++
+		return nil
+	})
+
+	return copied, err
+}
+
+// isJekyllContent tells if a file is something Jekyll would turn into a page
+func isJekyllContent(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".md", ".markdown", ".mkd", ".mkdn", ".html", ".htm":
+		return true
+	}
+	return false
+}
+
+// ImportJekyll - Import the posts, drafts, pages and assets of a Jekyll site
+// at `src`, and carry the Jekyll site's title and URL over to this site.
+func (s *Site) ImportJekyll(src string) (*importReport, error) {
+	js, err := readJekyllConfig(src)
+	if err != nil {
+		return nil, err
+	}
+
+	report := new(importReport)
+
+	if len(js.Title) > 0 {
+		s.Title = js.Title
+	}
+	if len(js.BaseURL) > 0 {
+		s.BaseURL = js.BaseURL
+	}
+	if len(js.Description) > 0 {
+		s.Subtitle = js.Description
+	}
+	if len(js.Author) > 0 {
+		s.author = js.Author
+	}
+
+	sources := []struct {
+		dir     string
+		section string
+		isPost  bool
+		draft   bool
+	}{
+		{"_posts", "post", true, false},
+		{"_drafts", "post", true, true},
+		{"", "", false, false}, // pages at the root of the site
+	}
+
+	for _, source := range sources {
+		dir := filepath.Join(src, source.dir)
+		files, err := ioutil.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		for _, f := range files {
+			name := f.Name()
+			if f.IsDir() || !isJekyllContent(name) {
+				continue
+			}
+
+			filePath := filepath.Join(dir, name)
+			if !source.isPost {
+				// Only pages with front matter are rendered by Jekyll. This
+				// also skips README files and the like.
+				data, err := ioutil.ReadFile(filePath)
+				if err != nil || !bytes.HasPrefix(data, []byte(yamlBoundary)) {
+					continue
+				}
+				if strings.HasPrefix(name, "index.") || strings.HasPrefix(name, "404.") {
+					continue // Hugo's theme makes these
+				}
+			}
+
+			ip, err := readJekyllPost(filePath, source.section, source.isPost, js)
+			if err != nil {
+				report.warn("Could not read %s: %s", path.Join(source.dir, name), err.Error())
+				continue
+			}
+			if source.draft {
+				ip.Draft = true
+				ip.Aliases = nil
+			}
+
+			if _, _, err = s.importPost(ip); err != nil {
+				report.warn("Could not import %s: %s", path.Join(source.dir, name), err.Error())
+				continue
+			}
+
+			report.Posts++
+			if ip.Draft {
+				report.Drafts++
+			}
+		}
+	}
+
+	for _, dir := range jekyllAssetDirs {
+		assetDir := filepath.Join(src, dir)
+		if _, err := os.Stat(assetDir); os.IsNotExist(err) {
+			continue
+		}
+
+		copied, err := copyTree(assetDir, filepath.Join(s.Location, "static", dir))
+		report.Files += copied
+		if err != nil {
+			report.warn("Could not copy %s: %s", dir, err.Error())
+		}
+	}
+
+	if err = s.SaveConfig(); err != nil {
+		return report, fmt.Errorf("Posts were imported, but the site configuration "+
+			"could not be saved: %s", err.Error())
+	}
+
+	return report, nil
+}
@@ -20,15 +20,15 @@ import (
 	"fmt"
 	"github.com/justinas/alice"
 	"github.com/niemal/uman"
-	"github.com/spf13/viper"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sync"
 )
 
 var allSites []*Site
-var shimAssets *assets
+var sitesMu sync.RWMutex // guards allSites; see siteList
 var um *uman.UserManager
 
 // Pretty methods to check errors
@@ -43,30 +43,37 @@ func main() {
 	setupConfig()
 
 	// Loading configuration
-	viper.SetConfigName("config")
-	viper.AddConfigPath(".")
-	err := viper.ReadInConfig()
+	config, err := readConfig("")
 	checkReason(err, "Could no read config. Does 'config.toml' not exist?")
 
 	// Setup assets and appropriate folders
-	assignAssets()
+	a, err := loadAssets(config)
+	checkReason(err, "Couldn't set up shim's folders.")
+	setShimState(shimState{config: config, assets: a})
 
-	fmt.Printf("base path: %s\n", shimAssets.basepath)
+	// Run a command line tool instead of the web interface
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+
+	fmt.Printf("base path: %s\n", a.basepath)
 
-	parseTemplate() // in web.go
+	state, err := loadShimState(config.ConfigFileUsed())
+	checkReason(err, "Your workflow configuration or templates don't make sense.")
+	setShimState(state)
 
 	if firstRun() { // Setup initial username and password so admins can run shim.
-		um = uman.New(filepath.Join(shimAssets.root, "users.db"))
+		um = uman.New(filepath.Join(shimAssets().root, "users.db"))
 		um.Register("root", "hunter2")
 	} else {
-		um = uman.New(filepath.Join(shimAssets.root, "users.db"))
+		um = uman.New(filepath.Join(shimAssets().root, "users.db"))
 	}
 	um.CheckDelay = 60
 
-	fmt.Printf("Root directory is: %s\n", shimAssets.root)
+	fmt.Printf("Root directory is: %s\n", shimAssets().root)
 
 	// Lot sites and whatnot
-	siteNames, err := findSites()
+	siteNames, err := findSites(state.config)
 	checkReason(err, "Was not able to load sites. Please check your `config.toml` file.")
 	setupSites(siteNames)
 	allSites = loadAllSites(siteNames)
@@ -83,12 +90,22 @@ func main() {
 	mux.Handle("/", withAuth.ThenFunc(Home))
 	mux.Handle("/config/", withAuth.ThenFunc(EditSite))
 	mux.Handle("/config/advanced/", withAuth.ThenFunc(AdvancedConfig))
+	mux.Handle("/config/versions/", withAuth.ThenFunc(ConfigVersions))
+	mux.Handle("/config/schemas/", withAuth.ThenFunc(EditSchemas))
+	mux.Handle("/menus/", withAuth.ThenFunc(EditMenus))
 	mux.Handle("/posts/", withAuth.ThenFunc(ViewPosts))
 	mux.Handle("/staticfiles/", withAuth.ThenFunc(ViewFiles))
 	mux.Handle("/edit/", withAuth.ThenFunc(EditPost))
 	mux.Handle("/delete/", withAuth.ThenFunc(RemovePost))
+	mux.Handle("/comments/", withAuth.ThenFunc(PostComments))
+	mux.Handle("/review/", withAuth.ThenFunc(ReviewPosts))
+	mux.Handle("/calendar/", withAuth.ThenFunc(ViewCalendar))
 	mux.Handle("/new/", withAuth.ThenFunc(NewPost))
+	mux.Handle("/shortcodes/", withAuth.ThenFunc(InsertShortcode))
 	mux.Handle("/admin/", withAuth.ThenFunc(Admin))
+	mux.Handle("/sites/", withAuth.ThenFunc(ManageSites))
+	mux.Handle("/import/", withAuth.ThenFunc(ImportPosts))
+	mux.Handle("/export/", withAuth.ThenFunc(ExportSite))
 	mux.Handle("/user/", withAuth.ThenFunc(Users))
 	mux.Handle("/taxonomy/", withAuth.ThenFunc(ViewTaxonomies))
 
@@ -103,10 +120,15 @@ func main() {
 	mux.Handle("/files/", http.StripPrefix("/files/", withAuth.Then(fileViewer)))
 
 	noAuth := alice.New(loggingHandler, crashHandler)
-	staticFilesRoot := filepath.Join(shimAssets.root, shimAssets.static)
-	staticFileHandler := http.FileServer(http.Dir(staticFilesRoot))
+	// Shim's folders can change when its configuration is reloaded
+	staticFileHandler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		a := shimAssets()
+		staticFilesRoot := filepath.Join(a.root, a.static)
+		http.FileServer(http.Dir(staticFilesRoot)).ServeHTTP(w, req)
+	})
 
 	mux.Handle("/login/", noAuth.ThenFunc(Login))
+	mux.Handle("/calendar.ics", noAuth.ThenFunc(CalendarFeed))
 	mux.Handle("/static/", http.StripPrefix("/static/", noAuth.Then(staticFileHandler)))
 
 	// Get port from environment variable for compatibility with gin for easy reloads
@@ -118,7 +140,11 @@ func main() {
 
 	mServ := http.Server{}
 	mServ.Addr = fmt.Sprintf(":%s", portEnv)
-	mServ.Handler = http.StripPrefix(shimAssets.basepath, mux)
+	mServ.Handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.StripPrefix(shimAssets().basepath, mux).ServeHTTP(w, req)
+	})
+
+	reloadOnHangup()
 	err = mServ.ListenAndServe()
 	checkReason(err, "Error serving webapp")
 }
@@ -0,0 +1,275 @@
+// SHIM - A web front end for the Hugo site generator
+// Copyright (C) 2016        Cameron Conn
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const archivesDir = "archives" // in shim's root
+
+var regexTOMLTable = regexp.MustCompile(`^\s*\[\[?\s*([^\]]+?)\s*\]\]?\s*(#.*)?$`)
+var regexTOMLEnabled = regexp.MustCompile(`^(\s*)enabled\s*=`)
+
+// siteTable finds the lines of the `[sites.NAME]` table in shim's
+// configuration. `end` is the line after the table, not counting the comments
+// and blank lines before the next table.
+func siteTable(lines []string, name string) (start, end int, found bool) {
+	start = -1
+	for i, line := range lines {
+		m := regexTOMLTable.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+
+		key := strings.Replace(strings.Replace(m[1], " ", "", -1), `"`, "", -1)
+		if start >= 0 {
+			end = i
+			break
+		}
+		if key == "sites."+name {
+			start = i
+			end = len(lines)
+		}
+	}
+	if start < 0 {
+		return 0, 0, false
+	}
+
+	for end > start+1 {
+		trimmed := strings.TrimSpace(lines[end-1])
+		if len(trimmed) > 0 && !strings.HasPrefix(trimmed, "#") {
+			break
+		}
+		end--
+	}
+	return start, end, true
+}
+
+// editSiteTable changes the `[sites.NAME]` table of shim's configuration file
+// in place, so that the rest of the file (and its comments) stay the same.
+// With `comments`, the comments right above the table are part of it.
+func editSiteTable(name string, comments bool, edit func(table []string) []string) error {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	confPath := shimConfig().ConfigFileUsed()
+	data, err := ioutil.ReadFile(confPath)
+	if err != nil {
+		return fmt.Errorf("Could not read shim's configuration: %s", err.Error())
+	}
+
+	lines := strings.Split(string(data), "\n")
+	start, end, found := siteTable(lines, name)
+	if !found {
+		return fmt.Errorf("Could not find [sites.%s] in shim's configuration. "+
+			"Please change it by hand.", name)
+	}
+	for comments && start > 0 && strings.HasPrefix(strings.TrimSpace(lines[start-1]), "#") {
+		start--
+	}
+
+	edited := append([]string{}, lines[:start]...)
+	edited = append(edited, edit(lines[start:end])...)
+	edited = append(edited, lines[end:]...)
+
+	err = ioutil.WriteFile(confPath, []byte(strings.Join(edited, "\n")), 0644)
+	if err != nil {
+		return fmt.Errorf("Could not save shim's configuration: %s", err.Error())
+	}
+	return rereadConfig()
+}
+
+// setSiteEnabled turns a site on or off in shim's configuration
+func setSiteEnabled(name string, enabled bool) error {
+	return editSiteTable(name, false, func(table []string) []string {
+		for i, line := range table {
+			if m := regexTOMLEnabled.FindStringSubmatch(line); m != nil {
+				table[i] = fmt.Sprintf("%senabled = %t", m[1], enabled)
+				return table
+			}
+		}
+		line := fmt.Sprintf("    enabled = %t", enabled)
+		return append([]string{table[0], line}, table[1:]...)
+	})
+}
+
+// unregisterSite removes a site from shim's configuration
+func unregisterSite(name string) error {
+	return editSiteTable(name, true, func(table []string) []string { return nil })
+}
+
+// removeSite stops serving a site
+func removeSite(name string) {
+	sitesMu.Lock()
+	defer sitesMu.Unlock()
+
+	sites := []*Site{}
+	for _, s := range allSites {
+		if s.ShortName != name {
+			sites = append(sites, s)
+		}
+	}
+	allSites = sites
+}
+
+// disabledSites - The sites in shim's configuration which aren't enabled and
+// still have a folder.
+func disabledSites() []string {
+	names := []string{}
+	config := shimConfig()
+	for name := range config.GetStringMap("sites") {
+		if siteNamed(name) != nil || config.GetBool(fmt.Sprintf("sites.%s.enabled", name)) {
+			continue
+		}
+		if _, err := os.Stat(siteDir(name)); err == nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// isDisabledSite tells whether `name` is one of the disabledSites
+func isDisabledSite(name string) bool {
+	for _, disabled := range disabledSites() {
+		if disabled == name {
+			return true
+		}
+	}
+	return false
+}
+
+// checkNotLast makes sure a site isn't the only one left, since shim always
+// needs a site to show.
+func checkNotLast(name string) error {
+	sites := siteList()
+	if len(sites) == 1 && sites[0].ShortName == name {
+		return fmt.Errorf("%s is the only site left, so it can't be turned off.", name)
+	}
+	return nil
+}
+
+// disableSite - Stop serving a site, and keep it off when shim restarts
+func disableSite(name string) error {
+	if siteNamed(name) == nil {
+		return fmt.Errorf("%s isn't enabled.", name)
+	}
+	if err := checkNotLast(name); err != nil {
+		return err
+	}
+
+	if err := setSiteEnabled(name, false); err != nil {
+		return err
+	}
+	removeSite(name)
+	return nil
+}
+
+// enableSite - Start serving a site which was disabled
+func enableSite(name string) (*Site, error) {
+	if !isDisabledSite(name) {
+		return nil, fmt.Errorf("%s isn't a disabled site.", name)
+	}
+
+	s, err := loadSite(name)
+	if err != nil {
+		return nil, err
+	}
+	if err = setSiteEnabled(name, true); err != nil {
+		return nil, err
+	}
+
+	addSite(s)
+	return s, nil
+}
+
+// archiveSite - Save a compressed copy of a site in shim's archives folder and
+// disable it. The archive's path is returned.
+func archiveSite(name string) (string, error) {
+	s := siteNamed(name)
+	if s == nil {
+		return "", fmt.Errorf("%s isn't enabled.", name)
+	}
+	if err := checkNotLast(name); err != nil {
+		return "", err
+	}
+
+	dir := filepath.Join(shimAssets().root, archivesDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("Could not create the archives folder: %s", err.Error())
+	}
+
+	archivePath := filepath.Join(dir, fmt.Sprintf("%s-%s.%s", name,
+		time.Now().Format("2006-01-02-150405"), exportTarGz))
+	file, err := os.Create(archivePath)
+	if err != nil {
+		return "", fmt.Errorf("Could not create archive: %s", err.Error())
+	}
+
+	archive, err := newArchiveWriter(file, exportTarGz)
+	if err == nil {
+		err = s.archiveTree(archive, ".")
+		if closeErr := archive.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(archivePath)
+		return "", fmt.Errorf("Could not archive %s: %s", name, err.Error())
+	}
+
+	return archivePath, disableSite(name)
+}
+
+// deleteSite - Remove a site's folder and take it out of shim's configuration.
+// There's no undo, so archive sites first. Sites outside the sites folder
+// weren't made by shim, so their folders are left alone; `kept` tells when.
+func deleteSite(name string) (kept bool, err error) {
+	if siteNamed(name) != nil {
+		if err = checkNotLast(name); err != nil {
+			return false, err
+		}
+	} else if !isDisabledSite(name) {
+		return false, fmt.Errorf("There is no site named %s.", name)
+	}
+
+	dir := siteDir(name)
+	if err = unregisterSite(name); err != nil {
+		return false, err
+	}
+	removeSite(name)
+
+	if !isInSitesDir(dir) {
+		return true, nil
+	}
+	if err = os.RemoveAll(dir); err != nil {
+		return false, fmt.Errorf("%s was removed from shim, but its folder couldn't be deleted: %s",
+			name, err.Error())
+	}
+	return false, nil
+}
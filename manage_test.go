@@ -0,0 +1,33 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSiteTable(t *testing.T) {
+	conf := strings.Split(`[sites]
+    # This site is in ./sites/test/
+    [sites.test]
+        dir = "test"
+        enabled = true
+
+    # This site is in ./sites/mysite/
+    [ sites."mysite" ]
+        enabled = true
+[workflow]`, "\n")
+
+	inputs := []string{"test", "mysite", "other"}
+	outputs := [][]int{{2, 5}, {7, 9}, nil}
+
+	for i, name := range inputs {
+		start, end, found := siteTable(conf, name)
+		if outputs[i] == nil {
+			if found {
+				t.Errorf("%s isn't in the configuration, but was found at %d\n", name, start)
+			}
+		} else if !found || start != outputs[i][0] || end != outputs[i][1] {
+			t.Errorf("%s was supposed to be lines %v, not [%d %d]\n", name, outputs[i], start, end)
+		}
+	}
+}
@@ -71,6 +71,9 @@ func (s *Site) AddStaticFile(path string, uploadFile io.Reader) error {
 	// the static file path?
 	newFilePath := filepath.Join(s.Location, "static", "files", path)
 	fmt.Printf("New file path: %s\n", newFilePath)
+	if err := os.MkdirAll(filepath.Dir(newFilePath), 0755); err != nil {
+		return err
+	}
 	newFile, err := os.Create(newFilePath)
 	defer newFile.Close()
 	if err != nil {
@@ -109,6 +112,13 @@ func (s *Site) RemoveStaticFile(path string) error {
 // GetEmbedCode Generate the embedding code for a static file used in this site
 // with Hugo.
 func (s *Site) GetEmbedCode(path string) string {
-	embedCode := fmt.Sprintf(embedFmt, path)
-	return embedCode
+	figure, err := s.Shortcode("figure")
+	if err != nil || !figure.HasParam("src") {
+		return fmt.Sprintf(embedFmt, path)
+	}
+
+	return figure.Call(map[string]string{
+		"src":   "files/" + path,
+		"title": "Put Figure Name Here",
+	}, nil, "")
 }
@@ -0,0 +1,435 @@
+// SHIM - A web front end for the Hugo site generator
+// Copyright (C) 2016        Cameron Conn
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MenuEntry - An entry in one of a site's menus. Entries are either defined in
+// the site's configuration, or in the front matter of a post.
+type MenuEntry struct {
+	Menu       string
+	Name       string
+	URL        string
+	Identifier string
+	Parent     string
+	Weight     int
+
+	Post  *Post // The post which defines this entry. nil for configured entries.
+	index int   // Position of this entry in the site's configuration
+}
+
+// Menu - A named menu with all of its entries, sorted by weight
+type Menu struct {
+	Name    string
+	Entries []*MenuEntry
+}
+
+// Key - Identifies this entry in web forms
+func (e MenuEntry) Key() string {
+	if e.Post != nil {
+		return fmt.Sprintf("post:%s:%s", e.Menu, e.Post.PostID())
+	}
+	return fmt.Sprintf("config:%s:%d", e.Menu, e.index)
+}
+
+// ID - The name other entries use to refer to this one as their parent
+func (e MenuEntry) ID() string {
+	if len(e.Identifier) > 0 {
+		return e.Identifier
+	}
+	return e.Name
+}
+
+// Title - What this entry displays as. Post entries default to the title of
+// their post.
+func (e MenuEntry) Title() string {
+	if len(e.Name) == 0 && e.Post != nil {
+		return e.Post.Title
+	}
+	return e.Name
+}
+
+// Link - Where this entry links to
+func (e MenuEntry) Link() string {
+	if e.Post != nil {
+		return e.Post.URL()
+	}
+	return e.URL
+}
+
+// FromConfig - Whether this entry is defined in the site configuration
+func (e MenuEntry) FromConfig() bool {
+	return e.Post == nil
+}
+
+// Parents - The entries of this menu which other entries can be nested under
+func (m Menu) Parents() []string {
+	parents := []string{}
+	for _, e := range m.Entries {
+		if id := e.ID(); len(id) > 0 {
+			parents = append(parents, id)
+		}
+	}
+	removeDuplicates(&parents)
+	return parents
+}
+
+// toInt reads a number from a decoded TOML value
+func toInt(value interface{}) int {
+	switch v := value.(type) {
+	case int:
+		return v
+	case int64:
+		return int(v)
+	case float64:
+		return int(v)
+	case string:
+		i, _ := strconv.Atoi(strings.TrimSpace(v))
+		return i
+	}
+	return 0
+}
+
+// toMapSlice normalizes a decoded array of TOML tables
+func toMapSlice(value interface{}) []map[string]interface{} {
+	switch v := value.(type) {
+	case []map[string]interface{}:
+		return v
+	case []interface{}:
+		tables := []map[string]interface{}{}
+		for _, elem := range v {
+			if table, ok := elem.(map[string]interface{}); ok {
+				tables = append(tables, table)
+			}
+		}
+		return tables
+	}
+	return nil
+}
+
+// menuKey is the configuration key this site keeps its menus under. Hugo
+// accepts both `menu` and `menus`.
+func (s Site) menuKey() string {
+	if _, ok := s.allSettings["menu"]; !ok {
+		if _, ok := s.allSettings["menus"]; ok {
+			return "menus"
+		}
+	}
+	return "menu"
+}
+
+// configMenus - The menus defined in the site configuration
+func (s Site) configMenus() map[string][]map[string]interface{} {
+	menus := make(map[string][]map[string]interface{})
+
+	if all, ok := s.allSettings[s.menuKey()].(map[string]interface{}); ok {
+		for name, entries := range all {
+			menus[name] = toMapSlice(entries)
+		}
+	}
+
+	return menus
+}
+
+// setConfigMenu replaces the entries of one menu in the site configuration
+func (s *Site) setConfigMenu(name string, entries []map[string]interface{}) {
+	key := s.menuKey()
+	all, ok := s.allSettings[key].(map[string]interface{})
+	if !ok {
+		all = make(map[string]interface{})
+		s.allSettings[key] = all
+	}
+
+	if len(entries) == 0 {
+		delete(all, name)
+	} else {
+		all[name] = entries
+	}
+	if len(all) == 0 {
+		delete(s.allSettings, key)
+	}
+}
+
+// postMenus reads the menu entries from a post's front matter, which may be
+// a single menu name, a list of menu names, or a table of menus.
+func (p *Post) postMenus() map[string]map[string]interface{} {
+	menus := make(map[string]map[string]interface{})
+
+	switch v := p.all["menu"].(type) {
+	case string:
+		menus[v] = make(map[string]interface{})
+	case []string:
+		for _, name := range v {
+			menus[name] = make(map[string]interface{})
+		}
+	case []interface{}:
+		for _, name := range v {
+			menus[fmt.Sprint(name)] = make(map[string]interface{})
+		}
+	case map[string]interface{}:
+		for name, settings := range v {
+			if table, ok := settings.(map[string]interface{}); ok {
+				menus[name] = table
+			} else {
+				menus[name] = make(map[string]interface{})
+			}
+		}
+	}
+
+	return menus
+}
+
+// setPostMenus writes menu entries back to a post's front matter
+func (p *Post) setPostMenus(menus map[string]map[string]interface{}) {
+	if len(menus) == 0 {
+		delete(p.all, "menu")
+		return
+	}
+
+	table := make(map[string]interface{})
+	for name, settings := range menus {
+		table[name] = settings
+	}
+	p.all["menu"] = table
+}
+
+// Menus - All menus used by this site, from both its configuration and its
+// posts.
+func (s *Site) Menus() []*Menu {
+	byName := make(map[string]*Menu)
+	menu := func(name string) *Menu {
+		m, ok := byName[name]
+		if !ok {
+			m = &Menu{Name: name}
+			byName[name] = m
+		}
+		return m
+	}
+
+	for name, entries := range s.configMenus() {
+		m := menu(name)
+		for i, entry := range entries {
+			m.Entries = append(m.Entries, &MenuEntry{
+				Menu:       name,
+				Name:       fmt.Sprint(valueOr(entry["name"], "")),
+				URL:        fmt.Sprint(valueOr(entry["url"], "")),
+				Identifier: fmt.Sprint(valueOr(entry["identifier"], "")),
+				Parent:     fmt.Sprint(valueOr(entry["parent"], "")),
+				Weight:     toInt(entry["weight"]),
+				index:      i,
+			})
+		}
+	}
+
+	s.GetAllPosts()
+	for _, p := range s.Posts {
+		for name, settings := range p.postMenus() {
+			m := menu(name)
+			m.Entries = append(m.Entries, &MenuEntry{
+				Menu:       name,
+				Name:       fmt.Sprint(valueOr(settings["name"], "")),
+				Identifier: fmt.Sprint(valueOr(settings["identifier"], "")),
+				Parent:     fmt.Sprint(valueOr(settings["parent"], "")),
+				Weight:     toInt(settings["weight"]),
+				Post:       p,
+			})
+		}
+	}
+
+	menus := []*Menu{}
+	for _, m := range byName {
+		sort.SliceStable(m.Entries, func(i, j int) bool {
+			a, b := m.Entries[i], m.Entries[j]
+			if a.Weight != b.Weight {
+				return a.Weight < b.Weight
+			}
+			return a.Title() < b.Title()
+		})
+		menus = append(menus, m)
+	}
+	sort.Slice(menus, func(i, j int) bool { return menus[i].Name < menus[j].Name })
+
+	return menus
+}
+
+func valueOr(value, fallback interface{}) interface{} {
+	if value == nil {
+		return fallback
+	}
+	return value
+}
+
+// FindMenuEntry - Find a menu entry using the key from MenuEntry.Key
+func (s *Site) FindMenuEntry(key string) (*MenuEntry, error) {
+	for _, m := range s.Menus() {
+		for _, e := range m.Entries {
+			if e.Key() == key {
+				return e, nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("That menu entry doesn't exist anymore.")
+}
+
+// menuSettings are the settings of an entry, as written to a config file or
+// front matter. Blank settings are left out so that Hugo uses its defaults.
+func (e MenuEntry) menuSettings() map[string]interface{} {
+	settings := make(map[string]interface{})
+	if len(e.Name) > 0 {
+		settings["name"] = e.Name
+	}
+	if len(e.URL) > 0 && e.Post == nil {
+		settings["url"] = e.URL
+	}
+	if len(e.Identifier) > 0 {
+		settings["identifier"] = e.Identifier
+	}
+	if len(e.Parent) > 0 {
+		settings["parent"] = e.Parent
+	}
+	if e.Weight != 0 {
+		settings["weight"] = e.Weight
+	}
+	return settings
+}
+
+// mergeSettings writes the entry's settings over `settings`, keeping any
+// settings shim doesn't know about (e.g. `pre` or `params`)
+func (e MenuEntry) mergeSettings(settings map[string]interface{}) map[string]interface{} {
+	if settings == nil {
+		settings = make(map[string]interface{})
+	}
+	for _, key := range []string{"name", "url", "identifier", "parent", "weight"} {
+		delete(settings, key)
+	}
+	for key, value := range e.menuSettings() {
+		settings[key] = value
+	}
+	return settings
+}
+
+// SaveMenuEntry - Add or update a menu entry wherever it is defined. Entries
+// which are new to the site configuration have an index of -1.
+func (s *Site) SaveMenuEntry(e *MenuEntry) error {
+	if len(strings.TrimSpace(e.Menu)) == 0 {
+		return fmt.Errorf("Menu entries need to belong to a menu.")
+	}
+
+	if e.Post != nil {
+		menus := e.Post.postMenus()
+		menus[e.Menu] = e.mergeSettings(menus[e.Menu])
+		e.Post.setPostMenus(menus)
+		return e.Post.save(e.Post.GetBody())
+	}
+
+	if len(e.Name) == 0 || len(e.URL) == 0 {
+		return fmt.Errorf("Menu entries from the site configuration need a name and a URL.")
+	}
+
+	entries := s.configMenus()[e.Menu]
+	if e.index < 0 || e.index >= len(entries) {
+		e.index = len(entries)
+		entries = append(entries, e.menuSettings())
+	} else {
+		entries[e.index] = e.mergeSettings(entries[e.index])
+	}
+	s.setConfigMenu(e.Menu, entries)
+
+	return s.SaveConfig()
+}
+
+// RemoveMenuEntry - Remove a menu entry from wherever it is defined
+func (s *Site) RemoveMenuEntry(e *MenuEntry) error {
+	if e.Post != nil {
+		menus := e.Post.postMenus()
+		delete(menus, e.Menu)
+		e.Post.setPostMenus(menus)
+		return e.Post.save(e.Post.GetBody())
+	}
+
+	entries := s.configMenus()[e.Menu]
+	if e.index < 0 || e.index >= len(entries) {
+		return fmt.Errorf("That menu entry doesn't exist anymore.")
+	}
+	entries = append(entries[:e.index], entries[e.index+1:]...)
+	s.setConfigMenu(e.Menu, entries)
+
+	return s.SaveConfig()
+}
+
+// MoveMenuEntry - Move an entry up (negative offset) or down (positive offset)
+// in its menu. The entries of the menu are given new weights as needed.
+func (s *Site) MoveMenuEntry(e *MenuEntry, offset int) error {
+	var menu *Menu
+	for _, m := range s.Menus() {
+		if m.Name == e.Menu {
+			menu = m
+			break
+		}
+	}
+	if menu == nil {
+		return fmt.Errorf("Could not find menu %s", e.Menu)
+	}
+
+	pos := -1
+	for i, entry := range menu.Entries {
+		if entry.Key() == e.Key() {
+			pos = i
+			break
+		}
+	}
+	target := pos + offset
+	if pos < 0 || target < 0 || target >= len(menu.Entries) {
+		return nil // already at the top or bottom
+	}
+
+	entries := menu.Entries
+	entries[pos], entries[target] = entries[target], entries[pos]
+
+	// Renumber the menu, only saving entries whose weight actually changed
+	configChanged := false
+	for i, entry := range entries {
+		weight := (i + 1) * 10
+		if entry.Weight == weight {
+			continue
+		}
+		entry.Weight = weight
+
+		if entry.Post != nil {
+			if err := s.SaveMenuEntry(entry); err != nil {
+				return err
+			}
+			continue
+		}
+
+		configEntries := s.configMenus()[entry.Menu]
+		configEntries[entry.index]["weight"] = weight
+		s.setConfigMenu(entry.Menu, configEntries)
+		configChanged = true
+	}
+
+	if configChanged {
+		return s.SaveConfig()
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSavePostMenuEntry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shim-menus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	modified := time.Now().Add(-time.Hour)
+	aPath := writeTestPost(t, dir, "a.md", "+++\ntitle = \"A\"\n[menu.main]\n  weight = 5\n  pre = \"<i>\"\n"+
+		"  [menu.main.params]\n    color = \"red\"\n+++\nHello\n", modified)
+	writeTestPost(t, dir, "b.md", "+++\ntitle = \"B\"\n[menu.main]\n  weight = 1\n+++\nHello\n", modified)
+	s := &Site{Location: dir, contentDir: "content"}
+
+	find := func(title string) *MenuEntry {
+		for _, m := range s.Menus() {
+			for _, e := range m.Entries {
+				if e.Post != nil && e.Post.Title == title {
+					return e
+				}
+			}
+		}
+		t.Fatalf("Could not find the menu entry of %s", title)
+		return nil
+	}
+
+	e := find("A")
+	e.Name = "Alpha"
+	if err = s.SaveMenuEntry(e); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.MoveMenuEntry(find("A"), -1); err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := ioutil.ReadFile(aPath)
+	for _, want := range []string{`name = "Alpha"`, `pre = "<i>"`, `color = "red"`, "weight = 10"} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("The menu entry lost %s:\n%s\n", want, data)
+		}
+	}
+}
@@ -0,0 +1,347 @@
+// SHIM - A web front end for the Hugo site generator
+// Copyright (C) 2016        Cameron Conn
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	paramTable = "table"
+	paramOther = "other" // dates and lists of tables, which are only edited by hand
+)
+
+// Kinds of parameters which can be added from the configuration page
+var paramKinds = []ParamField{
+	{Kind: fieldString},
+	{Kind: fieldBool},
+	{Kind: fieldInt},
+	{Kind: fieldFloat},
+	{Kind: fieldList, Of: fieldString},
+	{Kind: fieldList, Of: fieldInt},
+	{Kind: fieldList, Of: fieldFloat},
+	{Kind: fieldList, Of: fieldBool},
+	{Kind: paramTable},
+}
+
+// ParamField - One of a site's parameters, as it's shown in a form
+type ParamField struct {
+	Path  []string // keys from the `params` table down to this parameter
+	Kind  string
+	Of    string // the kind of the items of a list
+	Value string // lists have an item on each line
+}
+
+// Label - The parameter's name, with the tables it's in
+func (f ParamField) Label() string {
+	return strings.Join(f.Path, ".")
+}
+
+// Name - The parameter's path, in a form which survives a round trip through
+// a form
+func (f ParamField) Name() string {
+	name, _ := json.Marshal(f.Path)
+	return string(name)
+}
+
+// FormKind - The kind of the parameter, as it's sent back in a form
+func (f ParamField) FormKind() string {
+	if f.Kind == fieldList {
+		return f.Kind + ":" + f.Of
+	}
+	return f.Kind
+}
+
+// KindName - The kind of the parameter, for people
+func (f ParamField) KindName() string {
+	return paramKindName(f.FormKind())
+}
+
+// Multiline - Whether the parameter needs more than one line to edit
+func (f ParamField) Multiline() bool {
+	return f.Kind == fieldList || strings.Contains(f.Value, "\n")
+}
+
+// Editable - Whether the parameter can be changed from a form
+func (f ParamField) Editable() bool {
+	return f.Kind != paramTable && f.Kind != paramOther
+}
+
+// paramKindName describes a kind of parameter for people
+func paramKindName(kind string) string {
+	switch kind {
+	case fieldString:
+		return "text"
+	case fieldBool:
+		return "true or false"
+	case fieldInt:
+		return "whole number"
+	case fieldFloat:
+		return "number"
+	case fieldList + ":" + fieldString:
+		return "list of text"
+	case fieldList + ":" + fieldBool:
+		return "list of true or false"
+	case fieldList + ":" + fieldInt:
+		return "list of whole numbers"
+	case fieldList + ":" + fieldFloat:
+		return "list of numbers"
+	}
+	return kind
+}
+
+// paramKind finds what kind of value a parameter is, and how it's written
+// in a form
+func paramKind(value interface{}) (kind, text string) {
+	switch v := value.(type) {
+	case string:
+		return fieldString, v
+	case bool:
+		return fieldBool, strconv.FormatBool(v)
+	case float32:
+		return fieldFloat, strconv.FormatFloat(float64(v), 'g', -1, 32)
+	case float64:
+		return fieldFloat, strconv.FormatFloat(v, 'g', -1, 64)
+	case map[string]interface{}:
+		return paramTable, ""
+	}
+
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return fieldInt, strconv.FormatInt(rv.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return fieldInt, strconv.FormatUint(rv.Uint(), 10)
+	}
+	return paramOther, fmt.Sprint(value)
+}
+
+// paramFields lists the parameters in `params`, sorted, with each table
+// before the parameters in it
+func paramFields(params map[string]interface{}, path []string) []ParamField {
+	keys := []string{}
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fields := []ParamField{}
+	for _, key := range keys {
+		field := ParamField{Path: append(append([]string{}, path...), key)}
+		value := params[key]
+
+		if list, ok := value.([]interface{}); ok {
+			field.Kind, field.Of = paramListKind(list)
+			if field.Kind == fieldList {
+				items := make([]string, len(list))
+				for i, item := range list {
+					_, items[i] = paramKind(item)
+				}
+				field.Value = strings.Join(items, "\n")
+			} else {
+				field.Value = fmt.Sprint(value)
+			}
+			fields = append(fields, field)
+			continue
+		}
+
+		field.Kind, field.Value = paramKind(value)
+		fields = append(fields, field)
+		if table, ok := value.(map[string]interface{}); ok {
+			fields = append(fields, paramFields(table, field.Path)...)
+		}
+	}
+	return fields
+}
+
+// paramListKind finds the kind of the items of a list. Lists with different
+// kinds of items, tables, or text which spans lines can't be edited in a form.
+func paramListKind(list []interface{}) (kind, of string) {
+	of = fieldString
+	for i, item := range list {
+		itemKind, text := paramKind(item)
+		if itemKind == paramTable || itemKind == paramOther || (i > 0 && itemKind != of) ||
+			strings.Contains(text, "\n") {
+			return paramOther, ""
+		}
+		of = itemKind
+	}
+	return fieldList, of
+}
+
+// parseParamValue turns a form value into a parameter of the kind `kind`
+func parseParamValue(kind, raw string) (interface{}, error) {
+	parts := strings.SplitN(kind, ":", 2)
+	if parts[0] == fieldList && len(parts) == 2 {
+		list := []interface{}{}
+		for _, line := range strings.Split(raw, "\n") {
+			line = strings.TrimSpace(line)
+			if len(line) == 0 {
+				continue
+			}
+			item, err := parseParamValue(parts[1], line)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, item)
+		}
+		return list, nil
+	}
+
+	switch kind {
+	case fieldString:
+		return strings.Replace(raw, "\r\n", "\n", -1), nil
+	case fieldBool:
+		v, err := strconv.ParseBool(strings.TrimSpace(raw))
+		if err != nil {
+			return nil, fmt.Errorf("%q isn't true or false", raw)
+		}
+		return v, nil
+	case fieldInt:
+		v, err := strconv.ParseInt(strings.TrimSpace(raw), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q isn't a whole number", raw)
+		}
+		return v, nil
+	case fieldFloat:
+		v, err := strconv.ParseFloat(strings.TrimSpace(raw), 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q isn't a number", raw)
+		}
+		return v, nil
+	case paramTable:
+		return make(map[string]interface{}), nil
+	}
+	return nil, fmt.Errorf("Unknown kind of parameter %q", kind)
+}
+
+// setParam sets the parameter at `path`, making the tables it's in if needed
+func setParam(params map[string]interface{}, path []string, value interface{}) error {
+	table := params
+	for i, key := range path[:len(path)-1] {
+		next, ok := table[key]
+		if !ok {
+			next = make(map[string]interface{})
+			table[key] = next
+		}
+		if table, ok = next.(map[string]interface{}); !ok {
+			return fmt.Errorf("%s isn't a table", strings.Join(path[:i+1], "."))
+		}
+	}
+	table[path[len(path)-1]] = value
+	return nil
+}
+
+// removeParam removes the parameter (or table of them) at `path`
+func removeParam(params map[string]interface{}, path []string) {
+	table := params
+	for _, key := range path[:len(path)-1] {
+		next, ok := table[key].(map[string]interface{})
+		if !ok {
+			return
+		}
+		table = next
+	}
+	delete(table, path[len(path)-1])
+}
+
+// hasParam tells whether there is a parameter at `path`
+func hasParam(params map[string]interface{}, path []string) bool {
+	table := params
+	for _, key := range path[:len(path)-1] {
+		next, ok := table[key].(map[string]interface{})
+		if !ok {
+			return false
+		}
+		table = next
+	}
+	_, ok := table[path[len(path)-1]]
+	return ok
+}
+
+func parseParamName(name string) ([]string, error) {
+	path := []string{}
+	if err := json.Unmarshal([]byte(name), &path); err != nil || len(path) == 0 {
+		return nil, fmt.Errorf("%q isn't a parameter", name)
+	}
+	return path, nil
+}
+
+// paramsFromForm - The parameters in `params`, changed by a submitted form.
+// Parameters are changed, then removed, then a new one may be added.
+// `params` is left alone.
+func paramsFromForm(params map[string]interface{}, form url.Values) (map[string]interface{}, error) {
+	if params == nil {
+		params = make(map[string]interface{})
+	}
+	params = copyConfig(params).(map[string]interface{})
+
+	names, kinds, values := form["paramPath"], form["paramKind"], form["paramValue"]
+	if len(kinds) != len(names) || len(values) != len(names) {
+		return nil, fmt.Errorf("Some of the site parameters were missing from the form.")
+	}
+	for i, name := range names {
+		path, err := parseParamName(name)
+		if err != nil {
+			return nil, err
+		}
+		value, err := parseParamValue(kinds[i], values[i])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", strings.Join(path, "."), err.Error())
+		}
+		if err = setParam(params, path, value); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, name := range form["paramRemove"] {
+		path, err := parseParamName(name)
+		if err != nil {
+			return nil, err
+		}
+		removeParam(params, path)
+	}
+
+	key := strings.ToLower(strings.TrimSpace(form.Get("newParamKey")))
+	if len(key) == 0 {
+		return params, nil
+	}
+	path := strings.Split(key, ".")
+	for _, part := range path {
+		if len(strings.TrimSpace(part)) == 0 {
+			return nil, fmt.Errorf("%q isn't a parameter name. Use dots only between the names of tables.", key)
+		}
+	}
+	if hasParam(params, path) {
+		return nil, fmt.Errorf("There is already a parameter named %s.", key)
+	}
+
+	value, err := parseParamValue(form.Get("newParamKind"), form.Get("newParamValue"))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", key, err.Error())
+	}
+	if err = setParam(params, path, value); err != nil {
+		return nil, err
+	}
+	return params, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestParamFields(t *testing.T) {
+	params := map[string]interface{}{
+		"logo":   "logo.png",
+		"social": map[string]interface{}{"twitter": "me", "show": true},
+		"sizes":  []interface{}{int64(1), int64(2)},
+		"mixed":  []interface{}{"a", int64(2)},
+		"ratio":  1.5,
+	}
+
+	want := []ParamField{
+		{Path: []string{"logo"}, Kind: fieldString, Value: "logo.png"},
+		{Path: []string{"mixed"}, Kind: paramOther, Value: "[a 2]"},
+		{Path: []string{"ratio"}, Kind: fieldFloat, Value: "1.5"},
+		{Path: []string{"sizes"}, Kind: fieldList, Of: fieldInt, Value: "1\n2"},
+		{Path: []string{"social"}, Kind: paramTable},
+		{Path: []string{"social", "show"}, Kind: fieldBool, Value: "true"},
+		{Path: []string{"social", "twitter"}, Kind: fieldString, Value: "me"},
+	}
+
+	if fields := paramFields(params, nil); !reflect.DeepEqual(fields, want) {
+		t.Errorf("Expected fields %v, not %v\n", want, fields)
+	}
+}
+
+func TestParamsFromForm(t *testing.T) {
+	params := map[string]interface{}{
+		"logo":   "logo.png",
+		"social": map[string]interface{}{"twitter": "me"},
+		"sizes":  []interface{}{int64(1)},
+	}
+
+	form := url.Values{
+		"paramPath":     {`["logo"]`, `["sizes"]`, `["social","twitter"]`},
+		"paramKind":     {"string", "list:int", "string"},
+		"paramValue":    {"new.png", "1\r\n2\r\n\r\n3", "you"},
+		"paramRemove":   {`["logo"]`},
+		"newParamKey":   {"Social.Show"},
+		"newParamKind":  {"bool"},
+		"newParamValue": {"true"},
+	}
+
+	changed, err := paramsFromForm(params, form)
+	if err != nil {
+		t.Fatalf("Could not read form: %s\n", err.Error())
+	}
+
+	want := map[string]interface{}{
+		"social": map[string]interface{}{"twitter": "you", "show": true},
+		"sizes":  []interface{}{int64(1), int64(2), int64(3)},
+	}
+	if !reflect.DeepEqual(changed, want) {
+		t.Errorf("Expected params %v, not %v\n", want, changed)
+	}
+	if params["logo"] != "logo.png" {
+		t.Errorf("The original params were changed: %v\n", params)
+	}
+
+	bad := []url.Values{
+		{"paramPath": {`["sizes"]`}, "paramKind": {"list:int"}, "paramValue": {"1\nlots"}},
+		{"paramPath": {`["sizes"]`}, "paramKind": {"int"}},
+		{"newParamKey": {"social"}, "newParamKind": {"table"}},
+		{"newParamKey": {"sizes.big"}, "newParamKind": {"int"}, "newParamValue": {"1"}},
+		{"newParamKey": {"a..b"}, "newParamKind": {"string"}},
+	}
+	for i, form := range bad {
+		if _, err := paramsFromForm(params, form); err == nil {
+			t.Errorf("Form %d should have been rejected\n", i)
+		}
+	}
+}
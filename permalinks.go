@@ -0,0 +1,188 @@
+// SHIM - A web front end for the Hugo site generator
+// Copyright (C) 2016        Cameron Conn
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// permalinkFields - Everything about a post that can be used in a permalink
+// pattern
+type permalinkFields struct {
+	Date     time.Time
+	Sections []string // folders the post is in, outermost first
+	Title    string
+	Slug     string
+	Filename string
+}
+
+var regexPermalinkToken = regexp.MustCompile(`:[a-z_]+`)
+
+// expandPermalink fills in a permalink pattern like `/:year/:month/:slug/`
+// the same way Hugo does. Unknown tokens are left alone.
+func expandPermalink(pattern string, f permalinkFields) string {
+	section := ""
+	if len(f.Sections) > 0 {
+		section = f.Sections[0]
+	}
+
+	slug := f.Slug
+	if len(slug) == 0 {
+		slug = NormalizeName(f.Title)
+	}
+
+	link := regexPermalinkToken.ReplaceAllStringFunc(pattern, func(token string) string {
+		switch token {
+		case ":year":
+			return f.Date.Format("2006")
+		case ":month":
+			return f.Date.Format("01")
+		case ":monthname":
+			return strings.ToLower(f.Date.Format("January"))
+		case ":day":
+			return f.Date.Format("02")
+		case ":weekday":
+			return fmt.Sprint(int(f.Date.Weekday()))
+		case ":weekdayname":
+			return strings.ToLower(f.Date.Format("Monday"))
+		case ":yearday":
+			return fmt.Sprint(f.Date.YearDay())
+		case ":section":
+			return section
+		case ":sections":
+			return path.Join(f.Sections...)
+		case ":title":
+			return NormalizeName(f.Title)
+		case ":slug":
+			return slug
+		case ":filename", ":contentbasename":
+			return f.Filename
+		case ":slugorfilename", ":slugorcontentbasename":
+			if len(f.Slug) > 0 {
+				return f.Slug
+			}
+			return f.Filename
+		}
+		return token
+	})
+
+	return cleanURLPath(link)
+}
+
+// cleanURLPath removes doubled slashes (from blank tokens) and makes sure a
+// path starts with a slash.
+func cleanURLPath(link string) string {
+	trailing := strings.HasSuffix(link, "/")
+	link = path.Clean("/" + link)
+	if trailing && link != "/" {
+		link += "/"
+	}
+	return link
+}
+
+// permalinkPatterns - The `[permalinks]` of this site, by section. Newer
+// versions of Hugo keep the patterns for pages in `[permalinks.page]`.
+func (s Site) permalinkPatterns() map[string]string {
+	patterns := make(map[string]string)
+
+	all, ok := s.allSettings["permalinks"].(map[string]interface{})
+	if !ok {
+		return patterns
+	}
+	if pages, ok := all["page"].(map[string]interface{}); ok {
+		all = pages
+	}
+
+	for section, pattern := range all {
+		if p, ok := pattern.(string); ok {
+			patterns[section] = p
+		}
+	}
+	return patterns
+}
+
+// settingBool reads a boolean site setting
+func (s Site) settingBool(key string) bool {
+	value, _ := s.allSettings[key].(bool)
+	return value
+}
+
+// URL - The path of this post on its site, worked out from the site's
+// permalinks the same way Hugo does.
+func (p Post) URL() string {
+	if explicit, ok := p.all["url"].(string); ok && len(strings.TrimSpace(explicit)) > 0 {
+		return cleanURLPath(strings.TrimSpace(explicit))
+	}
+
+	relPath := strings.Replace(p.RelPath, "\\", "/", -1)
+	dir, filename := path.Split(relPath)
+	dir = strings.Trim(dir, "/")
+
+	// Section lists and page bundles are named after their folder
+	switch filename {
+	case "_index":
+		return cleanURLPath(strings.ToLower(dir) + "/")
+	case "index":
+		dir, filename = path.Split(dir)
+		dir = strings.Trim(dir, "/")
+	}
+
+	sections := []string{}
+	if len(dir) > 0 {
+		sections = strings.Split(dir, "/")
+	}
+
+	f := permalinkFields{
+		Sections: sections,
+		Title:    p.Title,
+		Slug:     p.Slug,
+		Filename: filename,
+	}
+	if p.Published != nil {
+		f.Date = *p.Published
+	}
+
+	patternKey := "/"
+	if len(sections) > 0 {
+		patternKey = sections[0]
+	}
+
+	var link string
+	if pattern, ok := p.Site.permalinkPatterns()[patternKey]; ok {
+		link = expandPermalink(pattern, f)
+	} else {
+		name := filename
+		if len(p.Slug) > 0 {
+			name = p.Slug
+		}
+		link = cleanURLPath(path.Join(dir, name) + "/")
+	}
+
+	if !p.Site.settingBool("disablepathtolower") {
+		link = strings.ToLower(link)
+	}
+
+	if p.Site.settingBool("uglyurls") && strings.HasSuffix(link, "/") && link != "/" {
+		link = strings.TrimSuffix(link, "/") + ".html"
+	}
+
+	return link
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPostURL(t *testing.T) {
+	date := time.Date(2016, time.March, 5, 10, 0, 0, 0, time.UTC)
+	patterns := map[string]interface{}{
+		"post": "/:year/:month/:slug/",
+		"docs": "/:sections/:filename/",
+	}
+
+	sites := []*Site{
+		{allSettings: map[string]interface{}{}},
+		{allSettings: map[string]interface{}{"permalinks": patterns}},
+		{allSettings: map[string]interface{}{"permalinks": patterns, "uglyurls": true}},
+	}
+
+	posts := []Post{
+		{RelPath: "post/My-Post", Site: sites[0]},
+		{RelPath: "post/my-post", Slug: "hello", Site: sites[0]},
+		{RelPath: "about", Site: sites[0]},
+		{RelPath: "post/my-post", Title: "Hello World", Published: &date, Site: sites[1]},
+		{RelPath: "post/my-post", Slug: "hi", Published: &date, Site: sites[1]},
+		{RelPath: "docs/guide/setup", Site: sites[1]},
+		{RelPath: "post/bundle/index", Slug: "hi", Published: &date, Site: sites[2]},
+		{RelPath: "post/_index", Site: sites[1]},
+		{RelPath: "post/my-post", Site: sites[1], all: map[string]interface{}{"url": "/custom/path/"}},
+	}
+
+	outputs := []string{
+		"/post/my-post/",
+		"/post/hello/",
+		"/about/",
+		"/2016/03/hello-world/",
+		"/2016/03/hi/",
+		"/docs/guide/setup/",
+		"/2016/03/hi.html",
+		"/post/",
+		"/custom/path/",
+	}
+
+	for i, p := range posts {
+		if url := p.URL(); url != outputs[i] {
+			t.Errorf("%s was supposed to be at |%s|, not |%s|\n", p.RelPath, outputs[i], url)
+		}
+	}
+}
@@ -19,31 +19,43 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"crypto/rand"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"github.com/BurntSushi/toml"
 	"github.com/spf13/viper"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 )
 
 const (
 	tomlBoundary = "+++\n"
 	dateFormat   = "_2 Jan 2006 @ 15:04"
+	postIDKey    = "shimid" // front matter key of a post's stable ID
+	postIDsFile  = "postids.toml"
 )
 
+// Guards the post ID index of every site, which is read each time a site's
+// posts are listed
+var postIDsLock sync.Mutex
+
 // Post - Represents a post along with all its metadata
 type Post struct {
 	// These are never edited by us. They are effectively constants.
 	Location string
 	RelPath  string
 	Site     *Site
+	id       string    // see PostID
+	modified time.Time // when the post's file last changed
 
 	Title       string
 	author      string
@@ -52,6 +64,7 @@ type Post struct {
 	Slug        string
 	Draft       bool
 	Published   *time.Time
+	dateErr     error // why the front matter's date couldn't be read
 	Aliases     []string
 	Taxonomies  map[string][]string    // TODO: Is there a better storage format to use?
 	all         map[string]interface{} // All TOML data for this file
@@ -72,6 +85,7 @@ func (p *Post) handleFrontMatter(v *viper.Viper) {
 	p.ManualDesc = v.GetString("description")
 	p.Slug = v.GetString("slug")
 	p.Draft = v.GetBool("draft")
+	p.id = v.GetString(postIDKey)
 
 	v.SetDefault("aliases", []string{})
 	aliases := v.GetStringSlice("aliases")
@@ -83,16 +97,16 @@ func (p *Post) handleFrontMatter(v *viper.Viper) {
 		p.Aliases = aliases
 	}
 
-	{
-		publishString := v.GetString("date")
-		if len(publishString) > 0 {
-			pTime, err := time.Parse(time.RFC3339, publishString)
-
-			// Default to current time in case of parsing error
-			if err != nil {
-				pTime = time.Now()
-			}
-
+	p.Published = nil
+	p.dateErr = nil
+	if date := v.Get("date"); date != nil && date != "" {
+		pTime, err := parseDate(date, p.Site.TimeZone())
+		if err != nil {
+			// Keep the date as it is, so it can be fixed instead of replaced
+			p.dateErr = fmt.Errorf("The date in this post's front matter can't be read: %s",
+				err.Error())
+		} else {
+			pTime = pTime.In(p.Site.TimeZone())
 			p.Published = &pTime
 		}
 	}
@@ -103,8 +117,8 @@ func (p *Post) handleFrontMatter(v *viper.Viper) {
 		// If the post is a draft, and there is no "editdate" key, then this post has
 		// no date, even if we assigned it earlier.
 		lastEditDate := v.GetString("editdate")
-		if p.Draft && len(lastEditDate) == 0 {
-			p.all["editdate"] = p.Date().Format(time.RFC3339)
+		if p.Draft && len(lastEditDate) == 0 && p.Published != nil {
+			p.all["editdate"] = p.Published.Format(time.RFC3339)
 			delete(p.all, "date")
 			p.Published = nil
 		}
@@ -138,6 +152,9 @@ func (s *Site) loadPost(postPath, contentDirPath string) (*Post, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Could not open post data file: %s\n", err.Error())
 	}
+	if info, err := file.Stat(); err == nil {
+		p.modified = info.ModTime()
+	}
 
 	frontMatter := bytes.NewBuffer([]byte{})
 	frontScanner := bufio.NewScanner(file)
@@ -168,29 +185,9 @@ func (s *Site) loadPost(postPath, contentDirPath string) (*Post, error) {
 		return nil, fmt.Errorf("could not find post path: %s\n", err.Error())
 	}
 
-	descriptionBuf := new(bytes.Buffer)
-	descriptionBuf.ReadFrom(file)
-
-	num := descriptionBuf.Len()
-	if num > 160 {
-		descriptionBuf.Truncate(160)
-	}
-	descriptionBytes := descriptionBuf.Bytes()
-
-	descriptionBuf = nil
-
-	const dot = '.'
-	if num > 160 {
-		// find last newline and truncate to make it pretty
-		lastLineEnd := bytes.LastIndexByte(descriptionBytes, '\n')
-		if lastLineEnd > 0 {
-			descriptionBytes = descriptionBytes[:lastLineEnd]
-		}
-
-		descriptionBytes = append(descriptionBytes, '\n', '\n', dot, dot, dot)
-	}
-
-	p.Description = (string)(descriptionBytes)
+	bodyBuf := new(bytes.Buffer)
+	bodyBuf.ReadFrom(file)
+	p.Description = summarize(bodyBuf.String(), s.SummaryLength())
 
 	return p, nil
 }
@@ -207,13 +204,13 @@ func (s *Site) newPost(name string) (fPath string, err error) {
 		return "", fmt.Errorf("A page already exists at that location!")
 	}
 
-	hugoPath, err := exec.LookPath("hugo")
+	hugo, err := s.HugoPath()
 	if err != nil {
 		return "", err
 	}
 
 	// TODO: Capture build output and send to logs
-	cmd := exec.Command(hugoPath, "new", name)
+	cmd := exec.Command(hugo, "new", name)
 	cmd.Dir = s.Location
 	err = cmd.Run()
 	if err != nil {
@@ -224,8 +221,43 @@ func (s *Site) newPost(name string) (fPath string, err error) {
 	return
 }
 
-// SavePost - Save post to disk to path path
+// SavePost - Save post to disk to path path, then rebuild the site in the
+// background.
 func (p *Post) SavePost(body string) error {
+	err := p.save(body)
+	if err != nil {
+		return err
+	}
+
+	// TODO: Use a build queue or worker system
+	site, draft := p.Site, p.Draft
+	site.inBackground(func() {
+		var err error
+
+		if draft {
+			err = site.BuildPreview()
+		} else {
+			err = site.BuildPublic()
+		}
+		if err != nil {
+			log.Printf("Failed to run build in background: %s\n", err.Error())
+		}
+	})
+
+	site.inBackground(func() { site.loadTaxonomyTerms() })
+	return nil
+
+}
+
+// save writes this post to disk without rebuilding the site
+func (p *Post) save(body string) error {
+	// Comments and workflow states of a post without an ID are filed under
+	// its path-based ID until it gets one
+	legacyID := ""
+	if len(p.id) == 0 {
+		legacyID = p.legacyPostID()
+	}
+
 	// Go ahead and update the map of all TOML keys
 	err := p.updateMap()
 	if err != nil {
@@ -251,24 +283,17 @@ func (p *Post) SavePost(body string) error {
 	if err != nil {
 		return err
 	}
+	p.Description = summarize(body, p.Site.SummaryLength())
 
-	// TODO: Use a build queue or worker system
-	go func() {
-		var err error
-
-		if p.Draft {
-			err = p.Site.BuildPreview()
-		} else {
-			err = p.Site.BuildPublic()
+	if len(legacyID) > 0 {
+		if err = p.moveComments(legacyID); err != nil {
+			return fmt.Errorf("Could not keep the post's comments: %s", err.Error())
 		}
-		if err != nil {
-			log.Printf("Failed to run build in background: %s\n", err.Error())
+		if err = p.moveWorkflowState(legacyID); err != nil {
+			return fmt.Errorf("Could not keep the post's workflow state: %s", err.Error())
 		}
-	}()
-
-	go p.Site.loadTaxonomyTerms()
+	}
 	return nil
-
 }
 
 // update the hashmap associated with this post
@@ -282,10 +307,17 @@ func (p *Post) updateMap() error {
 	p.all["slug"] = p.Slug
 	p.all["draft"] = p.Draft
 
+	// Posts made outside of shim get their ID the first time they're saved
+	if len(p.id) == 0 {
+		p.id = newPostID()
+	}
+	p.all[postIDKey] = p.id
+
 	p.all["editdate"] = time.Now().Format(time.RFC3339)
 	if p.HasDate() {
 		p.all["date"] = p.Date().Format(time.RFC3339)
-	} else {
+		p.dateErr = nil
+	} else if p.dateErr == nil {
 		delete(p.all, "date")
 	}
 
@@ -354,12 +386,21 @@ func (p *Post) TaxonomyMap() map[string]string {
 	return items
 }
 
-// Publish - Publish this post
+// Publish - Publish this post. Posts which don't satisfy their section's
+// schema can't be published, and a ValidationErrors is returned instead.
 func (p *Post) Publish(text string) error {
+	if errs := p.Validate(); len(errs) > 0 {
+		return errs
+	}
+
 	p.Draft = false
 	if p.Published == nil {
 		p.Published = p.Date()
 	}
+	if p.Published == nil {
+		now := time.Now().In(p.Site.TimeZone())
+		p.Published = &now
+	}
 
 	err := p.SavePost(text)
 	if err != nil {
@@ -379,27 +420,29 @@ func (p Post) Author() string {
 }
 
 // Date The published date of this post OR the last time it was edited
-// if this post is a draft.
+// if this post is a draft. Posts without a date, or whose date can't be read,
+// have none.
 func (p Post) Date() *time.Time {
 	if p.Published != nil {
 		return p.Published
 	}
+	if p.dateErr != nil {
+		return nil
+	}
 
 	// If there's an edit date, try and use that for sorting.
 	if p.Draft {
 		if editTimeValue, ok := p.all["editdate"]; ok {
-			if editTimeStr, ok := editTimeValue.(string); ok {
-				editTime, err := time.Parse(time.RFC3339, editTimeStr)
-				if err == nil {
-					return &editTime
-				}
-				log.Println("Couldn't parse time: " + err.Error())
+			editTime, err := parseDate(editTimeValue, p.Site.TimeZone())
+			if err == nil {
+				editTime = editTime.In(p.Site.TimeZone())
+				return &editTime
 			}
+			log.Println("Couldn't parse time: " + err.Error())
 		}
 	}
 
-	now := time.Now()
-	return &now
+	return nil
 }
 
 // HasDate lets you know if the user has manually specified a date for this post
@@ -409,7 +452,34 @@ func (p Post) HasDate() bool {
 
 // WebDate - Get the date displayed in shim for this post
 func (p Post) WebDate() string {
-	return p.Date().Format(dateFormat)
+	if p.dateErr != nil {
+		return "Date can't be read"
+	}
+	date := p.Date()
+	if date == nil {
+		return "No date"
+	}
+	return p.Site.WebTime(*date)
+}
+
+// DateInput - This post's date for editing. A date which couldn't be read is
+// shown as it is, so that it can be fixed.
+func (p Post) DateInput() string {
+	if p.HasDate() {
+		return p.WebDate()
+	}
+	if date, ok := p.all["date"]; ok && p.dateErr != nil {
+		return fmt.Sprint(date)
+	}
+	return ""
+}
+
+// DateError - Why this post's date couldn't be read, or blank if it could
+func (p Post) DateError() string {
+	if p.dateErr == nil {
+		return ""
+	}
+	return p.dateErr.Error()
 }
 
 func (p Post) String() string {
@@ -448,26 +518,190 @@ func (p Post) GetBody() string {
 	return postBody.String()
 }
 
-// PostID is the base64 of the relative path for this post.
+// newPostID makes a random ID for a post
+func newPostID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		// Extremely unlikely, but time is unique enough for one site
+		return fmt.Sprintf("%016x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// PostID - The stable ID of this post, which stays the same when the post's
+// file is moved or renamed. It is kept in the post's front matter. Posts which
+// haven't been saved by shim yet use their path-based ID until they are.
+func (p *Post) PostID() string {
+	if len(p.id) == 0 {
+		return p.legacyPostID()
+	}
+	return p.id
+}
+
+// legacyPostID is the base64 of the relative path for this post, which is
+// what shim used to identify posts. Old links still use it.
 //
 // See also: Post.RelPath
-func (p *Post) PostID() string {
-	relPathStr := p.RelPath
+func (p *Post) legacyPostID() string {
+	return base64.StdEncoding.EncodeToString([]byte(p.RelPath))
+}
 
-	b64Path := base64.StdEncoding.EncodeToString([]byte(relPathStr))
+// postIDIndex - Which file each post ID belongs to, kept in the site's shim
+// folder. When a post's file is copied, the copy has the same ID in its front
+// matter, and the index tells which of them is the original.
+type postIDIndex struct {
+	Paths map[string]string `toml:"paths"` // post ID to Post.RelPath
+}
 
-	return b64Path
+func (s Site) postIDsPath() string {
+	return filepath.Join(s.shimDir(), postIDsFile)
+}
+
+func (s Site) readPostIDs() (*postIDIndex, error) {
+	index := &postIDIndex{Paths: make(map[string]string)}
+	_, err := toml.DecodeFile(s.postIDsPath(), index)
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	if index.Paths == nil {
+		index.Paths = make(map[string]string)
+	}
+	return index, err
+}
+
+func (s Site) writePostIDs(index *postIDIndex) error {
+	buf := new(bytes.Buffer)
+	if err := toml.NewEncoder(buf).Encode(index); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.shimDir(), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.postIDsPath(), buf.Bytes(), 0644)
+}
+
+// duplicateIDs finds the posts which have another post's ID, which happens
+// when a post's file is copied. The post at the path in `index` keeps the ID.
+// IDs which aren't in the index yet stay with the oldest file.
+func duplicateIDs(posts []*Post, index *postIDIndex) (copies []*Post) {
+	owners := make(map[string]*Post)
+	for _, p := range posts {
+		if len(p.id) == 0 {
+			continue
+		}
+
+		owner, ok := owners[p.id]
+		if !ok {
+			owners[p.id] = p
+			continue
+		}
+
+		indexed := index.Paths[p.id]
+		switch {
+		case owner.RelPath == indexed:
+			copies = append(copies, p)
+		case p.RelPath == indexed,
+			len(indexed) == 0 && (p.modified.Before(owner.modified) ||
+				(p.modified.Equal(owner.modified) && p.RelPath < owner.RelPath)):
+			owners[p.id] = p
+			copies = append(copies, owner)
+		default:
+			copies = append(copies, p)
+		}
+	}
+	return copies
+}
+
+// settleDuplicateIDs gives copied posts IDs of their own, and records which
+// file each ID belongs to
+func (s *Site) settleDuplicateIDs(posts []*Post) {
+	postIDsLock.Lock()
+	defer postIDsLock.Unlock()
+
+	index, err := s.readPostIDs()
+	if err != nil {
+		log.Printf("Could not read post IDs: %s\n", err.Error())
+	}
+
+	for _, p := range duplicateIDs(posts, index) {
+		p.id = newPostID()
+		if err := p.writeID(); err != nil {
+			log.Printf("Could not give the copied post %s an ID of its own: %s\n", p.RelPath, err.Error())
+			p.id = "" // its path-based ID is used instead
+		}
+	}
+
+	paths := make(map[string]string)
+	changed := false
+	for _, p := range posts {
+		if len(p.id) > 0 {
+			paths[p.id] = p.RelPath
+			changed = changed || index.Paths[p.id] != p.RelPath
+		}
+	}
+	if !changed && len(paths) == len(index.Paths) {
+		return
+	}
+	if err := s.writePostIDs(&postIDIndex{Paths: paths}); err != nil {
+		log.Printf("Could not save post IDs: %s\n", err.Error())
+	}
+}
+
+// writeID stores this post's ID in its front matter without touching anything
+// else in the file
+func (p *Post) writeID() error {
+	data, err := ioutil.ReadFile(p.Location)
+	if err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(data, []byte(tomlBoundary)) {
+		return fmt.Errorf("%s has no TOML front matter", p.RelPath)
+	}
+
+	idLine := fmt.Sprintf("%s = %q\n", postIDKey, p.id)
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	for i := 1; i < len(lines) && string(lines[i]) != tomlBoundary; i++ {
+		key := bytes.TrimSpace(bytes.SplitN(lines[i], []byte("="), 2)[0])
+		if string(key) == postIDKey {
+			lines[i] = []byte(idLine)
+			return ioutil.WriteFile(p.Location, bytes.Join(lines, nil), 0666)
+		}
+	}
+	return fmt.Errorf("%s has no %s in its front matter", p.RelPath, postIDKey)
+}
+
+// FindPost - Find one of this site's posts by its ID
+//
+// See also: Post.PostID
+func (s *Site) FindPost(id string) (*Post, error) {
+	s.GetAllPosts()
+	for _, p := range s.Posts {
+		if p.PostID() == id {
+			return p, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Could not find that post.")
+}
+
+// FindLegacyPost - Find a post by the path-based ID shim used to give posts.
+// Handlers should redirect to the post's current ID.
+func (s *Site) FindLegacyPost(id string) (*Post, error) {
+	for _, p := range s.Posts {
+		if p.legacyPostID() == id {
+			return p, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Could not find that post.")
 }
 
 // PreviewPath - Get the preview path for this post. This is effectively final
 // path of the URL the page will be at after Hugo generates this page.
-// TODO: Permalinks?
+//
+// See also: Post.URL
 func (p Post) PreviewPath() string {
-	if len(p.Slug) == 0 {
-		return p.RelPath + "/"
-	}
-
-	return filepath.Join(p.RelPath, "..", p.Slug+"/")
+	return strings.TrimPrefix(p.URL(), "/")
 }
 
 // WebAliases - Access this post's aliases in a format for the web
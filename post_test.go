@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func writeTestPost(t *testing.T, dir, name, src string, modified time.Time) string {
+	postPath := filepath.Join(dir, "content", name)
+	if err := os.MkdirAll(filepath.Dir(postPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(postPath, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(postPath, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+	return postPath
+}
+
+func TestPostIDs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shim-post-ids")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := "+++\ntitle = \"A\"\n+++\nHello\n"
+	postPath := writeTestPost(t, dir, "post/a.md", src, time.Now().Add(-time.Hour))
+	s := &Site{Location: dir, contentDir: "content"}
+
+	// Reading posts never changes their files
+	s.GetAllPosts()
+	if data, _ := ioutil.ReadFile(postPath); string(data) != src {
+		t.Errorf("Reading a post changed its file to:\n%s\n", data)
+	}
+	p := s.Posts[0]
+	legacy := p.legacyPostID()
+	if p.PostID() != legacy {
+		t.Errorf("A post without an ID should use %s, not %s\n", legacy, p.PostID())
+	}
+	if found, err := s.FindPost(legacy); err != nil || found.Location != p.Location {
+		t.Errorf("Could not find a post without an ID by its path-based ID\n")
+	}
+
+	// Saving gives the post an ID of its own
+	if err := s.Posts[0].save("Hello\n"); err != nil {
+		t.Fatal(err)
+	}
+	s.GetAllPosts()
+	id := s.Posts[0].PostID()
+	if id == legacy || len(id) != 16 {
+		t.Errorf("Saving should have given the post a new ID, not %s\n", id)
+	}
+	if data, _ := ioutil.ReadFile(postPath); !bytes.Contains(data, []byte(id)) {
+		t.Errorf("The post's ID wasn't saved in its front matter:\n%s\n", data)
+	}
+
+	// Old links are sent to the post's ID
+	old := shim.state
+	setShimState(shimState{config: viper.New(), assets: &assets{basepath: "/shim"}})
+	defer setShimState(old)
+
+	rec := httptest.NewRecorder()
+	redirectLegacyPost(rec, httptest.NewRequest("GET", "/edit/"+legacy, nil), s, "/edit/", legacy)
+	if rec.Code != http.StatusMovedPermanently || rec.Header().Get("Location") != "/shim/edit/"+id {
+		t.Errorf("The old link was sent to %d %s\n", rec.Code, rec.Header().Get("Location"))
+	}
+	rec = httptest.NewRecorder()
+	redirectLegacyPost(rec, httptest.NewRequest("GET", "/edit/nothing", nil), s, "/edit/", "nothing")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("A link to no post should be a 404, not %d\n", rec.Code)
+	}
+
+	// A copy gets an ID of its own, whichever order they're read in, and even
+	// once the original is saved after it
+	data, _ := ioutil.ReadFile(postPath)
+	for _, name := range []string{"post/0-copy.md", "post/z-copy.md"} {
+		copyPath := writeTestPost(t, dir, name, string(data), time.Now())
+		s.GetAllPosts()
+
+		for _, p := range s.Posts {
+			if p.Location == postPath && p.PostID() != id {
+				t.Errorf("The original lost its ID to %s\n", name)
+			}
+			if p.Location == copyPath && (p.PostID() == id || len(p.PostID()) != 16) {
+				t.Errorf("%s should have an ID of its own, not %s\n", p.RelPath, p.PostID())
+			}
+		}
+		if copied, _ := ioutil.ReadFile(copyPath); bytes.Contains(copied, []byte(id)) {
+			t.Errorf("The copy's new ID wasn't saved in its front matter:\n%s\n", copied)
+		}
+
+		original, err := s.FindPost(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = original.save("Hello again\n"); err != nil {
+			t.Fatal(err)
+		}
+		s.GetAllPosts()
+		if found, err := s.FindPost(id); err != nil || found.Location != postPath {
+			t.Errorf("Saving the original gave its ID to %s\n", name)
+		}
+		os.Remove(copyPath)
+	}
+}
+
+func TestPostDates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shim-post-dates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	modified := time.Now().Add(-time.Hour)
+	writeTestPost(t, dir, "post/dated.md", "+++\ntitle = \"Dated\"\ndate = \"2016-05-01T10:00:00Z\"\n+++\n", modified)
+	writeTestPost(t, dir, "post/none.md", "+++\ntitle = \"None\"\n+++\n", modified)
+	writeTestPost(t, dir, "post/bad.md", "+++\ntitle = \"Bad\"\ndate = \"someday\"\n+++\n", modified)
+	s := &Site{Location: dir, contentDir: "content"}
+	s.GetAllPosts()
+
+	posts := make(map[string]*Post)
+	for _, p := range s.Posts {
+		posts[p.Title] = p
+	}
+	if date := posts["Dated"].Date(); date == nil || date.Year() != 2016 {
+		t.Errorf("The dated post's date is %v\n", date)
+	}
+	for title, web := range map[string]string{"None": "No date", "Bad": "Date can't be read"} {
+		if date := posts[title].Date(); date != nil {
+			t.Errorf("%s should have no date, not %s\n", title, date)
+		}
+		if posts[title].WebDate() != web {
+			t.Errorf("%s is shown as %q\n", title, posts[title].WebDate())
+		}
+	}
+
+	sorted := SitePosts{posts["Dated"], posts["None"]}
+	sort.Sort(sorted)
+	if sorted[0].Title != "None" {
+		t.Errorf("Posts without a date should be listed first")
+	}
+}
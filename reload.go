@@ -0,0 +1,243 @@
+// SHIM - A web front end for the Hugo site generator
+// Copyright (C) 2016        Cameron Conn
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"github.com/spf13/viper"
+	"html/template"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Only one reload (or change to shim's configuration file) runs at a time
+var reloadLock sync.Mutex
+
+// shimState - What shim reads from its configuration. It's replaced all at
+// once, so a request never sees part of an old configuration and part of a
+// new one.
+type shimState struct {
+	config    *viper.Viper
+	assets    *assets
+	workflow  *Workflow // nil unless shim's configuration has a [workflow]
+	templates *template.Template
+}
+
+var shim = struct {
+	sync.RWMutex
+	state shimState
+}{state: shimState{config: viper.New(), assets: new(assets)}}
+
+// shimConfig - shim's configuration. It's never changed in place: edit the
+// file and call rereadConfig instead.
+func shimConfig() *viper.Viper {
+	shim.RLock()
+	defer shim.RUnlock()
+	return shim.state.config
+}
+
+// shimAssets - Where shim's files are
+func shimAssets() *assets {
+	shim.RLock()
+	defer shim.RUnlock()
+	return shim.state.assets
+}
+
+// shimWorkflow - The editorial workflow of every site, or nil if shim isn't
+// configured to use one.
+func shimWorkflow() *Workflow {
+	shim.RLock()
+	defer shim.RUnlock()
+	return shim.state.workflow
+}
+
+// shimTemplates - shim's page templates
+func shimTemplates() *template.Template {
+	shim.RLock()
+	defer shim.RUnlock()
+	return shim.state.templates
+}
+
+// setShimState switches shim to a new configuration
+func setShimState(state shimState) {
+	shim.Lock()
+	shim.state = state
+	shim.Unlock()
+}
+
+// readConfig reads shim's configuration file at `path`. Without a path,
+// config.toml is looked for in the folder shim runs in.
+func readConfig(path string) (*viper.Viper, error) {
+	v := viper.New()
+	if len(path) == 0 {
+		v.SetConfigName("config")
+		v.AddConfigPath(".")
+	} else {
+		v.SetConfigFile(path)
+	}
+
+	v.SetDefault("sitesDir", "sites")
+	v.SetDefault("templatesDir", "templates")
+	v.SetDefault("staticDir", "static")
+	v.SetDefault("themeDir", "themes")
+	v.SetDefault("baseurl", "http://127.0.0.1:8080")
+
+	if err := v.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("Could not read shim's configuration: %s", err.Error())
+	}
+	return v, nil
+}
+
+// loadShimState reads everything shim needs from its configuration file,
+// without using any of it yet.
+func loadShimState(path string) (state shimState, err error) {
+	if state.config, err = readConfig(path); err != nil {
+		return
+	}
+	if state.assets, err = loadAssets(state.config); err != nil {
+		return
+	}
+	if state.workflow, err = loadWorkflow(state.config); err != nil {
+		return
+	}
+	if state.templates, err = loadTemplates(state.assets); err != nil {
+		err = fmt.Errorf("Could not parse templates: %s", err.Error())
+	}
+	return
+}
+
+// rereadConfig reads shim's configuration file again after shim changed it.
+// Only the settings are replaced; shim's folders, workflow and templates
+// change when shim is reloaded. Call it with reloadLock held.
+func rereadConfig() error {
+	v, err := readConfig(shimConfig().ConfigFileUsed())
+	if err != nil {
+		return err
+	}
+
+	shim.Lock()
+	shim.state.config = v
+	shim.Unlock()
+	return nil
+}
+
+// reloadReport - What changed when shim's configuration was reloaded
+type reloadReport struct {
+	Started  []string // sites which are now being served
+	Stopped  []string // sites which aren't anymore
+	Problems []string // sites which couldn't be reloaded
+}
+
+func (r reloadReport) String() string {
+	parts := []string{"Reloaded shim's configuration."}
+	if len(r.Started) > 0 {
+		parts = append(parts, "Started "+strings.Join(r.Started, ", ")+".")
+	}
+	if len(r.Stopped) > 0 {
+		parts = append(parts, "Stopped "+strings.Join(r.Stopped, ", ")+".")
+	}
+	if len(r.Problems) > 0 {
+		parts = append(parts, "Problems: "+strings.Join(r.Problems, "; "))
+	}
+	return strings.Join(parts, " ")
+}
+
+// reloadShim reads shim's configuration again and applies it: folders, the
+// workflow and templates are replaced, and sites are started or stopped to
+// match `[sites]`. Requests which are already running finish with the old
+// configuration. If anything can't be read, nothing is changed.
+func reloadShim() (*reloadReport, error) {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	state, err := loadShimState(shimConfig().ConfigFileUsed())
+	if err != nil {
+		return nil, err
+	}
+	names, err := findSites(state.config)
+	if err != nil {
+		return nil, err
+	}
+
+	if state.assets.basepath != shimAssets().basepath {
+		log.Printf("Base path is now %s\n", state.assets.basepath)
+	}
+	setShimState(state)
+
+	report := new(reloadReport)
+	enabled := make(map[string]bool)
+	for _, name := range names {
+		enabled[name] = true
+	}
+
+	// New sites start before old ones stop, so there's always a site to show
+	current := siteList()
+	for _, name := range names {
+		if siteNamed(name) != nil {
+			continue
+		}
+
+		err := createSite(name)
+		var s *Site
+		if err == nil {
+			s, err = loadSite(name)
+		}
+		if err != nil {
+			report.Problems = append(report.Problems, fmt.Sprintf("%s: %s", name, err.Error()))
+			continue
+		}
+
+		addSite(s)
+		report.Started = append(report.Started, name)
+	}
+
+	for _, s := range current {
+		if !enabled[s.ShortName] {
+			if err := checkNotLast(s.ShortName); err != nil {
+				report.Problems = append(report.Problems, err.Error())
+				continue
+			}
+			removeSite(s.ShortName)
+			report.Stopped = append(report.Stopped, s.ShortName)
+		} else if _, err := s.Reload(); err != nil {
+			report.Problems = append(report.Problems, err.Error())
+		}
+	}
+
+	return report, nil
+}
+
+// reloadOnHangup reloads shim's configuration whenever shim gets SIGHUP
+func reloadOnHangup() {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+
+	go func() {
+		for range hangups {
+			report, err := reloadShim()
+			if err != nil {
+				log.Printf("Could not reload: %s\n", err.Error())
+			} else {
+				log.Println(report.String())
+			}
+		}
+	}()
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReloadShim(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shim-reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	templates := filepath.Join(dir, "templates")
+	os.MkdirAll(templates, 0755)
+	ioutil.WriteFile(filepath.Join(templates, "page.tmpl"), []byte(`{{define "page"}}ok{{end}}`), 0644)
+
+	confPath := filepath.Join(dir, "config.toml")
+	good := "templatesDir = \"" + templates + "\"\nbaseurl = \"http://a.example/shim\"\n"
+	ioutil.WriteFile(confPath, []byte(good), 0644)
+
+	old := shim.state
+	defer setShimState(old)
+	state, err := loadShimState(confPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setShimState(state)
+
+	// A broken workflow keeps the configuration which was already running
+	broken := "baseurl = \"http://b.example/\"\n[workflow]\nstates = [{name = \"draft\"}]\n"
+	ioutil.WriteFile(confPath, []byte(broken), 0644)
+	if _, err = reloadShim(); err == nil {
+		t.Fatal("A broken workflow was reloaded")
+	}
+	if shimConfig() != state.config || shimAssets().basepath != "/shim" || shimWorkflow() != nil {
+		t.Errorf("A failed reload changed shim's configuration")
+	}
+
+	ioutil.WriteFile(confPath, []byte(good+"[workflow]\n"), 0644)
+	if state, err = loadShimState(confPath); err != nil {
+		t.Fatal(err)
+	}
+	if state.workflow == nil {
+		t.Errorf("The workflow wasn't turned on")
+	}
+	setShimState(state)
+
+	// Sites added, turned off and removed by shim are read back from the file
+	if err = registerSite("blog", "blog"); err != nil {
+		t.Fatal(err)
+	}
+	if !shimConfig().GetBool("sites.blog.enabled") {
+		t.Errorf("The new site isn't enabled")
+	}
+	if err = setSiteEnabled("blog", false); err != nil {
+		t.Fatal(err)
+	}
+	if shimConfig().GetBool("sites.blog.enabled") {
+		t.Errorf("The site is still enabled")
+	}
+	if err = unregisterSite("blog"); err != nil {
+		t.Fatal(err)
+	}
+	if err = checkNewSiteName("blog"); err != nil {
+		t.Errorf("The name of a removed site can't be used again: %s\n", err)
+	}
+}
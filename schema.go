@@ -0,0 +1,414 @@
+// SHIM - A web front end for the Hugo site generator
+// Copyright (C) 2016        Cameron Conn
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	schemaFile = "schemas.toml"
+
+	fieldString = "string"
+	fieldBool   = "bool"
+	fieldInt    = "int"
+	fieldFloat  = "float"
+	fieldDate   = "date"
+	fieldList   = "list"
+)
+
+// Field types a schema may use
+var fieldTypes = []string{fieldString, fieldBool, fieldInt, fieldFloat, fieldDate, fieldList}
+
+// FieldSchema - A front matter field used by the posts of a section
+type FieldSchema struct {
+	Name        string `toml:"name"`
+	Type        string `toml:"type"`
+	Required    bool   `toml:"required"`
+	Description string `toml:"description,omitempty"`
+}
+
+// SectionSchema - The front matter fields used by a content section
+type SectionSchema struct {
+	Fields []FieldSchema `toml:"fields"`
+}
+
+// SectionSchemas - Every section schema of a site, indexed by section name.
+//
+// Schemas are stored in SITE/.shim/schemas.toml, which looks like:
+//
+//	[[events.fields]]
+//	name = "venue"
+//	type = "string"
+//	required = true
+type SectionSchemas map[string]*SectionSchema
+
+// ValidationErrors - Problems found while validating a post's front matter
+type ValidationErrors []error
+
+func (v ValidationErrors) Error() string {
+	msgs := make([]string, len(v))
+	for i, err := range v {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// shimDir is where shim keeps its own data for a site. Hugo never reads it.
+func (s Site) shimDir() string {
+	return filepath.Join(s.Location, ".shim")
+}
+
+// parseSchemas decodes and checks a schema definition
+func parseSchemas(src string) (SectionSchemas, error) {
+	schemas := make(SectionSchemas)
+	if _, err := toml.Decode(src, &schemas); err != nil {
+		return nil, err
+	}
+
+	for section, schema := range schemas {
+		if schema == nil {
+			delete(schemas, section)
+			continue
+		}
+		for i, f := range schema.Fields {
+			f.Name = strings.ToLower(strings.TrimSpace(f.Name))
+			if len(f.Name) == 0 {
+				return nil, fmt.Errorf("Field #%d of section %s has no name", i+1, section)
+			}
+			if len(f.Type) == 0 {
+				f.Type = fieldString
+			}
+			if !isFieldType(f.Type) {
+				return nil, fmt.Errorf("Field %s of section %s has unknown type %q (use one of: %s)",
+					f.Name, section, f.Type, strings.Join(fieldTypes, ", "))
+			}
+			schema.Fields[i] = f
+		}
+	}
+
+	return schemas, nil
+}
+
+func isFieldType(kind string) bool {
+	for _, t := range fieldTypes {
+		if t == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// loadSchemas reads this site's section schemas from disk. A missing schema
+// file simply means that no section has a schema.
+func (s *Site) loadSchemas() error {
+	s.schemas = make(SectionSchemas)
+
+	src, err := s.SchemaSource()
+	if err != nil || len(src) == 0 {
+		return nil
+	}
+
+	schemas, err := parseSchemas(src)
+	if err != nil {
+		return fmt.Errorf("Could not load section schemas: %s", err.Error())
+	}
+	s.schemas = schemas
+
+	return nil
+}
+
+// SchemaSource - The raw text of this site's schema definitions
+func (s Site) SchemaSource() (string, error) {
+	buf := new(bytes.Buffer)
+	file, err := os.Open(filepath.Join(s.shimDir(), schemaFile))
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	_, err = buf.ReadFrom(file)
+	return buf.String(), err
+}
+
+// SaveSchemas - Check and save a new schema definition for this site
+func (s *Site) SaveSchemas(src string) error {
+	schemas, err := parseSchemas(src)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(s.shimDir(), 0755); err != nil {
+		return err
+	}
+
+	mode := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	file, err := os.OpenFile(filepath.Join(s.shimDir(), schemaFile), mode, 0666)
+	if err != nil {
+		return fmt.Errorf("Could not open schema file: %s", err.Error())
+	}
+	defer file.Close()
+
+	if _, err = file.WriteString(src); err != nil {
+		return err
+	}
+
+	s.schemas = schemas
+	return nil
+}
+
+// Schemas - The front matter schemas of each section in this site
+func (s Site) Schemas() SectionSchemas {
+	return s.schemas
+}
+
+// SchemaSections - The names of all sections which have a schema, sorted.
+func (s Site) SchemaSections() []string {
+	sections := []string{}
+	for name := range s.schemas {
+		sections = append(sections, name)
+	}
+	sort.Strings(sections)
+	return sections
+}
+
+// sectionOf finds the section of a path relative to the content directory.
+// Root-level pages have no section.
+func sectionOf(relPath string) string {
+	relPath = filepath.ToSlash(relPath)
+	if i := strings.Index(relPath, "/"); i > 0 {
+		return relPath[:i]
+	}
+	return ""
+}
+
+// Section - The content section this post belongs to
+func (p Post) Section() string {
+	return sectionOf(p.RelPath)
+}
+
+// Schema - The schema for this post's section, or nil if there is none
+func (p Post) Schema() *SectionSchema {
+	return p.Site.Schemas()[p.Section()]
+}
+
+// convert turns a form value into the appropriate type for this field. Blank
+// values are returned as nil.
+func (f FieldSchema) convert(raw string, loc *time.Location) (interface{}, error) {
+	raw = strings.TrimSpace(raw)
+	if f.Type == fieldBool {
+		return len(raw) > 0 && raw != "false", nil
+	}
+	if len(raw) == 0 {
+		return nil, nil
+	}
+
+	switch f.Type {
+	case fieldInt:
+		v, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be a whole number", f.Name)
+		}
+		return v, nil
+	case fieldFloat:
+		v, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be a number", f.Name)
+		}
+		return v, nil
+	case fieldDate:
+		v, err := parseDate(raw, loc)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be a date like %q", f.Name, time.Now().In(loc).Format(dateFormat))
+		}
+		return v.Format(time.RFC3339), nil
+	case fieldList:
+		values := strings.Split(raw, ",")
+		stripChars(&values, " ")
+		removeDuplicates(&values)
+		return values, nil
+	}
+
+	return raw, nil
+}
+
+// check makes sure a front matter value is present (if required) and has the
+// correct type.
+func (f FieldSchema) check(value interface{}) error {
+	if value == nil || value == "" {
+		if f.Required {
+			return fmt.Errorf("%s is required", f.Name)
+		}
+		return nil
+	}
+
+	ok := true
+	switch f.Type {
+	case fieldString:
+		_, ok = value.(string)
+	case fieldBool:
+		_, ok = value.(bool)
+	case fieldInt:
+		switch value.(type) {
+		case int, int64:
+		default:
+			ok = false
+		}
+	case fieldFloat:
+		switch value.(type) {
+		case int, int64, float64:
+		default:
+			ok = false
+		}
+	case fieldDate:
+		switch v := value.(type) {
+		case time.Time:
+		case string:
+			_, err := parseDate(v, time.UTC)
+			ok = err == nil
+		default:
+			ok = false
+		}
+	case fieldList:
+		switch v := value.(type) {
+		case []string:
+			if f.Required && len(v) == 0 {
+				return fmt.Errorf("%s is required", f.Name)
+			}
+		case []interface{}:
+			if f.Required && len(v) == 0 {
+				return fmt.Errorf("%s is required", f.Name)
+			}
+		default:
+			ok = false
+		}
+	}
+
+	if !ok {
+		return fmt.Errorf("%s must be a %s", f.Name, f.Type)
+	}
+	return nil
+}
+
+// FieldValue - A schema field's value formatted for a web form
+func (p Post) FieldValue(name string) string {
+	value, ok := p.all[strings.ToLower(name)]
+	if !ok || value == nil {
+		return ""
+	}
+
+	switch v := value.(type) {
+	case []string:
+		return strings.Join(v, ", ")
+	case []interface{}:
+		parts := make([]string, len(v))
+		for i, elem := range v {
+			parts[i] = fmt.Sprint(elem)
+		}
+		return strings.Join(parts, ", ")
+	case time.Time:
+		return p.Site.WebTime(v)
+	case string:
+		if t, err := parseDate(v, p.Site.TimeZone()); err == nil {
+			return p.Site.WebTime(t)
+		}
+		return v
+	}
+
+	return fmt.Sprint(value)
+}
+
+// formValues converts the values of schema fields in a submitted form. Each
+// value is found under the form key `prefix + field name`, and blank values
+// are nil, and dates are in the time zone `loc`. Values which can't be
+// converted are left out and reported.
+func (sch *SectionSchema) formValues(form url.Values, prefix string, loc *time.Location) (map[string]interface{}, ValidationErrors) {
+	values := make(map[string]interface{})
+
+	var errs ValidationErrors
+	for _, f := range sch.Fields {
+		value, err := f.convert(form.Get(prefix+f.Name), loc)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		values[f.Name] = value
+	}
+
+	return values, errs
+}
+
+// setFields copies converted schema values into this post's front matter.
+func (p *Post) setFields(values map[string]interface{}) {
+	if p.all == nil {
+		p.all = make(map[string]interface{})
+	}
+
+	for name, value := range values {
+		if value == nil {
+			delete(p.all, name)
+		} else {
+			p.all[name] = value
+		}
+	}
+}
+
+// applySchemaFields copies the values of schema fields from a submitted form
+// into this post's front matter. See also: SectionSchema.formValues
+func (p *Post) applySchemaFields(form url.Values, prefix string) ValidationErrors {
+	schema := p.Schema()
+	if schema == nil {
+		return nil
+	}
+
+	values, errs := schema.formValues(form, prefix, p.Site.TimeZone())
+	p.setFields(values)
+	return errs
+}
+
+// Validate - Check this post's date, and its front matter against its
+// section's schema
+func (p Post) Validate() ValidationErrors {
+	var errs ValidationErrors
+	if p.dateErr != nil {
+		errs = append(errs, p.dateErr)
+	}
+
+	schema := p.Schema()
+	if schema == nil {
+		return errs
+	}
+
+	for _, f := range schema.Fields {
+		if err := f.check(p.all[f.Name]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errs
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseSchemas(t *testing.T) {
+	inputs := []string{
+		"[[events.fields]]\nname = \" Venue \"\nrequired = true\n\n[[events.fields]]\nname = \"seats\"\ntype = \"int\"\n",
+		"[[events.fields]]\ntype = \"int\"\n",
+		"[[events.fields]]\nname = \"venue\"\ntype = \"place\"\n",
+		"[[events.fields]\n",
+	}
+
+	// The fields of the events section, or nil if the schema is refused
+	outputs := [][]FieldSchema{
+		{{Name: "venue", Type: fieldString, Required: true}, {Name: "seats", Type: fieldInt}},
+		nil,
+		nil,
+		nil,
+	}
+
+	for i, input := range inputs {
+		schemas, err := parseSchemas(input)
+		if outputs[i] == nil {
+			if err == nil {
+				t.Errorf("|%s| should have been refused\n", input)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("Could not parse |%s|: %s\n", input, err.Error())
+		} else if !reflect.DeepEqual(schemas["events"].Fields, outputs[i]) {
+			t.Errorf("|%s| was supposed to parse to %v, not %v\n", input, outputs[i], schemas["events"].Fields)
+		}
+	}
+}
+
+func TestFieldConvert(t *testing.T) {
+	inputs := []struct {
+		kind, raw string
+	}{
+		{fieldString, " hello "},
+		{fieldString, "  "},
+		{fieldBool, "on"},
+		{fieldBool, "false"},
+		{fieldBool, ""},
+		{fieldInt, "42"},
+		{fieldInt, "4.2"},
+		{fieldFloat, "4.2"},
+		{fieldFloat, "many"},
+		{fieldDate, "2016-05-01T10:00:00Z"},
+		{fieldDate, "someday"},
+		{fieldList, "a, b, a"},
+	}
+
+	outputs := []interface{}{
+		"hello",
+		nil,
+		true,
+		false,
+		false,
+		int64(42),
+		nil,
+		4.2,
+		nil,
+		"2016-05-01T10:00:00Z",
+		nil,
+		[]string{"a", "b"},
+	}
+
+	refused := []bool{false, false, false, false, false, false, true, false, true, false, true, false}
+
+	for i, input := range inputs {
+		f := FieldSchema{Name: "field", Type: input.kind}
+		value, err := f.convert(input.raw, time.UTC)
+		if refused[i] {
+			if err == nil {
+				t.Errorf("%s |%s| should have been refused, not converted to %v\n", input.kind, input.raw, value)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("Could not convert %s |%s|: %s\n", input.kind, input.raw, err.Error())
+		} else if !reflect.DeepEqual(value, outputs[i]) {
+			t.Errorf("%s |%s| was supposed to convert to %#v, not %#v\n", input.kind, input.raw, outputs[i], value)
+		}
+	}
+}
+
+func TestFieldCheck(t *testing.T) {
+	inputs := []struct {
+		field FieldSchema
+		value interface{}
+	}{
+		{FieldSchema{Name: "a", Type: fieldString}, nil},
+		{FieldSchema{Name: "a", Type: fieldString, Required: true}, nil},
+		{FieldSchema{Name: "a", Type: fieldString, Required: true}, ""},
+		{FieldSchema{Name: "a", Type: fieldString}, 5},
+		{FieldSchema{Name: "a", Type: fieldInt}, int64(5)},
+		{FieldSchema{Name: "a", Type: fieldInt}, 5.5},
+		{FieldSchema{Name: "a", Type: fieldFloat}, int64(5)},
+		{FieldSchema{Name: "a", Type: fieldDate}, "2016-05-01"},
+		{FieldSchema{Name: "a", Type: fieldDate}, "someday"},
+		{FieldSchema{Name: "a", Type: fieldList}, []interface{}{"x"}},
+		{FieldSchema{Name: "a", Type: fieldList, Required: true}, []string{}},
+		{FieldSchema{Name: "a", Type: fieldList}, "x"},
+	}
+
+	valid := []bool{true, false, false, false, true, false, true, true, false, true, false, false}
+
+	for i, input := range inputs {
+		err := input.field.check(input.value)
+		if (err == nil) != valid[i] {
+			t.Errorf("Checking %#v against %v should be valid: %t, but got %v\n",
+				input.value, input.field, valid[i], err)
+		}
+	}
+}
+
+func TestPostValidate(t *testing.T) {
+	s := &Site{schemas: SectionSchemas{"events": &SectionSchema{Fields: []FieldSchema{
+		{Name: "venue", Type: fieldString, Required: true},
+		{Name: "seats", Type: fieldInt},
+	}}}}
+
+	inputs := []*Post{
+		{RelPath: "events/a.md", all: map[string]interface{}{"venue": "Hall", "seats": int64(20)}},
+		{RelPath: "events/b.md", all: map[string]interface{}{"seats": "many"}},
+		{RelPath: "post/c.md", all: map[string]interface{}{}},
+		{RelPath: "post/d.md", all: map[string]interface{}{}, dateErr: fmt.Errorf("bad date")},
+	}
+
+	problems := []int{0, 2, 0, 1}
+
+	for i, p := range inputs {
+		p.Site = s
+		if errs := p.Validate(); len(errs) != problems[i] {
+			t.Errorf("%s was supposed to have %d problems, not %v\n", p.RelPath, problems[i], errs)
+		}
+	}
+}
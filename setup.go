@@ -25,6 +25,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"strings"
 )
 
@@ -87,16 +88,15 @@ func firstRun() bool {
 
 // findPrimarySite Finds the first site that is enabled, and returns it's name
 // as a string `name`. If there are no sites available, returns an error `err`.
-func findSites() (names []string, err error) {
+func findSites(config *viper.Viper) (names []string, err error) {
 	names = []string{}
 	err = nil
-	// sites := viper.GetStringMapSlice("sites")
-	sites := viper.GetStringMapStringSlice("sites")
+	// sites := config.GetStringMapSlice("sites")
+	sites := config.GetStringMapStringSlice("sites")
 	for name := range sites {
 		enabledKey := fmt.Sprintf("sites.%s.enabled", name)
-		viper.SetDefault(enabledKey, false)
 
-		if viper.GetBool(enabledKey) {
+		if config.GetBool(enabledKey) {
 			names = append(names, name)
 		} else {
 		}
@@ -120,70 +120,237 @@ func setupSites(names []string) {
 
 // Set up the site with the name `name` in the sites directory.
 func setupSite(name string) {
-	here, err := os.Getwd()
-	checkReason(err, "Couldn't get current directory")
+	checkReason(createSite(name), "Error: couldn't create site "+name)
+}
 
-	sitesLoc := filepath.Join(here, viper.GetString("sitesDir"))
+// sitesDir is the folder new sites are kept in
+func sitesDir() string {
+	a := shimAssets()
+	if filepath.IsAbs(a.sites) {
+		return filepath.Clean(a.sites)
+	}
+	return filepath.Join(a.root, a.sites)
+}
 
-	// If sites folder doesn't exist, make it!
-	if _, err := os.Stat(sitesLoc); os.IsNotExist(err) {
-		err = os.MkdirAll(sitesLoc, 0755)
-		checkReason(err, "Could not create sites directory.")
+// siteDir is the folder the site `name` is in. A site's `dir` may be an
+// absolute path or relative to the sites folder, and is its name if unset.
+func siteDir(name string) string {
+	dir := shimConfig().GetString(fmt.Sprintf("sites.%s.dir", name))
+	if len(dir) == 0 {
+		dir = name
+	}
+	if filepath.IsAbs(dir) {
+		return filepath.Clean(dir)
+	}
+	return filepath.Join(sitesDir(), dir)
+}
+
+// isInSitesDir tells whether `dir` is inside the sites folder
+func isInSitesDir(dir string) bool {
+	rel, err := filepath.Rel(sitesDir(), dir)
+	return err == nil && rel != "." && rel != ".." &&
+		!strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// createSite runs `hugo new site` for the site `name`, unless its folder
+// already exists.
+func createSite(name string) error {
+	siteLoc := siteDir(name)
+	sitesLoc := filepath.Dir(siteLoc)
+
+	// If the folder the site goes in doesn't exist, make it!
+	if err := os.MkdirAll(sitesLoc, 0755); err != nil {
+		return fmt.Errorf("Could not create sites directory: %s", err.Error())
 	}
 
 	// check if site already exists
-	testLoc := filepath.Join(here, "sites", name)
-	if _, dirError := os.Stat(testLoc); !os.IsNotExist(dirError) {
+	if _, dirError := os.Stat(siteLoc); !os.IsNotExist(dirError) {
 		// site already exists; let's get out
-		return
+		return nil
 	}
 
 	// create hugo site
-	hugoPath, err := exec.LookPath("hugo")
-	checkReason(err, "Couldn't find hugo. Make sure it's in your PATH")
+	hugo, err := hugoPath(name)
+	if err != nil {
+		return err
+	}
 
-	cmd := exec.Command(hugoPath, "new", "site", filepath.Join(sitesLoc, name))
+	cmd := exec.Command(hugo, "new", "site", siteLoc)
 	cmd.Dir = sitesLoc
 	log.Printf("Creating new site in %s\n", cmd.Dir)
-	err = cmd.Run()
-	checkReason(err, "Error: couldn't create site "+name)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("hugo couldn't create the site: %s %s", err.Error(), output)
+	}
+	return nil
+}
+
+var regexSiteName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// checkSiteName makes sure `name` can be used as a new site's short name
+func checkSiteName(name string) error {
+	if err := checkNewSiteName(name); err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(sitesDir(), name)); !os.IsNotExist(err) {
+		return fmt.Errorf("The sites folder already has a folder named %s.", name)
+	}
+	return nil
+}
+
+// checkNewSiteName makes sure no site uses `name` yet
+func checkNewSiteName(name string) error {
+	if !regexSiteName.MatchString(name) || name == "all" {
+		return fmt.Errorf("Site names may only contain lowercase letters, numbers, " +
+			"dashes and underscores, and can't be \"all\".")
+	}
+	if siteNamed(name) != nil || shimConfig().IsSet("sites."+name) {
+		return fmt.Errorf("There is already a site named %s.", name)
+	}
+	return nil
+}
+
+// registerSite adds an enabled site in the folder `dir` to shim's
+// configuration. The new table is appended so that the rest of the file (and
+// its comments) stay the same.
+func registerSite(name, dir string) error {
+	table := fmt.Sprintf("\n[sites.%s]\n    dir = %q\n    enabled = true\n", name, dir)
+
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	file, err := os.OpenFile(shimConfig().ConfigFileUsed(), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("Could not open shim's configuration: %s", err.Error())
+	}
+	defer file.Close()
+
+	if _, err = file.WriteString(table); err != nil {
+		return fmt.Errorf("Could not add the site to shim's configuration: %s", err.Error())
+	}
+	return rereadConfig()
+}
+
+// newSite - Create a new Hugo site, add it to shim's configuration and start
+// serving it.
+func newSite(name, title, baseURL, theme string) (*Site, error) {
+	name = strings.TrimSpace(name)
+	if err := checkSiteName(name); err != nil {
+		return nil, err
+	}
+
+	if err := createSite(name); err != nil {
+		return nil, err
+	}
+
+	s, err := loadSite(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if title = strings.TrimSpace(title); len(title) > 0 {
+		s.Title = title
+	}
+	if baseURL = strings.TrimSpace(baseURL); len(baseURL) > 0 {
+		s.BaseURL = baseURL
+	}
+	if len(theme) > 0 {
+		if err = ChangeTheme(s, theme); err != nil {
+			return nil, fmt.Errorf("Could not use theme %s: %s", theme, err.Error())
+		}
+		s.Theme = theme
+	}
+
+	if err = s.SaveConfig(); err != nil {
+		return nil, err
+	}
+	if err = registerSite(name, name); err != nil {
+		return nil, err
+	}
+
+	addSite(s)
+	return s, nil
+}
+
+// addExistingSite - Start managing a Hugo site which is already on disk, in
+// the folder `dir` (an absolute path, or relative to the sites folder). The
+// site stays where it is.
+func addExistingSite(name, dir string) (*Site, error) {
+	name = strings.TrimSpace(name)
+	if err := checkNewSiteName(name); err != nil {
+		return nil, err
+	}
+
+	dir = strings.TrimSpace(dir)
+	if len(dir) == 0 {
+		return nil, fmt.Errorf("Please give the folder the site is in.")
+	}
+	loc := dir
+	if !filepath.IsAbs(loc) {
+		loc = filepath.Join(sitesDir(), loc)
+	}
+
+	if info, err := os.Stat(loc); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("%s isn't a folder.", loc)
+	}
+	if _, err := loadSiteConfig(loc); err != nil {
+		return nil, fmt.Errorf("%s doesn't look like a Hugo site: %s", loc, err.Error())
+	}
+	for _, s := range siteList() {
+		if s.Location == filepath.Clean(loc) {
+			return nil, fmt.Errorf("%s is already managed by shim as %s.", loc, s.ShortName)
+		}
+	}
+
+	if err := registerSite(name, dir); err != nil {
+		return nil, err
+	}
+	s, err := loadSite(name)
+	if err != nil {
+		unregisterSite(name)
+		return nil, err
+	}
+
+	addSite(s)
+	return s, nil
 }
 
 func loadAllSites(names []string) []*Site {
 	sites := []*Site{}
 
 	for _, name := range names {
-		if s, err := loadSite(name); err == nil {
-			sites = append(sites, s)
+		s, err := loadSite(name)
+		if err != nil {
+			log.Printf("Skipping site %s: %s\n", name, err.Error())
+			continue
 		}
+		sites = append(sites, s)
 	}
 
 	return sites
 }
 
-func assignAssets() {
-	shimAssets = new(assets)
+// loadAssets works out where shim's files are from its configuration
+func loadAssets(config *viper.Viper) (*assets, error) {
+	a := new(assets)
 
 	root, err := os.Getwd()
-	checkReason(err, "Couldn't find current working directory.")
-
-	viper.SetDefault("sitesDir", "sites")
-	viper.SetDefault("templatesDir", "templates")
-	viper.SetDefault("staticDir", "static")
-	viper.SetDefault("themeDir", "themes")
-	viper.SetDefault("baseurl", "http://127.0.0.1:8080")
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't find current working directory.")
+	}
 
-	shimAssets.root = root
-	shimAssets.sites = viper.GetString("sitesDir")
-	shimAssets.templates = viper.GetString("templatesDir")
-	shimAssets.static = viper.GetString("staticDir")
-	shimAssets.themes = viper.GetString("themeDir")
+	a.root = root
+	a.sites = config.GetString("sitesDir")
+	a.templates = config.GetString("templatesDir")
+	a.static = config.GetString("staticDir")
+	a.themes = config.GetString("themeDir")
 
-	baseurl := strings.TrimRight(viper.GetString("baseurl"), "/")
+	baseurl := strings.TrimRight(config.GetString("baseurl"), "/")
 	url, err := url.Parse(baseurl)
 	if err != nil {
-		log.Fatal("Invalid URL for \"baseurl\"!")
+		return nil, fmt.Errorf("Invalid URL for \"baseurl\"!")
 	}
-	shimAssets.baseurl = strings.TrimRight(url.String(), "/")
-	shimAssets.basepath = url.Path
+	a.baseurl = strings.TrimRight(url.String(), "/")
+	a.basepath = url.Path
+
+	return a, nil
 }
@@ -0,0 +1,210 @@
+// SHIM - A web front end for the Hugo site generator
+// Copyright (C) 2016        Cameron Conn
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Where a shortcode comes from
+const (
+	shortcodeBuiltin = "hugo"
+	shortcodeTheme   = "theme"
+	shortcodeSite    = "site"
+)
+
+// Shortcode - A Hugo shortcode which can be inserted into posts
+type Shortcode struct {
+	Name       string
+	Source     string   // hugo, theme, or site
+	Params     []string // named parameters
+	Positional int      // number of positional parameters
+	Inner      bool     // whether the shortcode wraps content
+}
+
+// Hugo's built-in shortcodes
+var builtinShortcodes = []*Shortcode{
+	{Name: "figure", Params: []string{"src", "link", "target", "rel", "alt", "title", "caption", "attr", "attrlink", "class", "width", "height"}},
+	{Name: "gist", Positional: 2},
+	{Name: "highlight", Positional: 2, Inner: true},
+	{Name: "instagram", Positional: 1},
+	{Name: "param", Positional: 1},
+	{Name: "ref", Positional: 1},
+	{Name: "relref", Positional: 1},
+	{Name: "tweet", Params: []string{"user", "id"}},
+	{Name: "vimeo", Positional: 1},
+	{Name: "youtube", Params: []string{"id", "autoplay", "title", "class"}},
+}
+
+var regexShortcodeNamedGet = regexp.MustCompile(`\.Get\s+"([^"]+)"`)
+var regexShortcodePositionalGet = regexp.MustCompile(`\.Get\s+(\d+)`)
+var regexShortcodeInner = regexp.MustCompile(`\.Inner\b`)
+
+// parseShortcode infers the parameters of a shortcode from its template
+func parseShortcode(name, source, src string) *Shortcode {
+	sc := &Shortcode{Name: name, Source: source}
+
+	for _, m := range regexShortcodeNamedGet.FindAllStringSubmatch(src, -1) {
+		sc.Params = append(sc.Params, m[1])
+	}
+	removeDuplicates(&sc.Params)
+
+	for _, m := range regexShortcodePositionalGet.FindAllStringSubmatch(src, -1) {
+		if i, err := strconv.Atoi(m[1]); err == nil && i+1 > sc.Positional {
+			sc.Positional = i + 1
+		}
+	}
+
+	sc.Inner = regexShortcodeInner.MatchString(src)
+	return sc
+}
+
+// readShortcodes reads all shortcode templates in a `layouts/shortcodes`
+// folder.
+func readShortcodes(dir, source string) []*Shortcode {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+
+	shortcodes := []*Shortcode{}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".html") {
+			continue
+		}
+
+		src, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			continue
+		}
+
+		// Output-format specific templates like `name.amp.html` share a name
+		name := strings.SplitN(f.Name(), ".", 2)[0]
+		shortcodes = append(shortcodes, parseShortcode(name, source, string(src)))
+	}
+
+	return shortcodes
+}
+
+// Shortcodes - All shortcodes this site can use. Shortcodes from the site
+// replace those of its theme, which replace Hugo's built-in shortcodes.
+func (s *Site) Shortcodes() []*Shortcode {
+	byName := make(map[string]*Shortcode)
+
+	for _, sc := range builtinShortcodes {
+		copied := *sc
+		copied.Source = shortcodeBuiltin
+		byName[sc.Name] = &copied
+	}
+
+	themeDir := filepath.Join(s.Location, "themes", s.Theme, "layouts", "shortcodes")
+	for _, sc := range readShortcodes(themeDir, shortcodeTheme) {
+		byName[sc.Name] = sc
+	}
+
+	siteDir := filepath.Join(s.Location, s.LayoutDir(), "shortcodes")
+	for _, sc := range readShortcodes(siteDir, shortcodeSite) {
+		byName[sc.Name] = sc
+	}
+
+	shortcodes := make([]*Shortcode, 0, len(byName))
+	for _, sc := range byName {
+		shortcodes = append(shortcodes, sc)
+	}
+	sort.Slice(shortcodes, func(i, j int) bool { return shortcodes[i].Name < shortcodes[j].Name })
+
+	return shortcodes
+}
+
+// Shortcode - Find one of this site's shortcodes by name
+func (s *Site) Shortcode(name string) (*Shortcode, error) {
+	for _, sc := range s.Shortcodes() {
+		if sc.Name == name {
+			return sc, nil
+		}
+	}
+	return nil, fmt.Errorf("There is no shortcode named %s", name)
+}
+
+// HasParam - Whether this shortcode takes a named parameter
+func (sc Shortcode) HasParam(name string) bool {
+	for _, param := range sc.Params {
+		if param == name {
+			return true
+		}
+	}
+	return false
+}
+
+// PositionalParams - The positions of this shortcode's positional parameters,
+// for use in templates.
+func (sc Shortcode) PositionalParams() []int {
+	positions := make([]int, sc.Positional)
+	for i := range positions {
+		positions[i] = i
+	}
+	return positions
+}
+
+// quoteShortcodeParam quotes a parameter value unless it doesn't need it
+func quoteShortcodeParam(value string) string {
+	if len(value) > 0 && !strings.ContainsAny(value, " \t\"'=<>{}") {
+		return value
+	}
+	return strconv.Quote(value)
+}
+
+// Call - A call to this shortcode with the given parameters. `named` is keyed
+// by parameter name, and `positional` holds the positional parameters in
+// order. Blank parameters are left out.
+func (sc Shortcode) Call(named map[string]string, positional []string, inner string) string {
+	var b strings.Builder
+	b.WriteString("{{< " + sc.Name)
+
+	for i, value := range positional {
+		if len(value) == 0 {
+			// Later positions can't be given without this one
+			positional = positional[:i]
+			break
+		}
+	}
+	for _, value := range positional {
+		b.WriteString(" " + quoteShortcodeParam(value))
+	}
+
+	// Named and positional parameters can't be mixed in a call
+	if len(positional) == 0 {
+		for _, name := range sc.Params {
+			if value := named[name]; len(value) > 0 {
+				fmt.Fprintf(&b, " %s=%s", name, strconv.Quote(value))
+			}
+		}
+	}
+	b.WriteString(" >}}")
+
+	if sc.Inner {
+		b.WriteString(inner + "{{< /" + sc.Name + " >}}")
+	}
+
+	return b.String()
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseShortcode(t *testing.T) {
+	src := `<div class="{{ .Get "class" }}">{{ .Get 1 }} {{ with .Get "class" }}{{ . }}{{ end }}{{ .Inner }}</div>`
+	sc := parseShortcode("box", shortcodeSite, src)
+
+	if len(sc.Params) != 1 || sc.Params[0] != "class" {
+		t.Errorf("Expected the named parameter `class`, got %v\n", sc.Params)
+	}
+	if sc.Positional != 2 {
+		t.Errorf("Expected 2 positional parameters, got %d\n", sc.Positional)
+	}
+	if !sc.Inner {
+		t.Error("Expected the shortcode to wrap content")
+	}
+}
+
+func TestShortcodeCall(t *testing.T) {
+	figure := Shortcode{Name: "figure", Params: []string{"src", "title"}}
+	highlight := Shortcode{Name: "highlight", Positional: 2, Inner: true}
+
+	calls := []string{
+		figure.Call(map[string]string{"src": "files/a.png", "title": "A \"cat\""}, nil, ""),
+		figure.Call(map[string]string{"title": ""}, nil, ""),
+		highlight.Call(nil, []string{"go", ""}, "x := 1"),
+		highlight.Call(nil, []string{"", "linenos=table"}, ""),
+	}
+
+	outputs := []string{
+		`{{< figure src="files/a.png" title="A \"cat\"" >}}`,
+		`{{< figure >}}`,
+		`{{< highlight go >}}x := 1{{< /highlight >}}`,
+		`{{< highlight >}}{{< /highlight >}}`,
+	}
+
+	for i, call := range calls {
+		if call != outputs[i] {
+			t.Errorf("Expected |%s|, got |%s|\n", outputs[i], call)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+// SHIM - A web front end for the Hugo site generator
+// Copyright (C) 2016        Cameron Conn
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ConfigError - A problem with a site's configuration, and where it is
+type ConfigError struct {
+	Line    int // 0 when the problem isn't on a single line
+	Col     int
+	Message string
+}
+
+func (e ConfigError) Error() string {
+	switch {
+	case e.Line > 0 && e.Col > 0:
+		return fmt.Sprintf("Line %d, column %d: %s", e.Line, e.Col, e.Message)
+	case e.Line > 0:
+		return fmt.Sprintf("Line %d: %s", e.Line, e.Message)
+	}
+	return e.Message
+}
+
+// Kinds of values in a site's configuration
+const (
+	configText  = "text"
+	configBool  = "true or false"
+	configTable = "table"
+)
+
+// The settings shim reads from a site's configuration, and the kind of value
+// each one needs to be
+var siteConfigKinds = map[string]string{
+	"title":       configText,
+	"baseurl":     configText,
+	"theme":       configText,
+	"contentdir":  configText,
+	"layoutdir":   configText,
+	"publishdir":  configText,
+	"timezone":    configText,
+	"builddrafts": configBool,
+	"params":      configTable,
+	"taxonomies":  configTable,
+	"permalinks":  configTable,
+}
+
+var regexYAMLLine = regexp.MustCompile(`^yaml: line ([0-9]+): (.*)$`)
+
+// configKeyLine finds the line (starting at 1) where a top level setting is
+// set, or 0 if it can't be found.
+func configKeyLine(src, format, key string) int {
+	quoted := `["']?` + regexp.QuoteMeta(key) + `["']?`
+	setting := regexp.MustCompile(`(?i)^(\s*)` + quoted + `\s*[=:]`)
+	table := regexp.MustCompile(`(?i)^\s*\[\s*` + quoted + `\s*[\].]`)
+
+	inTable := false
+	for i, line := range strings.Split(src, "\n") {
+		switch format {
+		case configTOML:
+			if table.MatchString(line) {
+				return i + 1
+			}
+			if regexTOMLTable.MatchString(line) {
+				inTable = true
+				continue
+			}
+		case configYAML:
+			// Settings in tables are indented
+			if m := setting.FindStringSubmatch(line); m != nil && len(m[1]) > 0 {
+				continue
+			}
+		}
+
+		if !inTable && setting.MatchString(line) {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// configParseError finds where the problem is in a configuration file which
+// couldn't be read
+func configParseError(src string, err error) ConfigError {
+	switch e := err.(type) {
+	case toml.ParseError:
+		return ConfigError{Line: e.Position.Line, Col: e.Position.Col, Message: e.Message}
+	case *json.SyntaxError:
+		offset := int(e.Offset)
+		if offset > len(src) {
+			offset = len(src)
+		}
+		before := src[:offset]
+		line := strings.Count(before, "\n") + 1
+		col := len(before) - strings.LastIndex(before, "\n")
+		return ConfigError{Line: line, Col: col, Message: e.Error()}
+	}
+
+	if m := regexYAMLLine.FindStringSubmatch(err.Error()); m != nil {
+		line, _ := strconv.Atoi(m[1])
+		return ConfigError{Line: line, Message: m[2]}
+	}
+	return ConfigError{Message: err.Error()}
+}
+
+// checkConfigValue makes sure a setting is the kind of value it needs to be
+func checkConfigValue(key, kind string, value interface{}) string {
+	ok := true
+	switch kind {
+	case configText:
+		_, ok = value.(string)
+	case configBool:
+		_, ok = value.(bool)
+	case configTable:
+		_, ok = value.(map[string]interface{})
+	}
+	if !ok {
+		return fmt.Sprintf("%s needs to be %s", key, map[string]string{
+			configText:  "text in quotes",
+			configBool:  "true or false",
+			configTable: "a table",
+		}[kind])
+	}
+
+	switch key {
+	case "timezone":
+		if _, err := loadTimeZone(value.(string)); err != nil {
+			return err.Error()
+		}
+	case "taxonomies":
+		for singular, plural := range value.(map[string]interface{}) {
+			if _, ok := plural.(string); !ok {
+				return fmt.Sprintf("The plural of the %s taxonomy needs to be text in quotes", singular)
+			}
+		}
+	}
+	return ""
+}
+
+// checkContentDir makes sure the site at `location` has the content folder
+// `dir`, since posts are read from it as soon as the site is reloaded
+func checkContentDir(location, dir string) string {
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(location, dir)
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return fmt.Sprintf("contentDir needs to be a folder of the site, but %s isn't one", dir)
+	}
+	return ""
+}
+
+// validateSiteConfig checks the source of one of the configuration files of the
+// site at `location` before it's saved. Settings are only checked in files of
+// top level settings, which have no `prefix`. Every problem found is returned,
+// in the order they appear.
+func validateSiteConfig(src, format string, prefix []string, location string) []ConfigError {
+	settings, err := parseConfig([]byte(src), format)
+	if err != nil {
+		return []ConfigError{configParseError(src, err)}
+	}
+	if len(prefix) > 0 {
+		return nil
+	}
+
+	problems := []ConfigError{}
+	for key, value := range settings {
+		kind, ok := siteConfigKinds[strings.ToLower(key)]
+		if !ok {
+			continue
+		}
+		msg := checkConfigValue(strings.ToLower(key), kind, value)
+		if len(msg) == 0 && strings.ToLower(key) == "contentdir" {
+			msg = checkContentDir(location, value.(string))
+		}
+		if len(msg) > 0 {
+			problems = append(problems, ConfigError{Line: configKeyLine(src, format, key), Message: msg})
+		}
+	}
+
+	sort.SliceStable(problems, func(i, j int) bool { return problems[i].Line < problems[j].Line })
+	return problems
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestValidateSiteConfig(t *testing.T) {
+	inputs := []string{
+		"title = \"My Blog\"\nbaseurl = \"http://example.com/\"\n[params]\n  author = \"Me\"\n",
+		"title = \"My Blog\"\nbaseurl = \n",
+		"title = \"My Blog\"\n[params]\n[params]\n",
+		"title = 5\n\n[params]\n  title = 5\n",
+		"baseurl = \"http://example.com/\"\nbuildDrafts = \"yes\"\n",
+		"params = \"none\"\n",
+		"contentDir = \".\"\n",
+		"title = \"My Blog\"\ncontentDir = \"missing\"\n",
+	}
+
+	outputs := [][]ConfigError{
+		nil,
+		{{Line: 2, Col: 11}},
+		{{Line: 3}},
+		{{Line: 1}},
+		{{Line: 2}},
+		{{Line: 1}},
+		nil,
+		{{Line: 2}},
+	}
+
+	for i, input := range inputs {
+		problems := validateSiteConfig(input, configTOML, nil, ".")
+		if len(problems) != len(outputs[i]) {
+			t.Errorf("Config %d was supposed to have %d problems, not %v\n", i, len(outputs[i]), problems)
+			continue
+		}
+
+		for j, problem := range problems {
+			want := outputs[i][j]
+			if problem.Line != want.Line || (want.Col > 0 && problem.Col != want.Col) {
+				t.Errorf("Config %d was supposed to have a problem at %d:%d, not %s\n",
+					i, want.Line, want.Col, problem.Error())
+			}
+		}
+	}
+}
@@ -17,10 +17,10 @@
 package main
 
 import (
+	"bytes"
 	"container/list"
 	"errors"
 	"fmt"
-	"github.com/BurntSushi/toml"
 	"github.com/spf13/viper"
 	"log"
 	"os"
@@ -28,8 +28,24 @@ import (
 	"path/filepath"
 	"sort"
 	"sync"
+	"time"
 )
 
+// What a site's settings are when its configuration doesn't have them. They
+// aren't written to the configuration until they're changed.
+const (
+	defaultBaseURL  = "http://myblog.example.com/"
+	defaultTitle    = "My Hugo+Shim Site"
+	defaultTheme    = "slim"
+	defaultAuthor   = "John Doe"
+	defaultSubtitle = "My Shim Blog"
+)
+
+var defaultTaxonomies = map[string]interface{}{
+	"tag":      "tags",
+	"category": "categories",
+}
+
 // SitePosts - An array of pointers to all of this site's posts
 type SitePosts []*Post
 
@@ -55,11 +71,31 @@ type Site struct {
 	// Don't prefer to modify this map directly! Instead, prefer to modify the fields
 	// of this Site struct, as they *overwrite* this hashmap!
 	allSettings map[string]interface{}
+	config      *siteConfig // the files allSettings came from
 	taxonomies  TaxonomyKinds
+	schemas     SectionSchemas
+	timeZone    *time.Location
 
 	buildLock struct {
-		lock *sync.Mutex
+		lock    *sync.Mutex
+		pending *sync.WaitGroup // work started by inBackground
 	}
+	builds *buildHistory
+}
+
+// BuildStatus - How a build of a site went
+type BuildStatus struct {
+	Preview  bool // false for public builds
+	Started  time.Time
+	Duration time.Duration
+	Err      error
+	Output   string // what hugo printed
+}
+
+// buildHistory keeps the last build of a site. Copies of a Site share it.
+type buildHistory struct {
+	sync.Mutex
+	last *BuildStatus
 }
 
 func (s *Site) String() string {
@@ -80,26 +116,70 @@ func (s SitePosts) Less(i, j int) bool {
 		return false
 	}
 
-	timeA := postA.Date().Add(0)
-	timeB := postB.Date().Add(0)
-	return !timeA.Before(timeB)
+	// Posts without a date come first too, so they're noticed
+	timeA, timeB := postA.Date(), postB.Date()
+	if timeA == nil || timeB == nil {
+		return timeA == nil && timeB != nil
+	}
+	return !timeA.Before(*timeB)
 }
 
-// Reload - Reload this site from configuration
-func (s Site) Reload() error {
-	err := s.loadConfig(s.ShortName)
+// Reload - Reload this site from configuration. The site is loaded anew and
+// served in place of this one, which is left as it was for requests which
+// are still using it. A bad configuration leaves the site as it was.
+func (s *Site) Reload() (*Site, error) {
+	fresh := &Site{buildLock: s.buildLock, builds: s.builds}
+	err := fresh.loadConfig(s.ShortName)
 
 	if err != nil {
-		return fmt.Errorf("Could not reload site; error: %s", err.Error())
+		return nil, fmt.Errorf("Could not reload site; error: %s", err.Error())
 	}
 
-	return nil
+	replaceSite(s, fresh)
+	return fresh, nil
+}
+
+// siteList - Every site shim is serving. Sites can be added while shim runs,
+// so read them through here instead of using allSites directly.
+func siteList() []*Site {
+	sitesMu.RLock()
+	defer sitesMu.RUnlock()
+	return allSites
+}
+
+// addSite starts serving a site
+func addSite(s *Site) {
+	sitesMu.Lock()
+	defer sitesMu.Unlock()
+
+	// Copy so that lists handed out by siteList never change
+	sites := make([]*Site, len(allSites), len(allSites)+1)
+	copy(sites, allSites)
+	allSites = append(sites, s)
+}
+
+// replaceSite serves `fresh` in place of the site `old`, if it's being served
+func replaceSite(old, fresh *Site) {
+	sitesMu.Lock()
+	defer sitesMu.Unlock()
+
+	// Copy so that lists handed out by siteList never change
+	sites := make([]*Site, len(allSites))
+	for i, s := range allSites {
+		if s == old {
+			s = fresh
+		}
+		sites[i] = s
+	}
+	allSites = sites
 }
 
 func loadSite(name string) (*Site, error) {
 	s := Site{}
 	err := (&s).loadConfig(name)
 	s.buildLock.lock = &sync.Mutex{}
+	s.buildLock.pending = &sync.WaitGroup{}
+	s.builds = &buildHistory{}
 
 	if err != nil {
 		return nil, fmt.Errorf("could not load site; error: %s", err.Error())
@@ -109,56 +189,63 @@ func loadSite(name string) (*Site, error) {
 }
 
 func (s *Site) loadConfig(name string) error {
-	// This is (SHIM_ROOT/sites/sitename)
-	s.Location = filepath.Join(shimAssets.root, shimAssets.sites, name)
+	// This is (SHIM_ROOT/sites/sitename), unless the site's `dir` says otherwise
+	s.Location = siteDir(name)
 	s.ShortName = name
 
-	confLoc := fmt.Sprintf("%s/config.toml", s.Location)
-	fmt.Printf("Opening config at %s\n", confLoc)
-	file, err := os.Open(confLoc)
-	defer file.Close()
-
+	fmt.Printf("Opening config in %s\n", s.Location)
+	config, err := loadSiteConfig(s.Location)
 	if err != nil {
 		return fmt.Errorf("Could not load site configuration because: %s", err.Error())
 	}
+	s.config = config
+
+	// Files may be YAML or JSON too, so viper reads the merged settings
+	merged, err := encodeConfig(config.Merged, configTOML)
+	if err != nil {
+		return fmt.Errorf("Could not merge site configuration: %s", err.Error())
+	}
 
 	v := viper.New()
 	v.SetConfigType("toml")
-	err = v.ReadConfig(file)
-	checkReason(err, "Can't read config")
+	err = v.ReadConfig(bytes.NewReader(merged))
+	if err != nil {
+		return fmt.Errorf("Could not read site configuration: %s", err.Error())
+	}
 
 	v.SetDefault("contentdir", "content")
 	v.SetDefault("layoutdir", "layouts")
 	v.SetDefault("publishdir", "public")
 	v.SetDefault("builddrafts", false)
-	v.SetDefault("BaseURL", "http://myblog.example.com/")
-	v.SetDefault("Canonify", false)
-	v.SetDefault("title", "My Hugo+Shim Site")
-	v.SetDefault("theme", "slim")
+	v.SetDefault("baseurl", defaultBaseURL)
+	v.SetDefault("canonifyurls", false)
+	v.SetDefault("title", defaultTitle)
+	v.SetDefault("theme", defaultTheme)
 
 	// Struct-builtin fields that are in `params.NAME`
 	defaultParams := make(map[string]interface{})
-	defaultParams["author"] = "John Doe"
-	defaultParams["subtitle"] = "My Shim Blog"
+	defaultParams["author"] = defaultAuthor
+	defaultParams["subtitle"] = defaultSubtitle
 	v.SetDefault("params", defaultParams)
 
-	s.BaseURL = v.GetString("BaseURL")
+	s.BaseURL = v.GetString("baseurl")
 	s.contentDir = v.GetString("contentdir")
 	s.layoutDir = v.GetString("layoutdir")
 	s.publishDir = v.GetString("publishdir")
 	s.BuildDrafts = v.GetBool("builddrafts")
-	s.Canonify = v.GetBool("Canonify")
+	s.Canonify = v.GetBool("canonifyurls")
 	s.Title = v.GetString("title")
 	s.Theme = v.GetString("theme")
 	s.Subtitle = v.GetString("params.Subtitle")
 	s.author = v.GetString("params.author")
 
-	// Set sane defaults for taxonomies
-	taxDefaults := map[string]string{
-		"tag":      "tags",
-		"category": "categories",
+	s.timeZone, err = loadTimeZone(v.GetString("timezone"))
+	if err != nil {
+		log.Printf("Using shim's time zone for %s: %s\n", name, err.Error())
 	}
-	v.SetDefault("taxonomies", taxDefaults)
+
+	// Set sane defaults for taxonomies
+	v.SetDefault("taxonomies", defaultTaxonomies)
 
 	s.taxonomies = make(TaxonomyKinds)
 	taxonomies := v.GetStringMapString("taxonomies")
@@ -169,29 +256,40 @@ func (s *Site) loadConfig(name string) error {
 		}
 	}
 
-	s.loadTaxonomyTerms()
-	s.allSettings = v.AllSettings()
+	err = s.loadSchemas()
+	if err != nil {
+		log.Printf("Ignoring section schemas for %s: %s\n", name, err.Error())
+	}
+
+	if err = s.loadTaxonomyTerms(); err != nil {
+		return err
+	}
+	// Only what's in the site's files, so defaults aren't saved with them
+	s.allSettings = copyConfig(config.Merged).(map[string]interface{})
 
 	return nil
 }
 
 // From all posts, populate each taxonomy with terms
-func (s Site) loadTaxonomyTerms() {
+func (s Site) loadTaxonomyTerms() error {
 	// clear existing terms if reloading
 	for _, kind := range s.Taxonomies() {
 		kind.Clear()
 	}
 	// Update taxonomy from each post
 	s.Posts = nil
-	s.GetAllPosts()
+	if err := s.GetAllPosts(); err != nil {
+		return err
+	}
 	for _, p := range s.Posts {
 		p.updateTaxonomy()
 	}
+	return nil
 }
 
 // GetAllPosts - Find all posts for this site.
 // TODO: Don't reload posts if they haven't been modified since last load.
-func (s *Site) GetAllPosts() {
+func (s *Site) GetAllPosts() error {
 	contentPath := filepath.Join(s.Location, s.ContentDir())
 
 	allPostFiles := list.New()
@@ -199,7 +297,7 @@ func (s *Site) GetAllPosts() {
 
 	scanFunc := func(path string, fileInfo os.FileInfo, err error) error {
 		if err != nil {
-			// return err
+			return err
 		}
 
 		if !fileInfo.IsDir() {
@@ -215,7 +313,7 @@ func (s *Site) GetAllPosts() {
 
 	err := filepath.Walk(contentPath, scanFunc)
 	if err != nil {
-		log.Fatalf("Could not find site posts: %s\n", err.Error())
+		return fmt.Errorf("Could not find site posts: %s", err.Error())
 	}
 
 	allPosts := make([]*Post, numPosts)
@@ -228,67 +326,86 @@ func (s *Site) GetAllPosts() {
 		if ok {
 			allPosts[i], err = s.loadPost(fileName, contentPath)
 			if err != nil {
-				log.Fatalf("failed to load post %s!\n", fileName)
+				return fmt.Errorf("Failed to load post %s: %s", fileName, err.Error())
 			}
 		} else {
-			log.Fatal("This should *never* happen, but it looks like we have non-string in a list of file names!")
+			return fmt.Errorf("This should *never* happen, but it looks like we have non-string in a list of file names!")
 		}
 
 		elem = elem.Next()
 	}
 
+	// Copied files start out with the same ID as the original
+	s.settleDuplicateIDs(allPosts)
+
 	s.Posts = allPosts
 	sort.Sort(s.Posts)
+	return nil
+}
+
+// inBackground runs `work` in its own goroutine. Builds and other work on
+// the site's files are started this way so that waitForBackground can tell
+// when they are done.
+func (s *Site) inBackground(work func()) {
+	pending := s.buildLock.pending
+	if pending == nil {
+		go work()
+		return
+	}
+
+	pending.Add(1)
+	go func() {
+		defer pending.Done()
+		work()
+	}()
+}
+
+// waitForBackground blocks until all of the work started by inBackground
+// is done
+func (s *Site) waitForBackground() {
+	if s.buildLock.pending != nil {
+		s.buildLock.pending.Wait()
+	}
 }
 
 // BuildPublic - Build the public site using Hugo
 func (s *Site) BuildPublic() (err error) {
-	publicDir := filepath.Join(s.Location, "public")
+	publicDir := s.PublishDir()
+	if !filepath.IsAbs(publicDir) {
+		publicDir = filepath.Join(s.Location, publicDir)
+	}
 	err = s.build(publicDir, false)
 	return
 }
 
 // BuildPreview - Build a preview with hugo
 func (s Site) BuildPreview() (err error) {
-	// Set BaseURL to /preview/ to help view
-	origPath := s.BaseURL[:]
-
-	// NOTE: The way that we are publishing these sites means that all of the URLs
-	// **CANNOT** be canonical. So what's happening here is that we're temporarily
-	// making the site not canonical for the entirety of this build process.
-	wasCanonical := s.Canonify
-	if wasCanonical {
-		s.Canonify = false
-	}
-
-	s.BaseURL = shimAssets.baseurl + "/preview/"
-	log.Printf("Temporarily %s\n", s.BaseURL)
-	// s.BaseURL = origPath + "/preview/"
-	err = s.SaveConfig()
-	if err != nil {
-		return
-	}
+	// The preview is served from /preview/, so hugo is told to build it for
+	// there instead of the site's BaseURL.
+	previewURL := shimAssets().baseurl + "/preview/"
+	log.Printf("Building preview for %s\n", previewURL)
 
 	previewDir := filepath.Join(s.Location, "preview")
-	err = s.build(previewDir, true)
-	if err != nil {
-		return
-	}
-
-	// reset to original path
-	s.BaseURL = origPath
-	s.Canonify = wasCanonical
-	_ = s.SaveConfig()
-	log.Printf("Now %s\n", s.BaseURL)
-
-	return err
+	return s.build(previewDir, true, "-b", previewURL)
 }
 
 // Build and generate the site using Hugo's generator function
-func (s *Site) build(path string, drafts bool) error {
-	hugoPath, err := exec.LookPath("hugo")
+func (s *Site) build(path string, drafts bool, args ...string) (err error) {
+	started := time.Now()
+	var output []byte
+	defer func() {
+		s.recordBuild(&BuildStatus{
+			Preview:  drafts,
+			Started:  started,
+			Duration: time.Since(started),
+			Err:      err,
+			Output:   string(output),
+		})
+	}()
+
+	hugo, err := s.HugoPath()
 	if err != nil {
-		return fmt.Errorf("Could not find hugo executable. Is hugo installed?\n")
+		return err
 	}
 
 	// These two lines so we don't screw ourselves accidentally with Hugo.
@@ -301,50 +418,78 @@ func (s *Site) build(path string, drafts bool) error {
 		return fmt.Errorf("Could not clean up target %s\nError: %s", path, err.Error())
 	}
 
-	cmd := &exec.Cmd{}
+	args = append([]string{"-s", s.Location, "-d", path}, args...)
 	if drafts {
-		cmd = exec.Command(hugoPath, "-D", "-s", s.Location, "-d", path)
-	} else {
-		cmd = exec.Command(hugoPath, "-s", s.Location, "-d", path)
+		args = append([]string{"-D"}, args...)
+	}
+	cmd := exec.Command(hugo, args...)
+	if drafts {
+		// Previews are served under shim, so their URLs can't be canonical
+		cmd.Env = append(os.Environ(), "HUGO_CANONIFYURLS=false")
 	}
 
-	err = cmd.Run()
+	output, err = cmd.CombinedOutput()
 	if err != nil {
+		if warning := s.Hugo().Warning; len(warning) > 0 {
+			return fmt.Errorf("Could not build site. Error: %s\n%s\n", err.Error(), warning)
+		}
 		return fmt.Errorf("Could not build site. Error: %s\n", err.Error())
 	}
 
 	return nil
 }
 
+func (s *Site) recordBuild(status *BuildStatus) {
+	if s.builds == nil {
+		return
+	}
+
+	s.builds.Lock()
+	s.builds.last = status
+	s.builds.Unlock()
+}
+
+// LastBuild - How the last build of this site went, or nil if it hasn't been
+// built since shim started.
+func (s Site) LastBuild() *BuildStatus {
+	if s.builds == nil {
+		return nil
+	}
+
+	s.builds.Lock()
+	defer s.builds.Unlock()
+	return s.builds.last
+}
+
 // SaveConfig - Saves this site's configuration with the intended changes
 func (s Site) SaveConfig() error {
+	return s.SaveConfigAs("")
+}
+
+// SaveConfigAs - Saves this site's configuration, remembering that `user`
+// changed it. Each setting is saved in the file which defines it.
+func (s Site) SaveConfigAs(user string) error {
 	err := s.updateMap()
 	if err != nil {
 		return errors.New("Could not update the metadata associated with this site.")
 	}
-
-	// fmt.Printf("opening at %s/config.toml\n", s.location)
-	fileLoc := fmt.Sprintf("%s/config.toml", s.Location)
-
-	mode := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
-	file, err := os.OpenFile(fileLoc, mode, 0666)
-	defer file.Close()
-	if err != nil {
-		return errors.New("Could not open site configuration file")
+	if s.config == nil {
+		s.config = &siteConfig{Merged: make(map[string]interface{})}
 	}
 
-	_, err = file.WriteString("# WARNING: This file was automatically generated by shim.\n" +
-		"# Editing this file directly may have adverse consequences.\n" +
-		"# Even though TOML is CaSe-SeNsItIvE, viper, Hugo's TOML parser is case-insensitive!\n" +
-		"# Thus, all of the key values below are lowercase to prevent duplication.\n\n" +
-		"# You have been warned!\n\n")
-	checkReason(err, "Could not write warning header to top of site configuration "+
-		"file. It may be corrupted, so please check it.")
-
-	tomlEncoder := toml.NewEncoder(file)
-	tomlEncoder.Indent = "    "
-	tomlEncoder.Encode(s.allSettings)
+	configLock.Lock()
+	defer configLock.Unlock()
 
+	for _, f := range s.config.apply(s.allSettings) {
+		src, err := f.source(s.Location)
+		f.edits = nil
+		if err != nil {
+			return fmt.Errorf("Could not save %s: %s", f.Path, err.Error())
+		}
+		if err = s.writeConfigLocked(f.Path, src, user); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -355,46 +500,57 @@ func (s *Site) updateMap() error {
 		s.allSettings = make(map[string]interface{})
 	}
 
-	// Even though TOML is case-sensitive, viper, the library Hugo uses, is not.
-	// Therefore, everything is lowercase here to prevent accidental duplication.
-	s.allSettings["title"] = s.Title
-	s.allSettings["BaseURL"] = s.BaseURL
-	s.allSettings["contentdir"] = s.ContentDir()
-	s.allSettings["layoutdir"] = s.LayoutDir()
-	s.allSettings["publishdir"] = s.PublishDir()
-	s.allSettings["staticdir"] = "static"
-	s.allSettings["builddrafts"] = s.BuildDrafts
-	s.allSettings["Canonify"] = s.Canonify
-	s.allSettings["theme"] = s.Theme
-	s.allSettings["metadataformat"] = "toml"
-	s.allSettings["notimes"] = false
-	s.allSettings["paginate"] = 10
-	s.allSettings["paginatepath"] = "page"
-
-	paramsKey, ok := s.allSettings["params"]
-	if ok {
-		paramsMap, ok := paramsKey.(map[string]interface{})
-		if ok {
-			// Site-wide parameters
-			paramsMap["author"] = s.Author()
-			paramsMap["subtitle"] = s.Subtitle
-		} else {
+	// Hugo's settings are case-insensitive, and allSettings has them in
+	// lowercase like viper does.
+	s.changeSetting([]string{"title"}, s.Title, defaultTitle)
+	s.changeSetting([]string{"baseurl"}, s.BaseURL, defaultBaseURL)
+	s.changeSetting([]string{"builddrafts"}, s.BuildDrafts, false)
+	s.changeSetting([]string{"canonifyurls"}, s.Canonify, false)
+	s.changeSetting([]string{"theme"}, s.Theme, defaultTheme)
+
+	// Site-wide parameters
+	if params, ok := s.allSettings["params"]; ok {
+		if _, ok := params.(map[string]interface{}); !ok {
 			return errors.New("allSettings[\"params\"] is *not* a map[string]interface{}! WTF")
 		}
-	} else {
-		return errors.New("Could not find \"params\" map inside of configuration map")
 	}
+	s.changeSetting([]string{"params", "author"}, s.Author(), defaultAuthor)
+	s.changeSetting([]string{"params", "subtitle"}, s.Subtitle, defaultSubtitle)
 
 	// Go ahead and write all taxonomy names to the hashmap
-	taxonomies := make(map[string]string)
+	taxonomies := make(map[string]interface{})
 	for _, kind := range s.taxonomies.GetKinds() {
 		taxonomies[kind.Singular()] = kind.Plural()
 	}
-	s.allSettings["taxonomies"] = taxonomies
+	s.changeSetting([]string{"taxonomies"}, taxonomies, defaultTaxonomies)
 
 	return nil
 }
 
+// changeSetting updates one of the settings shim manages. A setting the site
+// doesn't have yet is only added once it's different from its default.
+func (s *Site) changeSetting(path []string, value, def interface{}) {
+	unset := sameConfigValue(value, def)
+
+	table := s.allSettings
+	for _, key := range path[:len(path)-1] {
+		next, ok := table[key].(map[string]interface{})
+		if !ok {
+			if unset {
+				return
+			}
+			next = make(map[string]interface{})
+			table[key] = next
+		}
+		table = next
+	}
+
+	key := path[len(path)-1]
+	if _, ok := table[key]; ok || !unset {
+		table[key] = value
+	}
+}
+
 // ContentDir - Directory where content (e.g. posts, images) will be stored
 func (s Site) ContentDir() string {
 	return s.contentDir
@@ -413,12 +569,47 @@ func (s Site) PublishDir() string {
 // Author - Default author for the site
 func (s Site) Author() string {
 	if len(s.author) == 0 {
-		return "John Doe" // default
+		return defaultAuthor
 	}
 
 	return s.author
 }
 
+// Params - The site's parameters, as they are in its configuration
+func (s Site) Params() map[string]interface{} {
+	params, _ := s.allSettings["params"].(map[string]interface{})
+	return params
+}
+
+// ParamFields - The site's parameters, except the author and subtitle which
+// have their own fields
+func (s Site) ParamFields() []ParamField {
+	fields := []ParamField{}
+	for _, f := range paramFields(s.Params(), nil) {
+		if len(f.Path) == 1 && (f.Path[0] == "author" || f.Path[0] == "subtitle") {
+			continue
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// ParamKinds - The kinds of parameters which can be added to the site
+func (s Site) ParamKinds() []ParamField {
+	return paramKinds
+}
+
+// setParams replaces the site's parameters. They're written the next time
+// the configuration is saved.
+func (s *Site) setParams(params map[string]interface{}) {
+	if s.allSettings == nil {
+		s.allSettings = make(map[string]interface{})
+	}
+	if _, ok := s.allSettings["params"]; ok || len(params) > 0 {
+		s.allSettings["params"] = params
+	}
+}
+
 // Taxonomies - This site's taxonomies
 func (s Site) Taxonomies() TaxonomyKinds {
 	return s.taxonomies
@@ -0,0 +1,84 @@
+// SHIM - A web front end for the Hugo site generator
+// Copyright (C) 2016        Cameron Conn
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+const (
+	defaultSummaryLength  = 70 // words, same as Hugo
+	summaryTruncationMark = "…"
+)
+
+var regexSummaryDivider = regexp.MustCompile(`(?i)<!--\s*more\s*-->`)
+var regexShortcodeTag = regexp.MustCompile(`{{[<%].*?[%>]}}`)
+var regexHTMLComment = regexp.MustCompile(`(?s)<!--.*?-->`)
+var regexHTMLTag = regexp.MustCompile(`</?[a-zA-Z][^>]*>`)
+var regexCodeFence = regexp.MustCompile("(?m)^\\s*(```|~~~).*$")
+var regexMarkdownImage = regexp.MustCompile(`!\[([^\]]*)\]\([^)]*\)`)
+var regexMarkdownLink = regexp.MustCompile(`\[([^\]]*)\](\([^)]*\)|\[[^\]]*\])`)
+var regexMarkdownLinkDef = regexp.MustCompile(`(?m)^\s*\[[^\]]+\]:\s*\S+.*$`)
+var regexMarkdownHeading = regexp.MustCompile(`(?m)^\s*#{1,6}\s*|\s*#+\s*$`)
+var regexMarkdownBlock = regexp.MustCompile(`(?m)^\s*(>\s*)+|^\s*([-*+]|\d+[.)])\s+`)
+var regexMarkdownRule = regexp.MustCompile(`(?m)^\s*([-*_]\s*){3,}$`)
+var regexMarkdownEmphasis = regexp.MustCompile("(\\*\\*|__|\\*|_|~~|`)([^\\s*_~`](.*?[^\\s*_~`])?)(\\*\\*|__|\\*|_|~~|`)")
+
+// plainText strips Markdown syntax, HTML and shortcodes from a post body
+func plainText(body string) string {
+	text := regexHTMLComment.ReplaceAllString(body, "")
+	text = regexShortcodeTag.ReplaceAllString(text, "")
+	text = regexCodeFence.ReplaceAllString(text, "")
+	text = regexMarkdownImage.ReplaceAllString(text, "$1")
+	text = regexMarkdownLink.ReplaceAllString(text, "$1")
+	text = regexMarkdownLinkDef.ReplaceAllString(text, "")
+	text = regexMarkdownRule.ReplaceAllString(text, "")
+	text = regexMarkdownHeading.ReplaceAllString(text, "\n")
+	text = regexMarkdownBlock.ReplaceAllString(text, "")
+	text = regexMarkdownEmphasis.ReplaceAllString(text, "$2")
+	text = regexHTMLTag.ReplaceAllString(text, " ")
+	text = html.UnescapeString(text)
+
+	return strings.TrimSpace(regexWhitespace.ReplaceAllString(text, " "))
+}
+
+// summarize makes a plain-text summary of a post body the way Hugo does: the
+// text before the `<!--more-->` divider if there is one, and otherwise the
+// first `words` words of the post.
+func summarize(body string, words int) string {
+	if loc := regexSummaryDivider.FindStringIndex(body); loc != nil {
+		return plainText(body[:loc[0]])
+	}
+
+	fields := strings.Fields(plainText(body))
+	if len(fields) <= words {
+		return strings.Join(fields, " ")
+	}
+
+	return strings.Join(fields[:words], " ") + summaryTruncationMark
+}
+
+// SummaryLength - How many words are in automatic summaries of this site's
+// posts.
+func (s Site) SummaryLength() int {
+	if length := toInt(s.allSettings["summarylength"]); length > 0 {
+		return length
+	}
+	return defaultSummaryLength
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSummarize(t *testing.T) {
+	inputs := []string{
+		"# Hello\n\nSome **bold** and _italic_ text with a [link](http://example.com).\n",
+		"Before the break.\n\n<!--more-->\n\nAfter the break.",
+		"{{< figure src=\"a.png\" >}}\n\n> A quote\n\n- item `one`\n- item two\n",
+		"Ünïcödé wörds " + strings.Repeat("word ", 100),
+	}
+
+	outputs := []string{
+		"Hello Some bold and italic text with a link.",
+		"Before the break.",
+		"A quote item one item two",
+		"Ünïcödé wörds " + strings.TrimSpace(strings.Repeat("word ", 68)) + "…",
+	}
+
+	for i, input := range inputs {
+		summary := summarize(input, defaultSummaryLength)
+		if summary != outputs[i] {
+			t.Errorf("|%s| was supposed to summarize to |%s|, not |%s|\n", input, outputs[i], summary)
+		}
+	}
+}
@@ -22,6 +22,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 // GetThemes - Find a list of all themes available in the themesDir.
@@ -55,36 +56,55 @@ func DownloadTheme(themeFolder, themeDownloadLoc, customName string) error {
 	return nil
 }
 
-// ChangeTheme - Change the theme for a site siteName to themeName
+// ChangeTheme - Change the theme for a site siteName to themeName. Themes
+// the site has in its own themes folder are used as they are. Otherwise, the
+// theme is linked from shim's themes folder, replacing links to shim's other
+// themes. Nothing else in the site's themes folder is ever removed.
 func ChangeTheme(site *Site, themeName string) error {
-	newThemeSrc := filepath.Join(shimAssets.root, shimAssets.themes, themeName)
+	siteThemePath := filepath.Join(site.Location, "themes")
+	target := filepath.Join(siteThemePath, themeName)
+	if info, err := os.Lstat(target); err == nil && info.Mode()&os.ModeSymlink == 0 {
+		return nil
+	}
 
-	if _, err := os.Stat(newThemeSrc); os.IsNotExist(err) {
-		fmt.Printf("Could not find theme folder. %s does not exist!\n", newThemeSrc)
-		return err
+	themesDir := filepath.Join(shimAssets().root, shimAssets().themes)
+	newThemeSrc := filepath.Join(themesDir, themeName)
+	if _, err := os.Stat(newThemeSrc); err != nil {
+		return fmt.Errorf("Could not find the theme %s in the site or in shim's themes", themeName)
 	}
 
-	siteThemePath := filepath.Join(site.Location, "themes")
-	if _, err := os.Stat(siteThemePath); os.IsNotExist(err) {
-		fmt.Printf("Could not find old theme folder at %s. It does not exist!\n", siteThemePath)
+	if err := os.MkdirAll(siteThemePath, 0755); err != nil {
 		return err
 	}
-	// remove all symlinks in that folder
-	globString := filepath.Join(siteThemePath, "*")
-	files, err := filepath.Glob(globString)
+	files, err := filepath.Glob(filepath.Join(siteThemePath, "*"))
 	if err != nil {
 		return err
 	}
-
 	for _, name := range files {
-		err = os.RemoveAll(name)
-		if err != nil {
-			return err
+		if linksInto(name, themesDir) {
+			if err = os.Remove(name); err != nil {
+				return err
+			}
 		}
 	}
 
-	// create symlink
-	target := filepath.Join(siteThemePath, themeName)
-	err = os.Symlink(newThemeSrc, target)
-	return err
+	return os.Symlink(newThemeSrc, target)
+}
+
+// linksInto tells whether `name` is a symlink to something in `dir`
+func linksInto(name, dir string) bool {
+	info, err := os.Lstat(name)
+	if err != nil || info.Mode()&os.ModeSymlink == 0 {
+		return false
+	}
+
+	dest, err := os.Readlink(name)
+	if err != nil {
+		return false
+	}
+	if !filepath.IsAbs(dest) {
+		dest = filepath.Join(filepath.Dir(name), dest)
+	}
+	rel, err := filepath.Rel(dir, dest)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
 }
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestChangeTheme(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shim-themes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, theme := range []string{"themes/a", "themes/b", "other/c", "site/themes/own"} {
+		os.MkdirAll(filepath.Join(dir, theme), 0755)
+	}
+	siteThemes := filepath.Join(dir, "site", "themes")
+	os.Symlink(filepath.Join(dir, "themes", "a"), filepath.Join(siteThemes, "a"))
+	os.Symlink(filepath.Join(dir, "other", "c"), filepath.Join(siteThemes, "c"))
+
+	old := shim.state
+	setShimState(shimState{config: old.config, assets: &assets{root: dir, themes: "themes"}})
+	defer setShimState(old)
+	s := &Site{Location: filepath.Join(dir, "site")}
+
+	if err = ChangeTheme(s, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err = ChangeTheme(s, "own"); err != nil {
+		t.Fatal(err)
+	}
+	if err = ChangeTheme(s, "missing"); err == nil {
+		t.Errorf("A theme which doesn't exist was used")
+	}
+
+	for name, kept := range map[string]bool{"a": false, "b": true, "c": true, "own": true} {
+		_, err := os.Lstat(filepath.Join(siteThemes, name))
+		if kept != (err == nil) {
+			t.Errorf("The site's theme %s should have been kept: %t\n", name, kept)
+		}
+	}
+	if info, err := os.Lstat(filepath.Join(siteThemes, "own")); err != nil || !info.IsDir() {
+		t.Errorf("The site's own theme was changed")
+	}
+}
@@ -0,0 +1,796 @@
+// SHIM - A web front end for the Hugo site generator
+// Copyright (C) 2016        Cameron Conn
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var regexTOMLBareKey = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// tomlEntry - A `key = value` line (or lines) in a TOML document
+type tomlEntry struct {
+	path       []string // the whole path of the key, including its table
+	table      []string // the table the key is in
+	start, end int      // the first and last line of the entry
+	valueStart int      // where the value starts on the first line
+	valueEnd   int      // where the value ends on the last line
+	array      bool     // in an array of tables, where paths aren't unique
+}
+
+// tomlHeader - A `[table]` or `[[array]]` line in a TOML document
+type tomlHeader struct {
+	path  []string
+	line  int
+	array bool
+}
+
+// tomlDoc - A TOML document kept as lines, so that settings can be changed
+// without touching the comments, order or formatting of everything else.
+type tomlDoc struct {
+	lines   []string
+	entries []tomlEntry
+	headers []tomlHeader
+}
+
+// parseTOMLDoc reads a TOML document. It should already be valid TOML.
+func parseTOMLDoc(src string) (*tomlDoc, error) {
+	d := &tomlDoc{lines: strings.Split(src, "\n")}
+	return d, d.parse()
+}
+
+// String - The document's source
+func (d *tomlDoc) String() string {
+	return strings.Join(d.lines, "\n")
+}
+
+// parse finds the entries and headers in the document's lines
+func (d *tomlDoc) parse() error {
+	d.entries = nil
+	d.headers = nil
+
+	table := []string{}
+	array := false
+	for i := 0; i < len(d.lines); i++ {
+		line := d.lines[i]
+		col := len(line) - len(strings.TrimLeft(line, " \t"))
+		if col == len(line) || line[col] == '#' {
+			continue
+		}
+
+		if line[col] == '[' {
+			array = strings.HasPrefix(line[col:], "[[")
+			open := col + 1
+			if array {
+				open++
+			}
+			path, next, err := parseTOMLKey(line, open)
+			if err != nil {
+				return fmt.Errorf("Line %d: %s", i+1, err.Error())
+			}
+			if !strings.HasPrefix(strings.TrimLeft(line[next:], " \t"), "]") {
+				return fmt.Errorf("Line %d: a table name needs to end with ]", i+1)
+			}
+
+			table = path
+			d.headers = append(d.headers, tomlHeader{path: path, line: i, array: array})
+			continue
+		}
+
+		key, next, err := parseTOMLKey(line, col)
+		if err != nil {
+			return fmt.Errorf("Line %d: %s", i+1, err.Error())
+		}
+		next = skipTOMLSpace(line, next)
+		if next >= len(line) || line[next] != '=' {
+			return fmt.Errorf("Line %d: expected = after the key", i+1)
+		}
+		valueStart := skipTOMLSpace(line, next+1)
+
+		end, valueEnd := scanTOMLValue(d.lines, i, valueStart)
+		d.entries = append(d.entries, tomlEntry{
+			path:       append(append([]string{}, table...), key...),
+			table:      table,
+			start:      i,
+			end:        end,
+			valueStart: valueStart,
+			valueEnd:   valueEnd,
+			array:      array,
+		})
+		i = end
+	}
+	return nil
+}
+
+func skipTOMLSpace(line string, col int) int {
+	for col < len(line) && (line[col] == ' ' || line[col] == '\t') {
+		col++
+	}
+	return col
+}
+
+// parseTOMLKey reads a key like `a."b c".d` starting at `col`, and where the
+// key ends.
+func parseTOMLKey(line string, col int) ([]string, int, error) {
+	path := []string{}
+	for {
+		col = skipTOMLSpace(line, col)
+		if col >= len(line) {
+			return nil, col, fmt.Errorf("expected a key")
+		}
+
+		switch line[col] {
+		case '"':
+			end := closingQuote(line, col+1, '"')
+			if end < 0 {
+				return nil, col, fmt.Errorf("a quoted key needs to end with \"")
+			}
+			part, err := strconv.Unquote(line[col : end+1])
+			if err != nil {
+				part = line[col+1 : end]
+			}
+			path = append(path, part)
+			col = end + 1
+		case '\'':
+			end := strings.IndexByte(line[col+1:], '\'')
+			if end < 0 {
+				return nil, col, fmt.Errorf("a quoted key needs to end with '")
+			}
+			path = append(path, line[col+1:col+1+end])
+			col += end + 2
+		default:
+			start := col
+			for col < len(line) && regexTOMLBareKey.MatchString(line[col:col+1]) {
+				col++
+			}
+			if col == start {
+				return nil, col, fmt.Errorf("expected a key")
+			}
+			path = append(path, line[start:col])
+		}
+
+		next := skipTOMLSpace(line, col)
+		if next >= len(line) || line[next] != '.' {
+			return path, col, nil
+		}
+		col = next + 1
+	}
+}
+
+// closingQuote finds the quote which ends a basic string, skipping escapes
+func closingQuote(line string, col int, quote byte) int {
+	for ; col < len(line); col++ {
+		if line[col] == '\\' {
+			col++
+		} else if line[col] == quote {
+			return col
+		}
+	}
+	return -1
+}
+
+// scanTOMLValue finds where the value starting at `col` of `line` ends. Arrays,
+// inline tables and multi-line strings may go on for several lines.
+func scanTOMLValue(lines []string, line, col int) (endLine, endCol int) {
+	depth := 0
+	endLine, endCol = line, col
+
+	for l := line; l < len(lines); l++ {
+		s := lines[l]
+		c := 0
+		if l == line {
+			c = col
+		}
+
+	scanLine:
+		for c < len(s) {
+			switch {
+			case strings.HasPrefix(s[c:], `"""`) || strings.HasPrefix(s[c:], `'''`):
+				delim := s[c : c+3]
+				l, c = closingMultiline(lines, l, c+3, delim)
+				s = lines[l]
+				endLine, endCol = l, c
+				continue
+			case s[c] == '"':
+				end := closingQuote(s, c+1, '"')
+				if end < 0 {
+					end = len(s) - 1
+				}
+				c = end + 1
+				endLine, endCol = l, c
+				continue
+			case s[c] == '\'':
+				end := strings.IndexByte(s[c+1:], '\'')
+				if end < 0 {
+					c = len(s)
+				} else {
+					c += end + 2
+				}
+				endLine, endCol = l, c
+				continue
+			case s[c] == '#':
+				break scanLine
+			case s[c] == '[' || s[c] == '{':
+				depth++
+			case s[c] == ']' || s[c] == '}':
+				depth--
+			}
+
+			if s[c] != ' ' && s[c] != '\t' {
+				endLine, endCol = l, c+1
+			}
+			c++
+		}
+
+		if depth <= 0 {
+			return endLine, endCol
+		}
+	}
+	return endLine, endCol
+}
+
+// closingMultiline finds the end of a multi-line string, and the column just
+// past it.
+func closingMultiline(lines []string, l, c int, delim string) (int, int) {
+	for ; l < len(lines); l, c = l+1, 0 {
+		s := lines[l]
+		for c < len(s) {
+			i := strings.Index(s[c:], delim)
+			if i < 0 {
+				break
+			}
+			i += c
+
+			escaped := false
+			if delim == `"""` {
+				for j := i - 1; j >= 0 && s[j] == '\\'; j-- {
+					escaped = !escaped
+				}
+			}
+			if !escaped {
+				end := i + 3
+				for end < len(s) && s[end] == delim[0] {
+					end++ // up to two quotes may end the string itself
+				}
+				return l, end
+			}
+			c = i + 1
+		}
+	}
+	return len(lines) - 1, len(lines[len(lines)-1])
+}
+
+// samePath tells whether two key paths are the same, ignoring case like Hugo
+func samePath(a, b []string) bool {
+	return len(a) == len(b) && hasPathPrefix(a, b)
+}
+
+// hasPathPrefix tells whether `path` starts with `prefix`
+func hasPathPrefix(path, prefix []string) bool {
+	if len(prefix) > len(path) {
+		return false
+	}
+	for i := range prefix {
+		if !strings.EqualFold(path[i], prefix[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// tomlKey writes a key, quoting the parts which need it
+func tomlKey(path []string) string {
+	parts := make([]string, len(path))
+	for i, part := range path {
+		if regexTOMLBareKey.MatchString(part) {
+			parts[i] = part
+		} else {
+			parts[i] = tomlString(part)
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+// tomlString writes a basic TOML string
+func tomlString(s string) string {
+	b := new(bytes.Buffer)
+	b.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '\b':
+			b.WriteString(`\b`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\f':
+			b.WriteString(`\f`)
+		case '\r':
+			b.WriteString(`\r`)
+		default:
+			if r < 0x20 || r == 0x7f {
+				fmt.Fprintf(b, `\u%04X`, r)
+			} else {
+				b.WriteRune(r)
+			}
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// tomlValue writes a value as it would go after `key = `. Tables are written
+// inline.
+func tomlValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return tomlString(v), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case time.Time:
+		return v.Format(time.RFC3339Nano), nil
+	case float32:
+		return tomlFloat(float64(v)), nil
+	case float64:
+		return tomlFloat(v), nil
+	}
+
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(rv.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(rv.Uint(), 10), nil
+	case reflect.Slice, reflect.Array:
+		items := make([]string, rv.Len())
+		for i := range items {
+			item, err := tomlValue(rv.Index(i).Interface())
+			if err != nil {
+				return "", err
+			}
+			items[i] = item
+		}
+		return "[" + strings.Join(items, ", ") + "]", nil
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			break
+		}
+		keys := []string{}
+		for _, key := range rv.MapKeys() {
+			keys = append(keys, key.String())
+		}
+		sort.Strings(keys)
+
+		items := make([]string, len(keys))
+		for i, key := range keys {
+			item, err := tomlValue(rv.MapIndex(reflect.ValueOf(key).Convert(rv.Type().Key())).Interface())
+			if err != nil {
+				return "", err
+			}
+			items[i] = tomlKey([]string{key}) + " = " + item
+		}
+		if len(items) == 0 {
+			return "{}", nil
+		}
+		return "{ " + strings.Join(items, ", ") + " }", nil
+	}
+	return "", fmt.Errorf("Can't write %v (a %T) in TOML", value, value)
+}
+
+func tomlFloat(f float64) string {
+	switch {
+	case math.IsNaN(f):
+		return "nan"
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	}
+
+	s := strconv.FormatFloat(f, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".eE") {
+		s += ".0"
+	}
+	return s
+}
+
+// isTOMLTable tells whether a value is written as a table
+func isTOMLTable(value interface{}) bool {
+	rv := reflect.ValueOf(value)
+	return rv.Kind() == reflect.Map && rv.Type().Key().Kind() == reflect.String
+}
+
+// tomlTables tells whether a value is a list of tables, like [[menu.main]]
+func tomlTables(value interface{}) ([]map[string]interface{}, bool) {
+	switch v := value.(type) {
+	case []map[string]interface{}:
+		return v, len(v) > 0
+	case []interface{}:
+		tables := make([]map[string]interface{}, len(v))
+		for i, item := range v {
+			table, ok := item.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			tables[i] = table
+		}
+		return tables, len(v) > 0
+	}
+	return nil, false
+}
+
+// entry finds the entry for exactly `path`
+func (d *tomlDoc) entry(path []string) *tomlEntry {
+	for i := range d.entries {
+		if !d.entries[i].array && samePath(d.entries[i].path, path) {
+			return &d.entries[i]
+		}
+	}
+	return nil
+}
+
+// parentEntry finds an entry which holds `path` inside its value, like an
+// inline table
+func (d *tomlDoc) parentEntry(path []string) *tomlEntry {
+	for i := range d.entries {
+		e := &d.entries[i]
+		if !e.array && len(e.path) < len(path) && hasPathPrefix(path, e.path) {
+			return e
+		}
+	}
+	return nil
+}
+
+// valueText - The source of an entry's value
+func (d *tomlDoc) valueText(e *tomlEntry) string {
+	if e.start == e.end {
+		return d.lines[e.start][e.valueStart:e.valueEnd]
+	}
+
+	parts := []string{d.lines[e.start][e.valueStart:]}
+	parts = append(parts, d.lines[e.start+1:e.end]...)
+	parts = append(parts, d.lines[e.end][:e.valueEnd])
+	return strings.Join(parts, "\n")
+}
+
+// replaceValue puts a new value in an entry, keeping its key and comment
+func (d *tomlDoc) replaceValue(e *tomlEntry, value string) error {
+	first := d.lines[e.start][:e.valueStart] + value + d.lines[e.end][e.valueEnd:]
+	d.replaceLines(e.start, e.end+1, first)
+	return d.parse()
+}
+
+// replaceLines replaces lines [start, end) with `lines`
+func (d *tomlDoc) replaceLines(start, end int, lines ...string) {
+	edited := append([]string{}, d.lines[:start]...)
+	edited = append(edited, lines...)
+	d.lines = append(edited, d.lines[end:]...)
+}
+
+// indent - The indentation of a line
+func (d *tomlDoc) indent(line int) string {
+	s := d.lines[line]
+	return s[:len(s)-len(strings.TrimLeft(s, " \t"))]
+}
+
+// set changes the setting at `path`, or adds it where it fits best.
+func (d *tomlDoc) set(path []string, value interface{}) error {
+	if e := d.entry(path); e != nil {
+		text, err := tomlValue(value)
+		if err != nil {
+			return err
+		}
+		return d.replaceValue(e, text)
+	}
+
+	if e := d.parentEntry(path); e != nil {
+		return d.editInline(e, path, value, false)
+	}
+
+	if tables, ok := tomlTables(value); ok || d.hasArrayTables(path) {
+		return d.setArrayTables(path, tables)
+	}
+
+	if isTOMLTable(value) {
+		rv := reflect.ValueOf(value)
+		keys := []string{}
+		for _, key := range rv.MapKeys() {
+			keys = append(keys, key.String())
+		}
+		sort.Strings(keys)
+
+		// An empty table is written as just its header
+		if len(keys) == 0 && !d.hasTable(path) {
+			return d.appendLines("[" + tomlKey(path) + "]")
+		}
+
+		for _, key := range keys {
+			item := rv.MapIndex(reflect.ValueOf(key).Convert(rv.Type().Key())).Interface()
+			if err := d.set(append(append([]string{}, path...), key), item); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	text, err := tomlValue(value)
+	if err != nil {
+		return err
+	}
+	return d.insert(path, text)
+}
+
+// editInline changes (or removes) a setting inside an entry's inline table
+func (d *tomlDoc) editInline(e *tomlEntry, path []string, value interface{}, remove bool) error {
+	current := make(map[string]interface{})
+	if _, err := toml.Decode("value = "+d.valueText(e), &current); err != nil {
+		return err
+	}
+
+	table, ok := current["value"].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%s isn't a table", tomlKey(e.path))
+	}
+
+	rest := path[len(e.path):]
+	for _, key := range rest[:len(rest)-1] {
+		key, _ = configKey(table, key)
+		next, ok := table[key].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			table[key] = next
+		}
+		table = next
+	}
+
+	key, _ := configKey(table, rest[len(rest)-1])
+	if remove {
+		delete(table, key)
+	} else {
+		table[key] = value
+	}
+
+	text, err := tomlValue(current["value"])
+	if err != nil {
+		return err
+	}
+	return d.replaceValue(e, text)
+}
+
+// insert adds a new `key = value` line for `path` in the table it belongs to
+func (d *tomlDoc) insert(path []string, value string) error {
+	parent := path[:len(path)-1]
+
+	// Next to the last setting in the same table
+	var near *tomlEntry
+	for i := range d.entries {
+		e := &d.entries[i]
+		if e.array || !hasPathPrefix(e.path, parent) || !hasPathPrefix(parent, e.table) {
+			continue
+		}
+		if near == nil || len(e.table) >= len(near.table) {
+			near = e
+		}
+	}
+	if near != nil {
+		line := d.indent(near.start) + tomlKey(path[len(near.table):]) + " = " + value
+		d.replaceLines(near.end+1, near.end+1, line)
+		return d.parse()
+	}
+
+	// Right below the table's header
+	for _, h := range d.headers {
+		if !h.array && samePath(h.path, parent) {
+			d.replaceLines(h.line+1, h.line+1, tomlKey(path[len(parent):])+" = "+value)
+			return d.parse()
+		}
+	}
+
+	// Top level settings go before the first table, and its comments
+	if len(parent) == 0 && len(d.headers) > 0 {
+		at := d.headers[0].line
+		for at > 0 && strings.HasPrefix(strings.TrimSpace(d.lines[at-1]), "#") {
+			at--
+		}
+		d.replaceLines(at, at, tomlKey(path)+" = "+value, "")
+		return d.parse()
+	}
+
+	// Or else at the end of the file
+	if len(parent) > 0 {
+		return d.appendLines("["+tomlKey(parent)+"]", tomlKey(path[len(parent):])+" = "+value)
+	}
+	end := d.end()
+	d.lines = append(d.lines[:end], tomlKey(path)+" = "+value, "")
+	return d.parse()
+}
+
+// end is the line after the last one which isn't blank
+func (d *tomlDoc) end() int {
+	end := len(d.lines)
+	for end > 0 && len(strings.TrimSpace(d.lines[end-1])) == 0 {
+		end--
+	}
+	return end
+}
+
+// appendLines adds a table's lines at the end of the file, after a blank line
+func (d *tomlDoc) appendLines(lines ...string) error {
+	end := d.end()
+	if end > 0 {
+		lines = append([]string{""}, lines...)
+	}
+	d.lines = append(append(d.lines[:end], lines...), "")
+	return d.parse()
+}
+
+// hasTable tells whether the table at `path` has a header or any settings
+func (d *tomlDoc) hasTable(path []string) bool {
+	for _, h := range d.headers {
+		if hasPathPrefix(h.path, path) {
+			return true
+		}
+	}
+	for _, e := range d.entries {
+		if hasPathPrefix(e.path, path) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *tomlDoc) hasArrayTables(path []string) bool {
+	for _, h := range d.headers {
+		if h.array && samePath(h.path, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// section finds the lines of the table whose header is the `n`th one,
+// including tables inside it, but not the comments before the next table.
+func (d *tomlDoc) section(n int) (start, end int) {
+	h := d.headers[n]
+	start, end = h.line, len(d.lines)
+	for _, next := range d.headers[n+1:] {
+		if !hasPathPrefix(next.path, h.path) || (next.array && samePath(next.path, h.path)) {
+			end = next.line
+			break
+		}
+	}
+
+	for end > start+1 {
+		trimmed := strings.TrimSpace(d.lines[end-1])
+		if len(trimmed) > 0 && !strings.HasPrefix(trimmed, "#") {
+			break
+		}
+		end--
+	}
+	return start, end
+}
+
+// removeSection takes out a table, along with the comments right above it
+func (d *tomlDoc) removeSection(n int) {
+	start, end := d.section(n)
+	for start > 0 && strings.HasPrefix(strings.TrimSpace(d.lines[start-1]), "#") {
+		start--
+	}
+
+	// Don't leave two blank lines where the table was
+	blank := func(i int) bool { return i >= len(d.lines) || len(strings.TrimSpace(d.lines[i])) == 0 }
+	if start > 0 && blank(start-1) && blank(end) {
+		start--
+	}
+	d.replaceLines(start, end)
+}
+
+// setArrayTables replaces every `[[path]]` table with `tables`
+func (d *tomlDoc) setArrayTables(path []string, tables []map[string]interface{}) error {
+	// Settings are indented like they were in the old tables
+	indent := ""
+	for _, e := range d.entries {
+		if e.array && samePath(e.table, path) {
+			indent = d.indent(e.start)
+			break
+		}
+	}
+
+	lines := []string{}
+	for i, table := range tables {
+		if i > 0 {
+			lines = append(lines, "")
+		}
+		lines = append(lines, "[["+tomlKey(path)+"]]")
+
+		keys := []string{}
+		for key := range table {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			value, err := tomlValue(table[key])
+			if err != nil {
+				return err
+			}
+			lines = append(lines, indent+tomlKey([]string{key})+" = "+value)
+		}
+	}
+
+	// The new tables go where the first old one was
+	at := -1
+	for n := len(d.headers) - 1; n >= 0; n-- {
+		h := d.headers[n]
+		if h.array && samePath(h.path, path) {
+			start, end := d.section(n)
+			d.replaceLines(start, end)
+			at = start
+		}
+	}
+	if at < 0 {
+		at = len(d.lines)
+		for at > 0 && len(strings.TrimSpace(d.lines[at-1])) == 0 {
+			at--
+		}
+		lines = append([]string{""}, lines...)
+	}
+
+	d.replaceLines(at, at, lines...)
+	return d.parse()
+}
+
+// remove takes the setting or table at `path` out of the document
+func (d *tomlDoc) remove(path []string) error {
+	if e := d.parentEntry(path); e != nil {
+		return d.editInline(e, path, nil, true)
+	}
+
+	for removed := true; removed; {
+		removed = false
+		for i := len(d.entries) - 1; i >= 0; i-- {
+			e := d.entries[i]
+			if !e.array && hasPathPrefix(e.path, path) && !hasPathPrefix(e.table, path) {
+				d.replaceLines(e.start, e.end+1)
+				removed = true
+				break
+			}
+		}
+		for n := len(d.headers) - 1; n >= 0 && !removed; n-- {
+			if hasPathPrefix(d.headers[n].path, path) {
+				d.removeSection(n)
+				removed = true
+			}
+		}
+		if err := d.parse(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
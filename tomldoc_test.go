@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestTOMLDocEdits(t *testing.T) {
+	src := `# My site
+title = "Old" # shown in the header
+paginate = 5
+tags = [
+    "a", # first
+    "b",
+]
+
+# Parameters for the theme
+[params]
+    author = "Ann"
+    social = { twitter = "ann" }
+
+[[menu.main]]
+    name = "Home"
+    url = "/"
+`
+
+	edits := []struct {
+		path   []string
+		value  interface{}
+		remove bool
+	}{
+		{path: []string{"title"}, value: "New"},
+		{path: []string{"theme"}, value: "slim"},
+		{path: []string{"params", "subtitle"}, value: "Hi \"there\""},
+		{path: []string{"params", "social", "github"}, value: "ann"},
+		{path: []string{"paginate"}, remove: true},
+		{path: []string{"permalinks", "post"}, value: "/:slug/"},
+		{path: []string{"tags"}, value: []interface{}{"a", "c"}},
+		{path: []string{"params", "footer"}, value: map[string]interface{}{}},
+		{path: []string{"params"}, value: map[string]interface{}{}},
+	}
+
+	output := `# My site
+title = "New" # shown in the header
+tags = ["a", "c"]
+theme = "slim"
+
+# Parameters for the theme
+[params]
+    author = "Ann"
+    social = { github = "ann", twitter = "ann" }
+    subtitle = "Hi \"there\""
+
+[[menu.main]]
+    name = "Home"
+    url = "/"
+
+[permalinks]
+post = "/:slug/"
+
+[params.footer]
+`
+
+	doc, err := parseTOMLDoc(src)
+	if err != nil {
+		t.Fatalf("Could not parse the document: %s\n", err.Error())
+	}
+	for _, edit := range edits {
+		if edit.remove {
+			err = doc.remove(edit.path)
+		} else {
+			err = doc.set(edit.path, edit.value)
+		}
+		if err != nil {
+			t.Fatalf("Could not change %v: %s\n", edit.path, err.Error())
+		}
+	}
+
+	if doc.String() != output {
+		t.Errorf("The edited document was supposed to be:\n%s\nnot:\n%s\n", output, doc.String())
+	}
+}
@@ -18,15 +18,17 @@ package main
 
 import (
 	"bytes"
-	"encoding/base64"
 	"fmt"
 	"github.com/niemal/uman"
 	"html/template"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -75,27 +77,37 @@ func (w *WebWrapper) FailedMessage(message string) {
 	w.Failed = true
 }
 
+// IsAdmin Whether the logged in user is one of shim's admins. Session must be
+// populated.
+func (w *WebWrapper) IsAdmin() bool {
+	return w.Session != nil && userRole(w.Session.User) == roleAdmin
+}
+
+// UsesWorkflow Whether posts go through an editorial workflow
+func (w *WebWrapper) UsesWorkflow() bool {
+	return shimWorkflow() != nil
+}
+
 // NewWrapper Creates a new WebWrapper struct appropriate to the context of the
 // user, taking into account the current site as well as the URL
 func NewWrapper(w http.ResponseWriter, req *http.Request) *WebWrapper {
 	wr := new(WebWrapper)
 
 	wr.URL = req.URL.String()
-	wr.Base = shimAssets.baseurl
+	wr.Base = shimAssets().baseurl
 
 	wr.Site = findUserSite(w, req)
 
 	return wr
 }
 
-var t *template.Template
-
-func parseTemplate() {
-	t = template.Must(template.ParseGlob(fmt.Sprintf("%s/*", shimAssets.templates)))
+// loadTemplates parses all of shim's templates
+func loadTemplates(a *assets) (*template.Template, error) {
+	return template.ParseGlob(fmt.Sprintf("%s/*", a.templates))
 }
 
 func renderPage(w http.ResponseWriter, tmpl string, wrapper *WebWrapper) {
-	err := t.ExecuteTemplate(w, tmpl, wrapper)
+	err := shimTemplates().ExecuteTemplate(w, tmpl, wrapper)
 	if err != nil {
 		log.Printf("Couldn't execute template: %s\n", err)
 	}
@@ -103,13 +115,13 @@ func renderPage(w http.ResponseWriter, tmpl string, wrapper *WebWrapper) {
 
 // Home - The home page -- Just redirect to login
 func Home(w http.ResponseWriter, req *http.Request) {
-	http.Redirect(w, req, shimAssets.basepath+"/admin/", http.StatusMovedPermanently)
+	http.Redirect(w, req, shimAssets().basepath+"/admin/", http.StatusMovedPermanently)
 }
 
 // Admin - The admin page
 func Admin(w http.ResponseWriter, req *http.Request) {
 	status := NewWrapper(w, req)
-	status.AllSites = allSites
+	status.AllSites = siteList()
 
 	if req.Method == "POST" {
 		err := req.ParseForm()
@@ -122,11 +134,14 @@ func Admin(w http.ResponseWriter, req *http.Request) {
 			doBuild := strings.Trim(req.FormValue("doBuild"), " ")
 			doPreview := strings.Trim(req.FormValue("doPreview"), " ")
 			doReload := strings.Trim(req.FormValue("doReload"), " ")
+			doReloadShim := strings.Trim(req.FormValue("doReloadShim"), " ")
 			switchSite := strings.Trim(req.FormValue("switchSite"), " ")
 			if len(doBuild) >= 1 {
 				status.Action = "build"
 			} else if len(doReload) >= 1 {
 				status.Action = "reload"
+			} else if len(doReloadShim) >= 1 {
+				status.Action = "reloadShim"
 			} else if len(doPreview) >= 1 {
 				status.Action = "preview"
 			} else if len(switchSite) >= 1 {
@@ -148,13 +163,25 @@ func Admin(w http.ResponseWriter, req *http.Request) {
 			status.SuccessMessage("Build completed!")
 		}
 	} else if status.Action == "reload" {
-		err := status.Site.Reload()
+		fresh, err := status.Site.Reload()
 
 		if err == nil {
+			status.Site = fresh
 			status.SuccessMessage("Site reloaded.")
 		} else {
 			status.FailedMessage(fmt.Sprintf("Could not reload site: %s", err.Error()))
 		}
+	} else if status.Action == "reloadShim" {
+		report, err := reloadShim()
+		if err == nil {
+			status.SuccessMessage(report.String())
+		} else {
+			status.FailedMessage(fmt.Sprintf("Could not reload shim: %s", err.Error()))
+		}
+
+		// The current site may have been stopped
+		status.Site = findUserSite(w, req)
+		status.AllSites = siteList()
 	} else if status.Action == "switch" {
 		newSite := strings.TrimSpace(req.FormValue("newSite"))
 		if newSite == status.Site.ShortName {
@@ -164,7 +191,7 @@ func Admin(w http.ResponseWriter, req *http.Request) {
 				setUserSite(w, req, newSite)
 
 				// Update to current site (bug workaround)
-				for _, site := range allSites {
+				for _, site := range siteList() {
 					if site.ShortName == newSite {
 						status.Site = site
 						break
@@ -177,6 +204,8 @@ func Admin(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 
+	status.Session = um.GetHTTPSession(w, req)
+	status.Anything = status.Site.Stats()
 	renderPage(w, "adminPage", status)
 }
 
@@ -284,7 +313,7 @@ func ViewTaxonomies(w http.ResponseWriter, req *http.Request) {
 				goto renderTaxonomy
 			}
 
-			err = wrapper.Site.SaveConfig()
+			err = wrapper.Site.SaveConfigAs(um.GetHTTPSession(w, req).User)
 			if err != nil {
 				wrapper.FailedMessage("Able to create taxonomy, but couldn't save it. Please try saving again.")
 			} else {
@@ -308,7 +337,7 @@ func ViewTaxonomies(w http.ResponseWriter, req *http.Request) {
 
 			delete(wrapper.Site.Taxonomies(), name)
 
-			err = wrapper.Site.SaveConfig()
+			err = wrapper.Site.SaveConfigAs(um.GetHTTPSession(w, req).User)
 			if err != nil {
 				wrapper.FailedMessage("Was able to remove taxonomy, but couldn't update site configuration." +
 					"Please try saving again.")
@@ -328,7 +357,7 @@ renderTaxonomy:
 // Login - The login page
 func Login(w http.ResponseWriter, req *http.Request) {
 	wrapper := new(WebWrapper)
-	wrapper.Base = shimAssets.baseurl
+	wrapper.Base = shimAssets().baseurl
 
 	q := req.URL.Query()
 	redirect := q.Get("redirect")
@@ -338,7 +367,7 @@ func Login(w http.ResponseWriter, req *http.Request) {
 		if len(warn) > 0 {
 			wrapper.Action = "warn"
 			q.Del("warn")
-			wrapper.URL = shimAssets.basepath + "/login/"
+			wrapper.URL = shimAssets().basepath + "/login/"
 			wrapper.Message = "Please login in."
 		}
 	}
@@ -353,7 +382,7 @@ func Login(w http.ResponseWriter, req *http.Request) {
 
 		redirect = req.FormValue("redirect")
 		if len(redirect) == 0 {
-			redirect = shimAssets.basepath + "/admin/" // By default, redirect to /admin/
+			redirect = shimAssets().basepath + "/admin/" // By default, redirect to /admin/
 		}
 
 		username := req.FormValue("username")
@@ -445,32 +474,38 @@ func ViewFiles(w http.ResponseWriter, req *http.Request) {
 	renderPage(w, "filesPage", wrapper)
 }
 
+// redirectLegacyPost sends links which use the old path-based post IDs to
+// the post's current ID, or responds with a 404 if there's no such post.
+func redirectLegacyPost(w http.ResponseWriter, req *http.Request, site *Site, prefix, postID string) {
+	post, err := site.FindLegacyPost(postID)
+	if err != nil {
+		http.Error(w, "Sorry, but the post you are looking for doesn't exist.", http.StatusNotFound)
+		return
+	}
+
+	http.Redirect(w, req, path.Join(shimAssets().basepath, prefix, post.PostID()), http.StatusMovedPermanently)
+}
+
 // EditPost - Edit a Post
 func EditPost(w http.ResponseWriter, req *http.Request) {
 	wrapper := NewWrapper(w, req)
 
-	// postID is the base64 post ID of a post.
 	postID := req.URL.Path[len("/edit/"):]
 
 	if len(postID) == 0 {
-		http.Redirect(w, req, shimAssets.basepath+"/posts/", http.StatusTemporaryRedirect)
+		http.Redirect(w, req, shimAssets().basepath+"/posts/", http.StatusTemporaryRedirect)
 		return
 	}
 
-	postPathBytes, err := base64.StdEncoding.DecodeString(postID)
-	if err != nil {
-		http.Error(w, "Sorry, but the post ID you are trying to edit is invalid.",
-			http.StatusNotFound)
-		return
+	// Pages covering every site say which site a post is on
+	if other := siteNamed(req.URL.Query().Get("site")); other != nil && other != wrapper.Site {
+		setUserSite(w, req, other.ShortName)
+		wrapper.Site = other
 	}
 
-	postPath := string(postPathBytes)
-
-	contentDirPath := filepath.Join(wrapper.Site.Location, wrapper.Site.ContentDir())
-	postLoc := fmt.Sprintf("%s.md", filepath.Join(contentDirPath, postPath))
-	post, err := wrapper.Site.loadPost(postLoc, contentDirPath)
+	post, err := wrapper.Site.FindPost(postID)
 	if err != nil {
-		http.Error(w, err.Error(), 500)
+		redirectLegacyPost(w, req, wrapper.Site, "/edit/", postID)
 		return
 	}
 
@@ -480,6 +515,7 @@ func EditPost(w http.ResponseWriter, req *http.Request) {
 		publish := false
 		values := req.Form
 		var postText string
+		var dateErr error
 
 		for i, v := range values {
 			value := v[0]
@@ -490,23 +526,27 @@ func EditPost(w http.ResponseWriter, req *http.Request) {
 			case "doPublish":
 				// Don't do anything, because we handled this earlier
 				publish = true
+			case "workflowTo":
+				// handled with publishing below
 			case "description":
 				post.ManualDesc = value
 			case "published":
-				post.Published = nil
 				trimmedTime := strings.TrimSpace(value)
 				if len(trimmedTime) == 0 {
+					post.Published = nil
+					post.dateErr = nil
 					continue
 				}
 
-				parsedTime, err := time.Parse(dateFormat, trimmedTime)
+				// A date which can't be read leaves the post's date unchanged
+				parsedTime, err := parseDate(trimmedTime, wrapper.Site.TimeZone())
 				if err != nil {
-					wrapper.FailedMessage("Could not parse publishing time! " +
-						"Please use a valid format, date, and time for time published.")
+					dateErr = fmt.Errorf("Published date: %s", err.Error())
 					continue
 				}
+				parsedTime = parsedTime.In(wrapper.Site.TimeZone())
 				post.Published = &parsedTime
-				log.Printf("parsed time: %s\n", parsedTime.Format(time.RFC3339))
+				post.dateErr = nil
 			case "slug":
 				post.Slug = value
 			case "title":
@@ -523,7 +563,9 @@ func EditPost(w http.ResponseWriter, req *http.Request) {
 					post.Aliases = individualValues
 				}
 			default:
-				if strings.Contains(i, "taxonomy.") {
+				if strings.HasPrefix(i, "field.") {
+					// schema fields are handled below
+				} else if strings.Contains(i, "taxonomy.") {
 					parts := strings.SplitAfterN(i, ".", 2)
 					right := parts[1]
 					if len(right) == 0 {
@@ -541,13 +583,67 @@ func EditPost(w http.ResponseWriter, req *http.Request) {
 			}
 		}
 
-		if publish {
-			post.Draft = false
-			err = post.Publish(postText)
+		fieldErrs := post.applySchemaFields(values, "field.")
+		if dateErr != nil {
+			fieldErrs = append(ValidationErrors{dateErr}, fieldErrs...)
+		}
+
+		if wf := shimWorkflow(); wf != nil {
+			// With a workflow, posts are only published by moving them through it
+			to := values.Get("workflowTo")
+			if len(to) == 0 {
+				err = post.SavePost(postText)
+			} else if len(fieldErrs) > 0 {
+				err = fieldErrs
+			} else {
+				session := um.GetHTTPSession(w, req)
+				err = post.MoveTo(to, session.User, postText)
+			}
+
+			if invalid, ok := err.(ValidationErrors); ok {
+				// The post stays where it was in the workflow
+				err = post.SavePost(postText)
+				if err == nil {
+					wrapper.FailedMessage("Post saved, but it can't move on until these " +
+						"problems are fixed: " + invalid.Error())
+				}
+			}
+
+			if err != nil {
+				wrapper.FailedMessage("Could not save post: " + err.Error())
+			} else if wrapper.Failed {
+				// The problems were already reported
+			} else if len(fieldErrs) > 0 {
+				wrapper.FailedMessage("Post saved, but some fields were left unchanged: " + fieldErrs.Error())
+			} else if len(to) > 0 {
+				wrapper.SuccessMessage("Post saved and moved to " + wf.State(to).Label + ".")
+			} else {
+				wrapper.SuccessMessage("Post saved.")
+			}
+		} else if publish {
+			if len(fieldErrs) > 0 {
+				err = append(fieldErrs, post.Validate()...)
+			} else {
+				err = post.Publish(postText)
+			}
+
+			if invalid, ok := err.(ValidationErrors); ok {
+				// Keep the changes so that nothing is lost. Only a draft is kept
+				// from being published; a post which is already live stays live.
+				err = post.SavePost(postText)
+				if err == nil && post.Draft {
+					wrapper.FailedMessage("Post saved as a draft, but it can't be published " +
+						"until these problems are fixed: " + invalid.Error())
+				} else if err == nil {
+					wrapper.FailedMessage("Post saved, but these problems need to be fixed: " +
+						invalid.Error())
+				}
+			}
+
 			if err != nil {
 				log.Printf("Could not publish post: %s\n", err.Error())
 				wrapper.FailedMessage("Could not publish post: " + err.Error())
-			} else {
+			} else if !wrapper.Failed {
 				wrapper.SuccessMessage("Post saved and published.")
 			}
 		} else {
@@ -556,13 +652,25 @@ func EditPost(w http.ResponseWriter, req *http.Request) {
 			if err != nil {
 				log.Printf("Error while saving post: %s\n", err.Error())
 				wrapper.FailedMessage("Could not save post to disk. Error: " + err.Error())
+			} else if len(fieldErrs) > 0 {
+				wrapper.FailedMessage("Post saved, but some fields were left unchanged: " + fieldErrs.Error())
 			} else {
 				wrapper.SuccessMessage("Post saved.")
 			}
 		}
 	}
 
+	renderEditPage(w, req, wrapper, post)
+}
+
+// renderEditPage shows the edit page of `post`, with the workflow transitions
+// the user may make
+func renderEditPage(w http.ResponseWriter, req *http.Request, wrapper *WebWrapper, post *Post) {
 	wrapper.Post = post
+	if wf := shimWorkflow(); wf != nil {
+		session := um.GetHTTPSession(w, req)
+		wrapper.Anything = wf.Allowed(post.WorkflowState().Name, userRole(session.User))
+	}
 	renderPage(w, "editPage", wrapper)
 }
 
@@ -604,6 +712,18 @@ func NewPost(w http.ResponseWriter, req *http.Request) {
 			}
 			newPostPath += ".md"
 
+			// Check the section's fields before creating anything
+			var fieldValues map[string]interface{}
+			if schema, ok := wrapper.Site.Schemas()[sectionOf(newPostPath)]; ok {
+				var fieldErrs ValidationErrors
+				prefix := fmt.Sprintf("schema.%s.", sectionOf(newPostPath))
+				fieldValues, fieldErrs = schema.formValues(req.Form, prefix, wrapper.Site.TimeZone())
+				if len(fieldErrs) > 0 {
+					wrapper.FailedMessage("Could not create page: " + fieldErrs.Error())
+					goto render
+				}
+			}
+
 			pPath, err := wrapper.Site.newPost(newPostPath)
 			if err != nil {
 				wrapper.FailedMessage("Could not create page: " + err.Error())
@@ -625,6 +745,7 @@ func NewPost(w http.ResponseWriter, req *http.Request) {
 			for v := range post.Taxonomies {
 				post.Taxonomies[v] = []string{}
 			}
+			post.setFields(fieldValues)
 
 			err = post.SavePost("")
 			if err != nil {
@@ -636,7 +757,7 @@ func NewPost(w http.ResponseWriter, req *http.Request) {
 				wrapper.FailedMessage("Could not save page: " + err.Error())
 				goto render
 			} else {
-				editLoc := path.Join(shimAssets.basepath, "/edit/", post.PostID())
+				editLoc := path.Join(shimAssets().basepath, "/edit/", post.PostID())
 				log.Printf("redirecting to %s\n", editLoc)
 				http.Redirect(w, req, editLoc, http.StatusSeeOther)
 				return
@@ -658,36 +779,17 @@ func RemovePost(w http.ResponseWriter, req *http.Request) {
 	postID := req.URL.Path[len("/delete/"):]
 
 	if len(postID) == 0 {
-		http.Redirect(w, req, shimAssets.basepath+"/posts/", http.StatusTemporaryRedirect)
+		http.Redirect(w, req, shimAssets().basepath+"/posts/", http.StatusTemporaryRedirect)
 		return
 	}
 
-	postPathBytes, err := base64.StdEncoding.DecodeString(postID)
+	post, err := wrapper.Site.FindPost(postID)
 	if err != nil {
-		http.Error(w, "Sorry, but the post ID you are trying to edit is invalid.",
-			http.StatusNotFound)
-		return
-	}
-
-	relPath := string(postPathBytes)
-
-	if len(relPath) == 0 {
-		http.Error(w, "File not found :'(", 404)
-		return
-	}
-
-	fileLoc := filepath.Join(wrapper.Site.Location, wrapper.Site.ContentDir(), relPath+".md")
-	if _, err := os.Stat(fileLoc); os.IsNotExist(err) {
-		http.Error(w, "File not found :'(", 404)
-		return
-	}
-
-	contentDirPath := filepath.Join(wrapper.Site.Location, wrapper.Site.ContentDir())
-	post, err := wrapper.Site.loadPost(fileLoc, contentDirPath)
-	if err != nil {
-		http.Error(w, err.Error(), 500)
+		redirectLegacyPost(w, req, wrapper.Site, "/delete/", postID)
 		return
 	}
+	relPath := post.RelPath
+	fileLoc := post.Location
 	wrapper.Post = post
 
 	pageConfirmQuery := req.URL.Query()
@@ -699,7 +801,10 @@ func RemovePost(w http.ResponseWriter, req *http.Request) {
 		if err != nil {
 			wrapper.FailedMessage("Couldn't delete file: " + err.Error())
 		} else {
-			http.Redirect(w, req, shimAssets.basepath+"/posts/", http.StatusSeeOther)
+			if err := post.removeComments(); err != nil {
+				log.Printf("Could not remove comments on %s: %s\n", relPath, err.Error())
+			}
+			http.Redirect(w, req, shimAssets().basepath+"/posts/", http.StatusSeeOther)
 		}
 	}
 
@@ -711,7 +816,7 @@ func EditSite(w http.ResponseWriter, req *http.Request) {
 	// TODO: Support multiple sites
 	wrapper := NewWrapper(w, req)
 
-	themesLoc := fmt.Sprintf("%s/%s", shimAssets.root, shimAssets.themes)
+	themesLoc := fmt.Sprintf("%s/%s", shimAssets().root, shimAssets().themes)
 	allThemes, err := GetThemes(themesLoc)
 	if err != nil {
 		wrapper.FailedMessage(fmt.Sprintf("Failed to load themes: %s", err.Error()))
@@ -725,7 +830,14 @@ func EditSite(w http.ResponseWriter, req *http.Request) {
 		// get values
 		values := req.Form
 
+		params, err := paramsFromForm(wrapper.Site.Params(), values)
+		if err != nil {
+			wrapper.FailedMessage(fmt.Sprintf("Failed to save site parameters: %s", err.Error()))
+			goto renderBasicConfig
+		}
+
 		wrapper.Site.Canonify = false
+		oldTheme := wrapper.Site.Theme
 
 		for i, v := range values {
 			value := v[0]
@@ -745,21 +857,34 @@ func EditSite(w http.ResponseWriter, req *http.Request) {
 				wrapper.Site.author = value
 			case "params.subtitle":
 				wrapper.Site.Subtitle = value
+			case "timezone":
+				if err := wrapper.Site.setTimeZone(value); err != nil {
+					wrapper.FailedMessage(fmt.Sprintf("Failed to save site: %s", err.Error()))
+					goto renderBasicConfig
+				}
+			case "paramPath", "paramKind", "paramValue", "paramRemove",
+				"newParamKey", "newParamKind", "newParamValue":
+				// The rest of the site's parameters, which are already read
 			default:
 				log.Printf("WTF IS %s and %s?\n", i, value)
 			}
 		}
+		wrapper.Site.setParams(params)
 
-		// save site
-		err := wrapper.Site.SaveConfig()
-		if err != nil {
-			wrapper.FailedMessage(fmt.Sprintf("Failed to save site: %s", err.Error()))
-			goto renderBasicConfig
+		// The site's themes folder is only touched when the theme changes
+		if wrapper.Site.Theme != oldTheme {
+			err = ChangeTheme(wrapper.Site, wrapper.Site.Theme)
+			if err != nil {
+				wrapper.Site.Theme = oldTheme
+				wrapper.FailedMessage(fmt.Sprintf("Failed to change theme: %s", err.Error()))
+				goto renderBasicConfig
+			}
 		}
 
-		err = ChangeTheme(wrapper.Site, wrapper.Site.Theme)
+		// save site
+		err = wrapper.Site.SaveConfigAs(um.GetHTTPSession(w, req).User)
 		if err != nil {
-			wrapper.FailedMessage(fmt.Sprintf("Failed to change theme: %s", err.Error()))
+			wrapper.FailedMessage(fmt.Sprintf("Failed to save site: %s", err.Error()))
 			goto renderBasicConfig
 		}
 
@@ -773,55 +898,567 @@ renderBasicConfig:
 func AdvancedConfig(w http.ResponseWriter, req *http.Request) {
 	wrapper := NewWrapper(w, req)
 
-	wrapper.Text = bytes.NewBuffer([]byte{})
-	configLoc := filepath.Join(wrapper.Site.Location, "config.toml")
-	var file *os.File
+	var file *configFile
+	var filePath string
+	var old []byte
 	var err error
 
+	// Sites may have several configuration files, so one is picked to edit
+	wrapper.Choices = wrapper.Site.ConfigFiles()
+	wrapper.Text = bytes.NewBuffer([]byte{})
+	req.ParseMultipartForm(fiveMegabytes)
+	wrapper.Action = req.FormValue("file")
+	if len(wrapper.Action) == 0 {
+		wrapper.Action = wrapper.Choices[0]
+	}
+
+	filePath, err = wrapper.Site.configFilePath(wrapper.Action)
+	if err != nil {
+		wrapper.FailedMessage(err.Error())
+		goto renderAdvancedConfig
+	}
+	if file = wrapper.Site.config.File(wrapper.Action); file == nil {
+		file = &configFile{Path: wrapper.Action, Format: configFormat(wrapper.Action)}
+	}
+
+	old, err = ioutil.ReadFile(filePath)
+	if err != nil {
+		wrapper.FailedMessage(fmt.Sprintf(
+			"Config could not be read because an error occurred: %s", err.Error()))
+		goto renderAdvancedConfig
+	}
+	wrapper.Text.Write(old)
+
 	if req.Method == "POST" {
-		req.ParseMultipartForm(fiveMegabytes)
+		configSrc := req.Form.Get("configSrc")
 
-		// get values
-		values := req.Form
-		configSrc := values.Get("configSrc")
+		// Keep what was typed on the page until it's fixed
+		if problems := validateSiteConfig(configSrc, file.Format, file.Prefix, wrapper.Site.Location); len(problems) > 0 {
+			wrapper.Text = bytes.NewBufferString(configSrc)
+			wrapper.Anything = problems
+			wrapper.FailedMessage("Settings were not saved. Please fix these problems first:")
+			goto renderAdvancedConfig
+		}
 
-		mode := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
-		file, err := os.OpenFile(configLoc, mode, 0666)
+		// The old settings are put back if the site can't use the new ones
+		fresh, err := wrapper.Site.replaceConfig(file.Path, []byte(configSrc), um.GetHTTPSession(w, req).User)
 		if err != nil {
+			wrapper.Text = bytes.NewBufferString(configSrc)
 			wrapper.FailedMessage(fmt.Sprintf(
-				"Settings could not be saved because an error occurred: %s", err.Error()))
+				"Settings were not saved because an error occurred: %s", err.Error()))
 			goto renderAdvancedConfig
 		}
-		defer file.Close()
 
-		// save site
-		file.WriteString(configSrc)
+		wrapper.Site = fresh
+		wrapper.Text = bytes.NewBufferString(configSrc)
+		wrapper.SuccessMessage("Successfully saved and reloaded configuration.")
+	}
+
+renderAdvancedConfig:
+	renderPage(w, "siteConfigAdvanced", wrapper)
+}
+
+// configVersionsPage - What the configuration versions page shows
+type configVersionsPage struct {
+	Versions []ConfigVersion
+	Selected *ConfigVersion // the version being compared, if any
+	Diff     []DiffLine     // from the selected version to the current one
+}
+
+// ConfigVersions - List earlier versions of a site's configuration, compare
+// one with the current configuration, or roll back to it.
+func ConfigVersions(w http.ResponseWriter, req *http.Request) {
+	wrapper := NewWrapper(w, req)
+	page := &configVersionsPage{}
+	wrapper.Anything = page
+
+	selected := req.URL.Query().Get("version")
+	if req.Method == "POST" {
+		req.ParseMultipartForm(fiveMegabytes)
+		rollback := req.Form.Get("rollback")
+
+		fresh, err := wrapper.Site.RollbackConfig(rollback, um.GetHTTPSession(w, req).User)
 		if err != nil {
-			wrapper.FailedMessage(fmt.Sprintf("Your settings may be corrupted -- "+
-				"Settings could not be saved because an error occurred: %s", err.Error()))
-			goto renderAdvancedConfig
+			wrapper.FailedMessage(fmt.Sprintf("Could not roll back: %s", err.Error()))
+		} else {
+			wrapper.Site = fresh
+			wrapper.SuccessMessage("Rolled back and reloaded configuration. " +
+				"The configuration it replaced is now the newest version below.")
+			selected = ""
 		}
+	}
 
-		wrapper.Site.Reload()
-		wrapper.SuccessMessage("Successfully saved and reloaded configuration.")
+	versions, err := wrapper.Site.ConfigVersions()
+	if err != nil {
+		wrapper.FailedMessage(fmt.Sprintf("Could not read configuration versions: %s", err.Error()))
+		goto renderConfigVersions
 	}
+	page.Versions = versions
 
-	wrapper.Text = bytes.NewBuffer([]byte{})
-	file, err = os.Open(configLoc)
-	defer file.Close()
+	if len(selected) > 0 {
+		page.Selected, _, err = wrapper.Site.ConfigVersion(selected)
+		if err == nil {
+			page.Diff, err = wrapper.Site.DiffConfigVersion(selected)
+		}
+		if err != nil {
+			page.Selected = nil
+			wrapper.FailedMessage(err.Error())
+		}
+	}
+
+renderConfigVersions:
+	renderPage(w, "configVersionsPage", wrapper)
+}
+
+// EditSchemas - Edit the front matter schemas of a site's sections
+func EditSchemas(w http.ResponseWriter, req *http.Request) {
+	wrapper := NewWrapper(w, req)
+
+	if req.Method == "POST" {
+		req.ParseMultipartForm(fiveMegabytes)
+		schemaSrc := req.Form.Get("schemaSrc")
+
+		err := wrapper.Site.SaveSchemas(schemaSrc)
+		if err != nil {
+			// Show the rejected text again so that it can be fixed
+			wrapper.Text = bytes.NewBufferString(schemaSrc)
+			wrapper.FailedMessage("Schemas were not saved: " + err.Error())
+			goto renderSchemas
+		}
+
+		wrapper.SuccessMessage("Section schemas saved.")
+	}
+
+	{
+		src, err := wrapper.Site.SchemaSource()
+		if err != nil {
+			wrapper.FailedMessage("Could not read schemas: " + err.Error())
+		}
+		wrapper.Text = bytes.NewBufferString(src)
+	}
+
+renderSchemas:
+	renderPage(w, "schemasPage", wrapper)
+}
+
+// EditMenus - View and change the menus of a site
+func EditMenus(w http.ResponseWriter, req *http.Request) {
+	wrapper := NewWrapper(w, req)
+
+	if req.Method == "POST" {
+		req.ParseMultipartForm(fiveMegabytes)
+
+		action := req.Form.Get("menuAction")
+		wrapper.Action = action
+
+		var entry *MenuEntry
+		var err error
+		if action == "add" {
+			entry = &MenuEntry{index: -1}
+			entry.Menu = strings.TrimSpace(req.Form.Get("menu"))
+			if postID := req.Form.Get("post"); len(postID) > 0 {
+				entry.Post, err = wrapper.Site.FindPost(postID)
+			}
+		} else {
+			entry, err = wrapper.Site.FindMenuEntry(req.Form.Get("entry"))
+		}
+		if err != nil {
+			wrapper.FailedMessage(err.Error())
+			goto renderMenus
+		}
+
+		switch action {
+		case "add", "update":
+			weight := strings.TrimSpace(req.Form.Get("weight"))
+			if len(weight) > 0 {
+				entry.Weight, err = strconv.Atoi(weight)
+				if err != nil {
+					wrapper.FailedMessage("The weight of a menu entry needs to be a whole number.")
+					goto renderMenus
+				}
+			} else {
+				entry.Weight = 0
+			}
+
+			entry.Name = strings.TrimSpace(req.Form.Get("name"))
+			entry.URL = strings.TrimSpace(req.Form.Get("url"))
+			entry.Parent = strings.TrimSpace(req.Form.Get("parent"))
+			if action == "add" {
+				entry.Identifier = strings.TrimSpace(req.Form.Get("identifier"))
+			}
+
+			err = wrapper.Site.SaveMenuEntry(entry)
+		case "remove":
+			err = wrapper.Site.RemoveMenuEntry(entry)
+		case "up":
+			err = wrapper.Site.MoveMenuEntry(entry, -1)
+		case "down":
+			err = wrapper.Site.MoveMenuEntry(entry, 1)
+		default:
+			err = fmt.Errorf("Unable to determine what to do with that menu entry.")
+		}
+
+		if err != nil {
+			wrapper.FailedMessage("Could not update menu: " + err.Error())
+		} else {
+			wrapper.SuccessMessage("Menu updated.")
+		}
+	}
+
+renderMenus:
+	wrapper.Anything = wrapper.Site.Menus()
+	renderPage(w, "menusPage", wrapper)
+}
+
+// ImportPosts - Import posts from another blogging platform
+func ImportPosts(w http.ResponseWriter, req *http.Request) {
+	wrapper := NewWrapper(w, req)
+	wrapper.AllSites = siteList()
+
+	if req.Method == "POST" {
+		err := req.ParseMultipartForm(fiveMegabytes)
+		if err != nil {
+			wrapper.FailedMessage("Couldn't read your upload: " + err.Error())
+			goto renderImport
+		}
+
+		site := wrapper.Site
+		siteName := req.FormValue("site")
+		for _, s := range siteList() {
+			if s.ShortName == siteName {
+				site = s
+				break
+			}
+		}
+
+		upload, _, err := req.FormFile("importFile")
+		if err != nil {
+			wrapper.FailedMessage("Please choose an export file to import.")
+			goto renderImport
+		}
+		defer upload.Close()
+
+		var report *importReport
+		switch req.FormValue("format") {
+		case "wordpress":
+			report, err = site.ImportWordPress(upload, len(req.FormValue("attachments")) > 0)
+		case "ghost":
+			report, err = site.ImportGhost(upload, len(req.FormValue("attachments")) > 0,
+				req.FormValue("siteURL"))
+		default:
+			err = fmt.Errorf("Unknown export format.")
+		}
+		if err != nil {
+			wrapper.FailedMessage("Import failed: " + err.Error())
+			goto renderImport
+		}
+
+		site.loadTaxonomyTerms()
+		site.inBackground(func() {
+			if err := site.BuildPreview(); err != nil {
+				log.Printf("Failed to build preview after import: %s\n", err.Error())
+			}
+		})
+
+		wrapper.Choices = report.Warnings
+		if len(report.Warnings) > 0 {
+			wrapper.FailedMessage(report.String())
+		} else {
+			wrapper.SuccessMessage(report.String())
+		}
+	}
+
+renderImport:
+	renderPage(w, "importPage", wrapper)
+}
+
+// ExportSite - Download an archive of the current site
+func ExportSite(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Redirect(w, req, shimAssets().basepath+"/admin/", http.StatusSeeOther)
+		return
+	}
+
+	wrapper := NewWrapper(w, req)
+	wrapper.AllSites = siteList()
+
+	format := req.FormValue("format")
+	if format != exportZip && format != exportTarGz {
+		wrapper.FailedMessage("Please choose a format for the export.")
+		renderPage(w, "adminPage", wrapper)
+		return
+	}
+	includePublic := len(req.FormValue("includePublic")) > 0
+
+	site := wrapper.Site
+	contentType := "application/zip"
+	if format == exportTarGz {
+		contentType = "application/gzip"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", site.ExportName(format)))
+
+	// The archive is streamed, so errors can't be shown to the user anymore
+	if err := site.Export(w, format, includePublic); err != nil {
+		log.Printf("Failed to export site %s: %s\n", site.ShortName, err.Error())
+	}
+}
+
+// InsertShortcode - Build a shortcode call for the editor's shortcode palette
+func InsertShortcode(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "Shortcodes can only be built with POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := req.ParseMultipartForm(fiveMegabytes); err != nil {
+		http.Error(w, "Couldn't parse form", http.StatusBadRequest)
+		return
+	}
+
+	site := findUserSite(w, req)
+	sc, err := site.Shortcode(req.FormValue("name"))
 	if err != nil {
-		wrapper.FailedMessage(fmt.Sprintf(
-			"Config could not be read because an error occurred: %s", err.Error()))
-		goto renderAdvancedConfig
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	named := make(map[string]string)
+	for _, param := range sc.Params {
+		named[param] = strings.TrimSpace(req.FormValue("param." + param))
 	}
+	positional := make([]string, sc.Positional)
+	for i := range positional {
+		positional[i] = strings.TrimSpace(req.FormValue(fmt.Sprintf("pos.%d", i)))
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, sc.Call(named, positional, req.FormValue("inner")))
+}
+
+// PostComments - Add, resolve or reopen comments on a post, then go back to
+// the post's editor.
+func PostComments(w http.ResponseWriter, req *http.Request) {
+	wrapper := NewWrapper(w, req)
+	postID := req.URL.Path[len("/comments/"):]
 
-	_, err = wrapper.Text.ReadFrom(file)
+	post, err := wrapper.Site.FindPost(postID)
 	if err != nil {
-		wrapper.FailedMessage(fmt.Sprintf(
-			"Config could not be read because an error occurred: %s", err.Error()))
-		goto renderAdvancedConfig
+		http.Error(w, "Sorry, but the post you are looking for doesn't exist.", http.StatusNotFound)
+		return
 	}
 
-renderAdvancedConfig:
-	renderPage(w, "siteConfigAdvanced", wrapper)
+	editLoc := path.Join(shimAssets().basepath, "/edit/", post.PostID())
+	if req.Method != "POST" {
+		http.Redirect(w, req, editLoc, http.StatusSeeOther)
+		return
+	}
+
+	req.ParseMultipartForm(fiveMegabytes)
+	session := um.GetHTTPSession(w, req)
+
+	switch req.FormValue("commentAction") {
+	case "add":
+		line, _ := strconv.Atoi(strings.TrimSpace(req.FormValue("line")))
+		err = post.AddComment(session.User, req.FormValue("body"), req.FormValue("parent"), line)
+	case "resolve":
+		err = post.ResolveComment(req.FormValue("comment"), true)
+	case "reopen":
+		err = post.ResolveComment(req.FormValue("comment"), false)
+	default:
+		err = fmt.Errorf("Unknown comment action.")
+	}
+
+	if err != nil {
+		wrapper.FailedMessage("Could not update comments: " + err.Error())
+		renderEditPage(w, req, wrapper, post)
+		return
+	}
+
+	http.Redirect(w, req, editLoc+"#comments", http.StatusSeeOther)
+}
+
+// ReviewPosts - The queue of posts waiting for a reviewer
+func ReviewPosts(w http.ResponseWriter, req *http.Request) {
+	wrapper := NewWrapper(w, req)
+
+	if shimWorkflow() == nil {
+		wrapper.FailedMessage("Shim isn't set up with an editorial workflow. Add a " +
+			"[workflow] table to shim's config.toml to use one.")
+	}
+	wrapper.Anything = wrapper.Site.ReviewQueue()
+
+	renderPage(w, "reviewPage", wrapper)
+}
+
+// calendarPage - What the calendar page shows
+type calendarPage struct {
+	*Calendar
+	SiteName string // a site's short name, or "all"
+	FeedURL  string
+}
+
+// ViewCalendar - A month or week of posts across one or all sites. Posts can
+// be rescheduled from here.
+func ViewCalendar(w http.ResponseWriter, req *http.Request) {
+	wrapper := NewWrapper(w, req)
+	wrapper.AllSites = siteList()
+	query := req.URL.Query()
+
+	siteName := query.Get("site")
+	if siteName != "all" && siteNamed(siteName) == nil {
+		siteName = wrapper.Site.ShortName
+	}
+
+	anchor, err := time.ParseInLocation(calendarDayFormat, query.Get("date"), wrapper.Site.TimeZone())
+	if err != nil {
+		anchor = time.Now().In(wrapper.Site.TimeZone())
+	}
+
+	if req.Method == "POST" {
+		req.ParseForm()
+
+		var post *Post
+		site := siteNamed(req.FormValue("postSite"))
+		day, err := time.ParseInLocation(calendarDayFormat, req.FormValue("date"), wrapper.Site.TimeZone())
+		if site == nil {
+			err = fmt.Errorf("That site doesn't exist.")
+		} else if err != nil {
+			err = fmt.Errorf("%s isn't a valid date.", req.FormValue("date"))
+		} else if post, err = site.FindPost(req.FormValue("post")); err == nil {
+			err = post.Reschedule(day)
+		}
+
+		if err != nil {
+			wrapper.FailedMessage("Could not reschedule post: " + err.Error())
+		} else {
+			wrapper.SuccessMessage(fmt.Sprintf("Moved \"%s\" to %s.", post.Title,
+				day.Format("Monday, January 2")))
+			anchor = day
+		}
+	}
+
+	sites := siteList()
+	if siteName != "all" {
+		sites = []*Site{siteNamed(siteName)}
+	}
+
+	page := &calendarPage{
+		Calendar: buildCalendar(sites, query.Get("view"), anchor),
+		SiteName: siteName,
+	}
+
+	session := um.GetHTTPSession(w, req)
+	if token, err := calendarToken(session.User); err == nil {
+		page.FeedURL = shimAssets().baseurl + "/calendar.ics?token=" + url.QueryEscape(token)
+	} else {
+		log.Printf("Could not make calendar feed token: %s\n", err.Error())
+	}
+
+	wrapper.Anything = page
+	renderPage(w, "calendarPage", wrapper)
+}
+
+// CalendarFeed - An iCalendar feed of upcoming publications on every site.
+// Calendar apps can't log in, so the feed checks the token in its URL
+// instead.
+func CalendarFeed(w http.ResponseWriter, req *http.Request) {
+	if _, err := checkCalendarToken(req.URL.Query().Get("token")); err != nil {
+		http.Error(w, "Sorry, but that calendar link isn't valid.", http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	if err := writeICal(w, siteList()); err != nil {
+		log.Printf("Could not write calendar feed: %s\n", err.Error())
+	}
+}
+
+// ManageSites - Create, disable, archive and delete sites. Only admins may
+// manage sites.
+func ManageSites(w http.ResponseWriter, req *http.Request) {
+	wrapper := NewWrapper(w, req)
+	wrapper.Session = um.GetHTTPSession(w, req)
+	if !wrapper.IsAdmin() {
+		http.Error(w, "Sorry, but only admins can manage sites.", http.StatusForbidden)
+		return
+	}
+
+	themes, err := GetThemes(filepath.Join(shimAssets().root, shimAssets().themes))
+	if err != nil {
+		wrapper.FailedMessage(fmt.Sprintf("Failed to load themes: %s", err.Error()))
+	}
+	wrapper.Choices = themes
+
+	if req.Method == "POST" {
+		req.ParseForm()
+		name := strings.TrimSpace(req.FormValue("site"))
+
+		switch req.FormValue("siteAction") {
+		case "create":
+			s, err := newSite(req.FormValue("shortName"), req.FormValue("title"),
+				req.FormValue("baseurl"), req.FormValue("theme"))
+			if err != nil {
+				wrapper.FailedMessage("Could not create site: " + err.Error())
+				goto render
+			}
+
+			// Start using the new site right away
+			setUserSite(w, req, s.ShortName)
+			wrapper.Site = s
+			wrapper.SuccessMessage(fmt.Sprintf("Created %s. You're now editing it.", s.ShortName))
+		case "add":
+			s, err := addExistingSite(req.FormValue("shortName"), req.FormValue("dir"))
+			if err != nil {
+				wrapper.FailedMessage("Could not add site: " + err.Error())
+				goto render
+			}
+
+			setUserSite(w, req, s.ShortName)
+			wrapper.Site = s
+			wrapper.SuccessMessage(fmt.Sprintf("Added %s from %s. You're now editing it.",
+				s.ShortName, s.Location))
+		case "disable":
+			if err := disableSite(name); err != nil {
+				wrapper.FailedMessage("Could not disable site: " + err.Error())
+			} else {
+				wrapper.SuccessMessage(fmt.Sprintf("Disabled %s.", name))
+			}
+		case "enable":
+			if _, err := enableSite(name); err != nil {
+				wrapper.FailedMessage("Could not enable site: " + err.Error())
+			} else {
+				wrapper.SuccessMessage(fmt.Sprintf("Enabled %s.", name))
+			}
+		case "archive":
+			if archivePath, err := archiveSite(name); err != nil {
+				wrapper.FailedMessage("Could not archive site: " + err.Error())
+			} else {
+				wrapper.SuccessMessage(fmt.Sprintf("Archived %s to %s and disabled it.", name, archivePath))
+			}
+		case "delete":
+			if req.FormValue("confirm") != name {
+				wrapper.FailedMessage(fmt.Sprintf("Type %s to confirm that you want to delete it.", name))
+			} else if kept, err := deleteSite(name); err != nil {
+				wrapper.FailedMessage("Could not delete site: " + err.Error())
+			} else if kept {
+				wrapper.SuccessMessage(fmt.Sprintf("Removed %s from shim. Its folder is outside "+
+					"shim's sites folder, so it was left alone.", name))
+			} else {
+				wrapper.SuccessMessage(fmt.Sprintf("Deleted %s.", name))
+			}
+		default:
+			wrapper.FailedMessage("Unknown site action.")
+		}
+
+		// The current site may be gone now
+		if siteNamed(wrapper.Site.ShortName) == nil {
+			wrapper.Site = findUserSite(w, req)
+		}
+	}
+
+render:
+	wrapper.AllSites = siteList()
+	wrapper.Anything = disabledSites()
+	renderPage(w, "sitesPage", wrapper)
 }
@@ -0,0 +1,277 @@
+// SHIM - A web front end for the Hugo site generator
+// Copyright (C) 2016        Cameron Conn
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	wpDateFormat = "2006-01-02 15:04:05"
+	wpNoDate     = "0000-00-00 00:00:00"
+)
+
+// wxrExport - The parts of a WordPress eXtended RSS (WXR) export which shim
+// uses. Elements are matched by their local name so that every version of the
+// WXR format can be read.
+type wxrExport struct {
+	Channel struct {
+		Title   string      `xml:"title"`
+		Link    string      `xml:"link"`
+		Authors []wxrAuthor `xml:"author"`
+		Items   []wxrItem   `xml:"item"`
+	} `xml:"channel"`
+}
+
+type wxrAuthor struct {
+	Login       string `xml:"author_login"`
+	DisplayName string `xml:"author_display_name"`
+}
+
+type wxrItem struct {
+	Title         string        `xml:"title"`
+	Link          string        `xml:"link"`
+	Creator       string        `xml:"creator"`
+	Encoded       []wxrEncoded  `xml:"encoded"` // both content:encoded and excerpt:encoded
+	PostID        string        `xml:"post_id"`
+	PostName      string        `xml:"post_name"`
+	PostType      string        `xml:"post_type"`
+	Status        string        `xml:"status"`
+	Date          string        `xml:"post_date"`
+	DateGMT       string        `xml:"post_date_gmt"`
+	AttachmentURL string        `xml:"attachment_url"`
+	Categories    []wxrCategory `xml:"category"`
+}
+
+type wxrEncoded struct {
+	XMLName xml.Name
+	Value   string `xml:",chardata"`
+}
+
+type wxrCategory struct {
+	Domain   string `xml:"domain,attr"`
+	Nicename string `xml:"nicename,attr"`
+	Name     string `xml:",chardata"`
+}
+
+// content finds the encoded element from a namespace such as "content" or
+// "excerpt".
+func (item wxrItem) content(kind string) string {
+	for _, e := range item.Encoded {
+		if strings.Contains(e.XMLName.Space, "/"+kind) {
+			return e.Value
+		}
+	}
+	return ""
+}
+
+// date finds when an item was published, preferring the GMT date
+func (item wxrItem) date() *time.Time {
+	if d := strings.TrimSpace(item.DateGMT); len(d) > 0 && d != wpNoDate {
+		if t, err := time.ParseInLocation(wpDateFormat, d, time.UTC); err == nil {
+			return &t
+		}
+	}
+	if d := strings.TrimSpace(item.Date); len(d) > 0 && d != wpNoDate {
+		if t, err := time.ParseInLocation(wpDateFormat, d, time.Local); err == nil {
+			return &t
+		}
+	}
+	return nil
+}
+
+var regexWPShortcode = regexp.MustCompile(`\[/?(caption|wp_caption)[^\]]*\]`)
+var regexWPBlock = regexp.MustCompile(`(?i)^<(p|div|h[1-6]|ul|ol|li|blockquote|pre|table|figure|hr|iframe)[\s>/]`)
+var regexWPComment = regexp.MustCompile(`<!-- /?wp:[^>]*-->`)
+
+// wpautop adds the paragraphs which WordPress leaves out of its post bodies
+// and only adds when displaying them.
+func wpautop(body string) string {
+	body = strings.Replace(body, "\r\n", "\n", -1)
+	body = regexWPComment.ReplaceAllString(body, "")
+	body = regexWPShortcode.ReplaceAllString(body, "")
+
+	chunks := strings.Split(body, "\n\n")
+	for i, chunk := range chunks {
+		chunk = strings.TrimSpace(chunk)
+		if len(chunk) == 0 || regexWPBlock.MatchString(chunk) {
+			chunks[i] = chunk
+			continue
+		}
+		chunks[i] = "<p>" + strings.Replace(chunk, "\n", "<br>\n", -1) + "</p>"
+	}
+
+	return strings.Join(chunks, "\n")
+}
+
+// ImportWordPress - Import posts, pages and attachments from a WordPress WXR
+// export into this site. If `attachments` is true, attached files are
+// downloaded from the old site into this site's static files.
+func (s *Site) ImportWordPress(data io.Reader, attachments bool) (*importReport, error) {
+	export := new(wxrExport)
+	decoder := xml.NewDecoder(data)
+	decoder.Strict = false
+	decoder.Entity = xml.HTMLEntity
+	if err := decoder.Decode(export); err != nil {
+		return nil, fmt.Errorf("Could not read WordPress export: %s", err.Error())
+	}
+
+	report := new(importReport)
+
+	authors := make(map[string]string)
+	for _, a := range export.Channel.Authors {
+		if len(a.DisplayName) > 0 {
+			authors[a.Login] = a.DisplayName
+		}
+	}
+
+	// Download attachments first, so post bodies can point to the new files
+	replacements := []*regexp.Regexp{}
+	newFiles := []string{}
+	if attachments {
+		client := &http.Client{Timeout: 60 * time.Second}
+		for _, item := range export.Channel.Items {
+			if item.PostType != "attachment" || len(item.AttachmentURL) == 0 {
+				continue
+			}
+
+			name, err := s.downloadStaticFile(client, item.AttachmentURL)
+			if err != nil {
+				report.warn("Could not download %s: %s", item.AttachmentURL, err.Error())
+				continue
+			}
+			report.Files++
+
+			// WordPress also links to resized copies like `photo-300x200.jpg`
+			ext := path.Ext(item.AttachmentURL)
+			stem := strings.TrimSuffix(item.AttachmentURL, ext)
+			stem = stem[strings.Index(stem, "://")+1:]
+			pattern := `(https?:)?` + regexp.QuoteMeta(stem) + `(-\d+x\d+)?` + regexp.QuoteMeta(ext)
+			replacements = append(replacements, regexp.MustCompile(pattern))
+			newFiles = append(newFiles, "files/"+name)
+		}
+	}
+
+	newKinds := false
+	for _, item := range export.Channel.Items {
+		var section string
+		switch item.PostType {
+		case "post":
+			section = "post"
+		case "page":
+			section = ""
+		default:
+			continue // attachments, menu items, revisions, etc.
+		}
+
+		if item.Status == "trash" || item.Status == "auto-draft" {
+			continue
+		}
+
+		body := wpautop(item.content("content"))
+		for i, pattern := range replacements {
+			body = pattern.ReplaceAllString(body, newFiles[i])
+		}
+
+		ip := &importedPost{
+			Section:     section,
+			Slug:        item.PostName,
+			Title:       strings.TrimSpace(item.Title),
+			Author:      item.Creator,
+			Description: strings.TrimSpace(regexWhitespace.ReplaceAllString(item.content("excerpt"), " ")),
+			Date:        item.date(),
+			Draft:       item.Status != "publish" && item.Status != "future",
+			Body:        htmlToMarkdown(body),
+			Terms:       make(map[string][]string),
+		}
+
+		if name, ok := authors[item.Creator]; ok {
+			ip.Author = name
+		}
+
+		if alias := aliasFromURL(item.Link); len(alias) > 0 && !ip.Draft {
+			ip.Aliases = []string{alias}
+		}
+
+		for _, c := range item.Categories {
+			name := strings.TrimSpace(c.Name)
+			switch c.Domain {
+			case "category":
+				if c.Nicename != "uncategorized" {
+					ip.Terms["category"] = append(ip.Terms["category"], name)
+				}
+			case "post_tag":
+				ip.Terms["tag"] = append(ip.Terms["tag"], name)
+			}
+		}
+
+		_, created, err := s.importPost(ip)
+		newKinds = newKinds || created
+		if err != nil {
+			report.warn("Could not import %q: %s", ip.Title, err.Error())
+			continue
+		}
+
+		report.Posts++
+		if ip.Draft {
+			report.Drafts++
+		}
+	}
+
+	if newKinds {
+		if err := s.SaveConfig(); err != nil {
+			report.warn("Could not save new taxonomies: %s", err.Error())
+		}
+	}
+
+	return report, nil
+}
+
+// downloadStaticFile saves a file from the web into this site's static files.
+// If a file with the same name already exists it is kept as-is. The name of
+// the file is returned.
+func (s *Site) downloadStaticFile(client *http.Client, fileURL string) (string, error) {
+	name := NormalizeName(path.Base(fileURL))
+	name = strings.Replace(name, "/", "-", -1)
+	if len(name) == 0 {
+		return "", fmt.Errorf("The file has no name")
+	}
+
+	if f, err := s.GetStaticFile(name); err == nil {
+		f.Close()
+		return name, nil
+	}
+
+	resp, err := client.Get(fileURL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Server responded with %s", resp.Status)
+	}
+
+	return name, s.AddStaticFile(name, resp.Body)
+}
@@ -0,0 +1,407 @@
+// SHIM - A web front end for the Hugo site generator
+// Copyright (C) 2016        Cameron Conn
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/spf13/viper"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	workflowFile = "workflow.toml"
+
+	roleAuthor = "author"
+	roleEditor = "editor"
+	roleAdmin  = "admin" // may make every transition
+)
+
+// workflowLock guards each site's workflow.toml, which holds the state of every
+// post in the site
+var workflowLock sync.Mutex
+
+// WorkflowState - A stage of writing a post goes through
+type WorkflowState struct {
+	Name    string `mapstructure:"name"`
+	Label   string `mapstructure:"label"`
+	Publish bool   `mapstructure:"publish"` // posts in this state are published
+	Review  bool   `mapstructure:"review"`  // posts in this state wait for a reviewer
+}
+
+// WorkflowTransition - A move from one state to another, and the roles which
+// can make it
+type WorkflowTransition struct {
+	From  string   `mapstructure:"from"`
+	To    string   `mapstructure:"to"`
+	Label string   `mapstructure:"label"`
+	Roles []string `mapstructure:"roles"`
+}
+
+// Workflow - The states of a post, and how posts move between them
+type Workflow struct {
+	DefaultRole string               `mapstructure:"defaultRole"`
+	States      []WorkflowState      `mapstructure:"states"`
+	Transitions []WorkflowTransition `mapstructure:"transitions"`
+}
+
+// postState - Where a post is in the workflow, and who put it there
+type postState struct {
+	State string    `toml:"state"`
+	User  string    `toml:"user"`
+	Time  time.Time `toml:"time"`
+}
+
+type workflowStates struct {
+	Posts map[string]*postState `toml:"posts"`
+}
+
+// defaultWorkflow is used when shim's `[workflow]` doesn't list its own states
+func defaultWorkflow() *Workflow {
+	anyone := []string{roleAuthor, roleEditor}
+	editors := []string{roleEditor}
+
+	return &Workflow{
+		DefaultRole: roleAdmin,
+		States: []WorkflowState{
+			{Name: "draft", Label: "Draft"},
+			{Name: "review", Label: "In Review", Review: true},
+			{Name: "approved", Label: "Approved"},
+			{Name: "published", Label: "Published", Publish: true},
+		},
+		Transitions: []WorkflowTransition{
+			{From: "draft", To: "review", Label: "Ready for Review", Roles: anyone},
+			{From: "review", To: "draft", Label: "Request Changes", Roles: anyone},
+			{From: "review", To: "approved", Label: "Approve", Roles: editors},
+			{From: "approved", To: "published", Label: "Publish", Roles: anyone},
+			{From: "approved", To: "draft", Label: "Back to Draft", Roles: editors},
+			{From: "published", To: "draft", Label: "Unpublish", Roles: editors},
+		},
+	}
+}
+
+// loadWorkflow reads the `[workflow]` of shim's configuration. There is no
+// workflow unless shim's configuration has a `[workflow]` table.
+func loadWorkflow(config *viper.Viper) (*Workflow, error) {
+	if !config.IsSet("workflow") {
+		return nil, nil
+	}
+
+	wf := defaultWorkflow()
+	custom := new(Workflow)
+	if err := config.UnmarshalKey("workflow", custom); err != nil {
+		return wf, fmt.Errorf("Could not read workflow: %s", err.Error())
+	}
+
+	if len(custom.DefaultRole) > 0 {
+		wf.DefaultRole = custom.DefaultRole
+	}
+	if len(custom.States) > 0 {
+		if len(custom.Transitions) == 0 {
+			return wf, fmt.Errorf("Workflows with their own states need their own transitions too.")
+		}
+		wf.States = custom.States
+		wf.Transitions = custom.Transitions
+	}
+
+	return wf, wf.check()
+}
+
+// check makes sure a workflow makes sense
+func (wf *Workflow) check() error {
+	names := make(map[string]bool)
+	published := 0
+	for i, state := range wf.States {
+		if len(state.Name) == 0 {
+			return fmt.Errorf("Workflow state #%d has no name.", i+1)
+		}
+		if names[state.Name] {
+			return fmt.Errorf("There is more than one workflow state named %s.", state.Name)
+		}
+		names[state.Name] = true
+		if len(state.Label) == 0 {
+			wf.States[i].Label = state.Name
+		}
+		if state.Publish {
+			published++
+		}
+	}
+
+	if published != 1 {
+		return fmt.Errorf("Exactly one workflow state needs `publish = true`.")
+	}
+	if wf.States[0].Publish {
+		return fmt.Errorf("The first workflow state is for new posts, so it can't be published.")
+	}
+
+	for i, t := range wf.Transitions {
+		if !names[t.From] || !names[t.To] {
+			return fmt.Errorf("The workflow transition from %s to %s uses a state "+
+				"which doesn't exist.", t.From, t.To)
+		}
+		if len(t.Label) == 0 {
+			wf.Transitions[i].Label = t.To
+		}
+	}
+
+	return nil
+}
+
+// State - Find a state by name
+func (wf *Workflow) State(name string) *WorkflowState {
+	for i := range wf.States {
+		if wf.States[i].Name == name {
+			return &wf.States[i]
+		}
+	}
+	return nil
+}
+
+// publishedState is the state of published posts
+func (wf *Workflow) publishedState() *WorkflowState {
+	for i := range wf.States {
+		if wf.States[i].Publish {
+			return &wf.States[i]
+		}
+	}
+	return nil
+}
+
+// userRole - The workflow role of one of shim's users, set with
+// `[users.NAME] role = "..."` in shim's configuration.
+func userRole(user string) string {
+	if role := shimConfig().GetString(fmt.Sprintf("users.%s.role", user)); len(role) > 0 {
+		return role
+	}
+	if wf := shimWorkflow(); wf != nil {
+		return wf.DefaultRole
+	}
+	return roleAdmin
+}
+
+// allowed tells whether a role can make a transition
+func (t WorkflowTransition) allowed(role string) bool {
+	if role == roleAdmin {
+		return true
+	}
+	for _, r := range t.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Allowed - The transitions out of a state which a role can make
+func (wf *Workflow) Allowed(from, role string) []WorkflowTransition {
+	transitions := []WorkflowTransition{}
+	for _, t := range wf.Transitions {
+		if t.From == from && t.allowed(role) {
+			transitions = append(transitions, t)
+		}
+	}
+	return transitions
+}
+
+// transition finds the transition between two states, if a role may make it
+func (wf *Workflow) transition(from, to, role string) (*WorkflowTransition, error) {
+	for _, t := range wf.Transitions {
+		if t.From != from || t.To != to {
+			continue
+		}
+		if !t.allowed(role) {
+			return nil, fmt.Errorf("Your role (%s) can't move posts from %s to %s.",
+				role, wf.State(from).Label, wf.State(to).Label)
+		}
+		return &t, nil
+	}
+
+	return nil, fmt.Errorf("Posts can't be moved from %s to %s.", from, to)
+}
+
+// workflowPath is where a site keeps the workflow states of its posts
+func (s Site) workflowPath() string {
+	return filepath.Join(s.shimDir(), workflowFile)
+}
+
+func (s Site) readWorkflowStates() (*workflowStates, error) {
+	states := &workflowStates{Posts: make(map[string]*postState)}
+	_, err := toml.DecodeFile(s.workflowPath(), states)
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	if states.Posts == nil {
+		states.Posts = make(map[string]*postState)
+	}
+	return states, err
+}
+
+func (s Site) writeWorkflowStates(states *workflowStates) error {
+	buf := new(bytes.Buffer)
+	if err := toml.NewEncoder(buf).Encode(states); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.shimDir(), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.workflowPath(), buf.Bytes(), 0644)
+}
+
+// moveWorkflowState records the workflow state this post had with the ID
+// `from` under its current ID
+func (p *Post) moveWorkflowState(from string) error {
+	workflowLock.Lock()
+	defer workflowLock.Unlock()
+
+	states, err := p.Site.readWorkflowStates()
+	if err != nil {
+		return err
+	}
+	state, ok := states.Posts[from]
+	if !ok {
+		return nil
+	}
+	delete(states.Posts, from)
+	states.Posts[p.PostID()] = state
+	return p.Site.writeWorkflowStates(states)
+}
+
+// postWorkflowState finds where a post is in the workflow. Posts which have
+// never been through the workflow, or which were published or unpublished
+// outside of it, are in the first or published state.
+func (s Site) postWorkflowState(wf *Workflow, p *Post, recorded *postState) *WorkflowState {
+	if recorded != nil {
+		if state := wf.State(recorded.State); state != nil && state.Publish == !p.Draft {
+			return state
+		}
+	}
+
+	if p.Draft {
+		return &wf.States[0]
+	}
+	return wf.publishedState()
+}
+
+// WorkflowState - Where this post is in the workflow, or nil if shim doesn't
+// use one.
+func (p *Post) WorkflowState() *WorkflowState {
+	wf := shimWorkflow()
+	if wf == nil {
+		return nil
+	}
+
+	workflowLock.Lock()
+	states, err := p.Site.readWorkflowStates()
+	workflowLock.Unlock()
+	if err != nil {
+		log.Printf("Could not read workflow states: %s\n", err.Error())
+	}
+
+	return p.Site.postWorkflowState(wf, p, states.Posts[p.PostID()])
+}
+
+// MoveTo - Move this post to another workflow state on behalf of `user`,
+// saving `text` as its body. Moving a post into the published state publishes
+// it, and moving it out unpublishes it.
+func (p *Post) MoveTo(to, user, text string) error {
+	wf := shimWorkflow()
+	from := p.WorkflowState()
+	if wf == nil || from == nil {
+		return fmt.Errorf("Shim isn't set up with a workflow.")
+	}
+
+	if _, err := wf.transition(from.Name, to, userRole(user)); err != nil {
+		return err
+	}
+
+	var err error
+	if wf.State(to).Publish {
+		err = p.Publish(text)
+	} else {
+		p.Draft = true
+		err = p.SavePost(text)
+	}
+	if err != nil {
+		return err
+	}
+
+	workflowLock.Lock()
+	defer workflowLock.Unlock()
+
+	states, err := p.Site.readWorkflowStates()
+	if err != nil {
+		return fmt.Errorf("Could not read workflow states: %s", err.Error())
+	}
+	states.Posts[p.PostID()] = &postState{State: to, User: user, Time: time.Now().UTC()}
+	return p.Site.writeWorkflowStates(states)
+}
+
+// ReviewItem - A post waiting for a reviewer
+type ReviewItem struct {
+	Post  *Post
+	State *WorkflowState
+	User  string // who asked for the review
+	Time  time.Time
+}
+
+// WebTime - When the review was asked for, in a format for the web
+func (r ReviewItem) WebTime() string {
+	return r.Post.Site.WebTime(r.Time)
+}
+
+// ReviewQueue - This site's posts which are waiting for a reviewer, oldest
+// first.
+func (s *Site) ReviewQueue() []ReviewItem {
+	queue := []ReviewItem{}
+	wf := shimWorkflow()
+	if wf == nil {
+		return queue
+	}
+
+	workflowLock.Lock()
+	states, err := s.readWorkflowStates()
+	workflowLock.Unlock()
+	if err != nil {
+		log.Printf("Could not read workflow states: %s\n", err.Error())
+	}
+
+	s.GetAllPosts()
+	for _, p := range s.Posts {
+		recorded := states.Posts[p.PostID()]
+		state := s.postWorkflowState(wf, p, recorded)
+		if !state.Review {
+			continue
+		}
+
+		item := ReviewItem{Post: p, State: state}
+		if recorded != nil {
+			item.User = recorded.User
+			item.Time = recorded.Time
+		}
+		queue = append(queue, item)
+	}
+
+	sort.SliceStable(queue, func(i, j int) bool { return queue[i].Time.Before(queue[j].Time) })
+	return queue
+}
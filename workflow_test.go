@@ -0,0 +1,141 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestWorkflowTransition(t *testing.T) {
+	wf := defaultWorkflow()
+
+	inputs := []struct {
+		from, to, role string
+	}{
+		{"draft", "review", roleAuthor},
+		{"review", "approved", roleAuthor},
+		{"review", "approved", roleEditor},
+		{"approved", "published", roleAuthor},
+		{"draft", "published", roleAuthor},
+		{"draft", "published", roleEditor},
+		{"draft", "published", roleAdmin},
+		{"review", "published", roleAdmin},
+		{"published", "draft", roleAuthor},
+		{"published", "draft", roleAdmin},
+	}
+
+	// Publishing is blocked until a post is approved, even for admins
+	outputs := []bool{true, false, true, true, false, false, false, false, false, true}
+
+	for i, input := range inputs {
+		_, err := wf.transition(input.from, input.to, input.role)
+		if (err == nil) != outputs[i] {
+			t.Errorf("Moving from %s to %s as %s should be allowed: %t, not %v\n",
+				input.from, input.to, input.role, outputs[i], err)
+		}
+	}
+}
+
+func TestWorkflowAllowed(t *testing.T) {
+	wf := defaultWorkflow()
+
+	inputs := []struct {
+		from, role string
+	}{
+		{"draft", roleAuthor},
+		{"review", roleAuthor},
+		{"review", roleEditor},
+		{"approved", roleAdmin},
+		{"published", roleAuthor},
+		{"published", "nobody"},
+	}
+
+	outputs := [][]string{
+		{"review"},
+		{"draft"},
+		{"draft", "approved"},
+		{"published", "draft"},
+		{},
+		{},
+	}
+
+	for i, input := range inputs {
+		to := []string{}
+		for _, transition := range wf.Allowed(input.from, input.role) {
+			to = append(to, transition.To)
+		}
+		if strings.Join(to, " ") != strings.Join(outputs[i], " ") {
+			t.Errorf("%s should be able to move posts from %s to %v, not %v\n",
+				input.role, input.from, outputs[i], to)
+		}
+	}
+}
+
+func TestMoveTo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shim-workflow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	postPath := filepath.Join(dir, "content", "post", "a.md")
+	os.MkdirAll(filepath.Dir(postPath), 0755)
+	ioutil.WriteFile(postPath, []byte("+++\ntitle = \"A\"\ndraft = true\n+++\nHello\n"), 0644)
+
+	config := viper.New()
+	config.Set("users.ed.role", roleEditor)
+	config.Set("users.al.role", roleAuthor)
+	old := shim.state
+	setShimState(shimState{config: config, assets: old.assets, workflow: defaultWorkflow()})
+	defer setShimState(old)
+	defer os.RemoveAll(dir)
+
+	s := &Site{Location: dir, contentDir: "content"}
+	s.buildLock.lock = &sync.Mutex{}
+	s.buildLock.pending = &sync.WaitGroup{}
+	// Saving posts rebuilds the site in the background
+	defer s.waitForBackground()
+	s.GetAllPosts()
+	p := s.Posts[0]
+
+	moves := []struct {
+		to, user string
+	}{
+		{"published", "ed"},
+		{"review", "al"},
+		{"approved", "al"},
+		{"approved", "ed"},
+		{"published", "al"},
+	}
+
+	outputs := []struct {
+		ok    bool
+		state string
+	}{
+		{false, "draft"},
+		{true, "review"},
+		{false, "review"},
+		{true, "approved"},
+		{true, "published"},
+	}
+
+	for i, move := range moves {
+		err := p.MoveTo(move.to, move.user, "Hello\n")
+		if (err == nil) != outputs[i].ok {
+			t.Errorf("Moving to %s as %s should work: %t, not %v\n", move.to, move.user, outputs[i].ok, err)
+		}
+		if state := p.WorkflowState().Name; state != outputs[i].state {
+			t.Errorf("The post should be in %s after moving to %s as %s, not %s\n",
+				outputs[i].state, move.to, move.user, state)
+		}
+	}
+
+	s.waitForBackground()
+	s.GetAllPosts()
+	if s.Posts[0].Draft {
+		t.Errorf("The post should have been published\n")
+	}
+}